@@ -0,0 +1,169 @@
+/*
+
+Copyright (C) 2024 Jackie Deng
+
+Permission to use, copy, modify, and/or distribute this software for any
+purpose with or without fee is hereby granted.
+
+THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES WITH
+REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF MERCHANTABILITY AND
+FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY SPECIAL, DIRECT,
+INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES WHATSOEVER RESULTING FROM
+LOSS OF USE, DATA OR PROFITS, WHETHER IN AN ACTION OF CONTRACT, NEGLIGENCE OR
+OTHER TORTIOUS ACTION, ARISING OUT OF OR IN CONNECTION WITH THE USE OR
+PERFORMANCE OF THIS SOFTWARE.
+
+*/
+
+package gowe
+
+import (
+	"bufio"
+	"compress/bzip2"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+)
+
+/** Compression **/
+
+// Decompressor wraps a compressed stream with a reader of the decompressed
+// bytes
+type Decompressor func(r io.Reader) (io.Reader, error)
+
+type compression struct {
+	name         string
+	magic        []byte
+	exts         []string
+	decompressor Decompressor
+}
+
+// Compressed models are recognized by their magic bytes, or by their file
+// extension if the stream is too short to hold the magic bytes. gzip and bzip2 are decoded with
+// the standard library while xz and zstd need a Decompressor registered with
+// RegisterDecompressor.
+var (
+	compressionsMu sync.RWMutex
+	compressions   = []*compression{
+		{
+			name:  "gzip",
+			magic: []byte{0x1f, 0x8b},
+			exts:  []string{".gz", ".gzip"},
+			decompressor: func(r io.Reader) (io.Reader, error) {
+				return gzip.NewReader(r)
+			},
+		},
+		{
+			// "BZh" + block size + the block magic (the BCD digits of pi)
+			name:  "bzip2",
+			magic: []byte("BZh?1AY&SY"),
+			exts:  []string{".bz2", ".bzip2"},
+			decompressor: func(r io.Reader) (io.Reader, error) {
+				return bzip2.NewReader(r), nil
+			},
+		},
+		{
+			name:  "xz",
+			magic: []byte{0xfd, '7', 'z', 'X', 'Z', 0x00},
+			exts:  []string{".xz"},
+		},
+		{
+			name:  "zstd",
+			magic: []byte{0x28, 0xb5, 0x2f, 0xfd},
+			exts:  []string{".zst", ".zstd"},
+		},
+	}
+)
+
+// RegisterDecompressor sets the Decompressor used for a compression format,
+// one of "gzip", "bzip2", "xz" or "zstd". This keeps gowe free of third party
+// dependencies while allowing any xz or zstd implementation to be used e.g.
+//
+//	gowe.RegisterDecompressor("zstd", func(r io.Reader) (io.Reader, error) {
+//		return zstd.NewReader(r)
+//	})
+func RegisterDecompressor(name string, d Decompressor) error {
+	compressionsMu.Lock()
+	defer compressionsMu.Unlock()
+	for _, c := range compressions {
+		if c.name == name {
+			c.decompressor = d
+			return nil
+		}
+	}
+	return fmt.Errorf("Unknown compression format %q", name)
+}
+
+// matchesMagic compares the start of a stream to magic bytes where '?' in
+// magic matches any byte
+func matchesMagic(head, magic []byte) bool {
+	if len(head) < len(magic) {
+		return false
+	}
+	for i := range magic {
+		if magic[i] != '?' && magic[i] != head[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// detectCompression determines the compression of a stream from its first
+// bytes, it returns nil if the stream isn't compressed. The extension of its
+// file name is only trusted if there are too few bytes to sniff, so that an
+// already decompressed model keeps working under its compressed name.
+func detectCompression(head []byte, ext string) *compression {
+	compressionsMu.RLock()
+	defer compressionsMu.RUnlock()
+	for _, c := range compressions {
+		if matchesMagic(head, c.magic) {
+			return c
+		}
+	}
+	ext = strings.ToLower(ext)
+	for _, c := range compressions {
+		for _, e := range c.exts {
+			if ext == e && len(head) < len(c.magic) {
+				return c
+			}
+		}
+	}
+	return nil
+}
+
+// decompress returns a reader of the decompressed contents of r if it is
+// compressed, otherwise a reader of r itself. ext is the file extension of
+// the stream if known, or "" otherwise.
+func decompress(r io.Reader, ext string) (io.Reader, error) {
+	dr, _, err := decompressNamed(r, ext)
+	return dr, err
+}
+
+// decompressNamed is decompress but also returns the name of the compression
+// format, or "" if the stream isn't compressed
+func decompressNamed(r io.Reader, ext string) (io.Reader, string, error) {
+	br := bufio.NewReader(r)
+	// A short stream can't be compressed, so the error is irrelevant here and
+	// will surface when parsing
+	head, _ := br.Peek(16)
+	c := detectCompression(head, ext)
+	if c == nil {
+		return br, "", nil
+	}
+
+	compressionsMu.RLock()
+	d := c.decompressor
+	compressionsMu.RUnlock()
+	if d == nil {
+		return nil, c.name, fmt.Errorf("Model is %s compressed but no "+
+			"Decompressor is registered for %s", c.name, c.name)
+	}
+	dr, err := d(br)
+	if err != nil {
+		return nil, c.name, fmt.Errorf("Could not decompress %s model: %w",
+			c.name, err)
+	}
+	return dr, c.name, nil
+}
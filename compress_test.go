@@ -0,0 +1,135 @@
+/*
+
+Copyright (C) 2024 Jackie Deng
+
+Permission to use, copy, modify, and/or distribute this software for any
+purpose with or without fee is hereby granted.
+
+THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES WITH
+REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF MERCHANTABILITY AND
+FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY SPECIAL, DIRECT,
+INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES WHATSOEVER RESULTING FROM
+LOSS OF USE, DATA OR PROFITS, WHETHER IN AN ACTION OF CONTRACT, NEGLIGENCE OR
+OTHER TORTIOUS ACTION, ARISING OUT OF OR IN CONNECTION WITH THE USE OR
+PERFORMANCE OF THIS SOFTWARE.
+
+*/
+
+package gowe
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// bzip2 compressed testPlain(false), the standard library has no bzip2 writer
+var testPlainBzip2 = []byte{
+	0x42, 0x5a, 0x68, 0x39, 0x31, 0x41, 0x59, 0x26, 0x53, 0x59, 0x44, 0xb8,
+	0x5d, 0xbc, 0x00, 0x00, 0x14, 0xd9, 0x80, 0x00, 0x10, 0x40, 0x03, 0x72,
+	0x80, 0x2c, 0x80, 0x94, 0x00, 0x20, 0x00, 0x21, 0xa6, 0x53, 0x40, 0x68,
+	0xc8, 0x53, 0x00, 0x04, 0xd1, 0xef, 0x96, 0x83, 0xda, 0x41, 0xf2, 0xd8,
+	0x40, 0x82, 0x98, 0x68, 0x13, 0xb6, 0xe1, 0x10, 0x94, 0xcf, 0xa4, 0xda,
+	0xaa, 0xcf, 0xf1, 0x77, 0x24, 0x53, 0x85, 0x09, 0x04, 0x4b, 0x85, 0xdb,
+	0xc0,
+}
+
+func gzipped(data []byte) []byte {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write(data)
+	zw.Close()
+	return buf.Bytes()
+}
+
+func TestGzipModels(t *testing.T) {
+	m := NewFloatModel[float32]()
+	err := m.FromPlainReader(
+		bytes.NewReader(gzipped([]byte(testPlain(true)))), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkTestFloatModel(t, m)
+
+	p := filepath.Join(t.TempDir(), "model.bin.gz")
+	if err := os.WriteFile(p, gzipped(testBinary()), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	m = NewFloatModel[float32]()
+	if err := m.FromBinaryFile(p, 32); err != nil {
+		t.Fatal(err)
+	}
+	checkTestFloatModel(t, m)
+
+	// A model that was already decompressed keeps its name
+	plain := filepath.Join(t.TempDir(), "model.txt.gz")
+	if err := os.WriteFile(plain, []byte(testPlain(true)),
+		0o644); err != nil {
+		t.Fatal(err)
+	}
+	m = NewFloatModel[float32]()
+	if err := m.LoadPlainFile(plain, WithHeader(true)); err != nil {
+		t.Fatal(err)
+	}
+	checkTestFloatModel(t, m)
+
+	im := NewIntModel[int8]()
+	if err := im.FromBinaryFile(p, 32, 2.0); err != nil {
+		t.Fatal(err)
+	}
+	if im.VocabularySize() != 3 {
+		t.Errorf("IntModel from gzip should have 3 words, got %d",
+			im.VocabularySize())
+	}
+}
+
+func TestBzip2Models(t *testing.T) {
+	m := NewFloatModel[float32]()
+	err := m.FromPlainReader(bytes.NewReader(testPlainBzip2), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkTestFloatModel(t, m)
+
+	im := NewIntModel[int16]()
+	err = im.FromPlainReader(bytes.NewReader(testPlainBzip2), false, 2.0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if im.VocabularySize() != 3 {
+		t.Errorf("IntModel from bzip2 should have 3 words, got %d",
+			im.VocabularySize())
+	}
+}
+
+func TestRegisterDecompressor(t *testing.T) {
+	zstdMagic := []byte{0x28, 0xb5, 0x2f, 0xfd}
+	data := append(zstdMagic, testPlain(false)...)
+
+	m := NewFloatModel[float32]()
+	if err := m.FromPlainReader(bytes.NewReader(data), false); err == nil {
+		t.Error("zstd model without a registered Decompressor should fail")
+	}
+
+	// A fake zstd decoder that strips the magic bytes
+	err := RegisterDecompressor("zstd", func(r io.Reader) (io.Reader, error) {
+		_, err := io.ReadFull(r, make([]byte, len(zstdMagic)))
+		return r, err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer RegisterDecompressor("zstd", nil)
+
+	if err := m.FromPlainReader(bytes.NewReader(data), false); err != nil {
+		t.Fatal(err)
+	}
+	checkTestFloatModel(t, m)
+
+	if RegisterDecompressor("lz4", nil) == nil {
+		t.Error("Registering an unknown compression format should fail")
+	}
+}
@@ -0,0 +1,397 @@
+/*
+
+Copyright (C) 2024 Jackie Deng
+
+Permission to use, copy, modify, and/or distribute this software for any
+purpose with or without fee is hereby granted.
+
+THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES WITH
+REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF MERCHANTABILITY AND
+FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY SPECIAL, DIRECT,
+INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES WHATSOEVER RESULTING FROM
+LOSS OF USE, DATA OR PROFITS, WHETHER IN AN ACTION OF CONTRACT, NEGLIGENCE OR
+OTHER TORTIOUS ACTION, ARISING OUT OF OR IN CONNECTION WITH THE USE OR
+PERFORMANCE OF THIS SOFTWARE.
+
+*/
+
+package gowe
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"unicode/utf8"
+)
+
+/** Format Detection **/
+
+// Format is the encoding of a model file
+type Format int
+
+const (
+	FormatUnknown Format = iota
+	FormatPlain
+	FormatBinary
+	FormatNative
+	FormatFastText
+)
+
+func (f Format) String() string {
+	switch f {
+	case FormatPlain:
+		return "plain"
+	case FormatBinary:
+		return "binary"
+	case FormatNative:
+		return "native"
+	case FormatFastText:
+		return "fastText"
+	}
+	return "unknown"
+}
+
+// FormatInfo describes a model stream as detected by DetectFormat
+type FormatInfo struct {
+	Format Format
+	// Compression is the compression format of the stream e.g. "gzip", or ""
+	// if it isn't compressed
+	Compression string
+	// Header is whether the stream starts with a "<size> <dim>" description
+	// (or the header of a native or fastText model)
+	Header bool
+	// Size is the vocabulary size given by the header, or 0 without one
+	Size uint
+	// Dim is the number of dimensions of each vector
+	Dim uint
+	// BitSize is the size of the floats in a binary or native model, 32 or
+	// 64, and 0 for plaintext and integer native models
+	BitSize int
+	// Scalar is the scalar type of a native model e.g. "int8"
+	Scalar string
+}
+
+func (f FormatInfo) String() string {
+	s := f.Format.String()
+	if f.Compression != "" {
+		s = f.Compression + " compressed " + s
+	}
+	if f.Header {
+		s += fmt.Sprintf(" with header, %d words of", f.Size)
+	} else {
+		s += " without header,"
+	}
+	s += fmt.Sprintf(" %d dimensions", f.Dim)
+	if f.Scalar != "" {
+		s += " of " + f.Scalar
+	} else if f.BitSize != 0 {
+		s += fmt.Sprintf(" of float%d", f.BitSize)
+	}
+	return s
+}
+
+// Options returns the LoadOptions that load the detected format
+func (f FormatInfo) Options() []LoadOption {
+	opts := []LoadOption{WithHeader(f.Header)}
+	if f.BitSize != 0 {
+		opts = append(opts, WithBitSize(f.BitSize))
+	}
+	return opts
+}
+
+const (
+	// sniffSize is how much of a stream DetectFormat may look at, enough for
+	// a few records of a model with thousands of dimensions
+	sniffSize = 1 << 18
+	// sniffRecords is how many records are checked against a format
+	sniffRecords = 3
+	// maxSniffWordLen bounds the length of a word in a binary record
+	maxSniffWordLen = 1 << 10
+	// maxSniffMagnitude bounds the binary scalars of a plausible embedding
+	maxSniffMagnitude = 1e6
+)
+
+// DetectFormat determines the format of a model stream by sniffing its first
+// bytes: whether it is compressed or native, whether it starts with a
+// "<size> <dim>" description and whether the records that follow are
+// plaintext or binary with 4 or 8 bytes per scalar. The sniffed bytes are
+// consumed from r, so the model must be loaded from the returned reader,
+// which starts at the beginning of the decompressed stream.
+func DetectFormat(r io.Reader) (FormatInfo, io.Reader, error) {
+	return detectFormat(r, "")
+}
+
+func detectFormat(r io.Reader, ext string) (FormatInfo, io.Reader, error) {
+	var info FormatInfo
+	dr, compression, err := decompressNamed(r, ext)
+	if err != nil {
+		return info, nil, err
+	}
+	info.Compression = compression
+
+	br := bufio.NewReaderSize(dr, sniffSize)
+	head, err := br.Peek(sniffSize)
+	eof := err != nil
+	if eof && err != io.EOF && err != bufio.ErrBufferFull {
+		return info, nil, err
+	}
+	if len(head) == 0 {
+		return info, nil, errors.New("Could not detect format of empty model")
+	}
+
+	if bytes.HasPrefix(head, []byte(nativeMagic)) {
+		h, err := unmarshalNativeHeader(head)
+		if err != nil {
+			return info, nil, err
+		}
+		info.Format = FormatNative
+		info.Header = true
+		info.Size = uint(h.size)
+		info.Dim = uint(h.dim)
+		info.Scalar = h.scalar.String()
+		switch h.scalar {
+		case scalarFloat32:
+			info.BitSize = 32
+		case scalarFloat64:
+			info.BitSize = 64
+		}
+		return info, br, nil
+	}
+
+	// fastText models start with the magic number and version followed by
+	// the dim argument, the number of words follows the arguments
+	if len(head) >= 72 && binary.LittleEndian.Uint32(head) == fastTextMagic {
+		info.Format = FormatFastText
+		info.Header = true
+		info.Dim = uint(binary.LittleEndian.Uint32(head[8:]))
+		info.Size = uint(binary.LittleEndian.Uint32(head[68:]))
+		info.BitSize = 32
+		return info, br, nil
+	}
+
+	line, rest, ok := sniffLine(head, eof)
+	if !ok {
+		return info, nil, errors.New("Could not detect format, first line " +
+			"is too long")
+	}
+
+	if size, dim, ok := sniffDescription(line); ok {
+		info.Header = true
+		info.Size = size
+		info.Dim = dim
+		switch {
+		case sniffPlain(rest, dim, eof):
+			info.Format = FormatPlain
+		case sniffBinary(rest, dim, 4, eof):
+			info.Format = FormatBinary
+			info.BitSize = 32
+		case sniffBinary(rest, dim, 8, eof):
+			info.Format = FormatBinary
+			info.BitSize = 64
+		default:
+			return info, nil, fmt.Errorf("Could not detect format, records "+
+				"after the description don't match %d dimensions", dim)
+		}
+		return info, br, nil
+	}
+
+	// Without a description only plaintext is possible, with the dimensions
+	// of the first line
+	fields := bytes.Fields(line)
+	if len(fields) < 2 || !sniffPlain(head, uint(len(fields)-1), eof) {
+		return info, nil, errors.New("Could not detect format, not a " +
+			"plaintext, binary or native model")
+	}
+	info.Format = FormatPlain
+	info.Dim = uint(len(fields) - 1)
+	return info, br, nil
+}
+
+// sniffLine splits the first line from head, it fails if the line doesn't
+// end within head
+func sniffLine(head []byte, eof bool) ([]byte, []byte, bool) {
+	i := bytes.IndexByte(head, '\n')
+	if i < 0 {
+		return head, nil, eof
+	}
+	return head[:i], head[i+1:], true
+}
+
+// sniffDescription parses a "<size> <dim>" description
+func sniffDescription(line []byte) (uint, uint, bool) {
+	fields := bytes.Fields(line)
+	if len(fields) != 2 {
+		return 0, 0, false
+	}
+	size, err := strconv.ParseUint(string(fields[0]), 10, 0)
+	if err != nil {
+		return 0, 0, false
+	}
+	dim, err := strconv.ParseUint(string(fields[1]), 10, 0)
+	if err != nil || dim == 0 {
+		return 0, 0, false
+	}
+	return uint(size), uint(dim), true
+}
+
+// sniffPlain checks that the first records of head are plaintext lines of a
+// word and dim floats
+func sniffPlain(head []byte, dim uint, eof bool) bool {
+	checked := 0
+	for checked < sniffRecords && len(head) > 0 {
+		line, rest, ok := sniffLine(head, eof)
+		if !ok {
+			break
+		}
+		fields := bytes.Fields(line)
+		if uint(len(fields)) != dim+1 {
+			return false
+		}
+		for _, field := range fields[1:] {
+			if _, err := strconv.ParseFloat(string(field), 64); err != nil {
+				return false
+			}
+		}
+		checked++
+		head = rest
+	}
+	return checked > 0
+}
+
+// sniffBinary checks that the first records of head are a word followed by
+// dim little endian floats of width bytes
+func sniffBinary(head []byte, dim uint, width int, eof bool) bool {
+	checked := 0
+	for checked < sniffRecords {
+		// word2vec ends each vector with a newline
+		head = bytes.TrimLeft(head, "\n")
+		if len(head) == 0 {
+			return eof && checked > 0
+		}
+		i := bytes.IndexByte(head[:min(len(head), maxSniffWordLen)], ' ')
+		if i <= 0 {
+			return !eof && checked > 0 && len(head) < maxSniffWordLen
+		}
+		word := head[:i]
+		if !utf8.Valid(word) || bytes.ContainsAny(word, "\n\x00") {
+			return false
+		}
+		head = head[i+1:]
+
+		n := int(dim) * width
+		if len(head) < n {
+			return !eof && checked > 0
+		}
+		for j := 0; j < n; j += width {
+			var f float64
+			if width == 4 {
+				f = float64(math.Float32frombits(
+					binary.LittleEndian.Uint32(head[j:])))
+			} else {
+				f = math.Float64frombits(binary.LittleEndian.Uint64(head[j:]))
+			}
+			if math.IsNaN(f) || math.Abs(f) > maxSniffMagnitude {
+				return false
+			}
+		}
+		head = head[n:]
+		checked++
+	}
+	return true
+}
+
+// newModel returns an empty FloatModel or IntModel for the scalar type T
+func newModel[T VectorScalar]() Model[T] {
+	var m any
+	switch scalarTypeOf[T]() {
+	case scalarFloat32:
+		m = NewFloatModel[float32]()
+	case scalarFloat64:
+		m = NewFloatModel[float64]()
+	case scalarInt8:
+		m = NewIntModel[int8]()
+	case scalarInt16:
+		m = NewIntModel[int16]()
+	case scalarInt32:
+		m = NewIntModel[int32]()
+	}
+	return m.(Model[T])
+}
+
+// Load detects the format of the model file at p and loads it into a
+// FloatModel for float scalars or an IntModel for integer scalars, which also
+// need WithMaxMagnitude unless the file is native. fastText models are loaded
+// into a FastTextModel and need T to be float32. opts are applied after the
+// detected options, so they can override them.
+func Load[T VectorScalar](p string, opts ...LoadOption) (Model[T],
+	FormatInfo, error) {
+
+	file, err := os.Open(p)
+	if err != nil {
+		return nil, FormatInfo{}, err
+	}
+	defer file.Close()
+
+	return loadDetected[T](file, filepath.Ext(p), opts)
+}
+
+// LoadReader is Load for a model stream
+func LoadReader[T VectorScalar](r io.Reader, opts ...LoadOption) (Model[T],
+	FormatInfo, error) {
+
+	return loadDetected[T](r, "", opts)
+}
+
+func loadDetected[T VectorScalar](r io.Reader, ext string,
+	opts []LoadOption) (Model[T], FormatInfo, error) {
+
+	// The context and progress cover detection, which reads the stream
+	// first
+	o := newLoadOptions(opts)
+	r, err := o.track(r)
+	if err != nil {
+		return nil, FormatInfo{}, err
+	}
+	if o.tracker != nil {
+		opts = append(opts, withTracker(o.tracker))
+	}
+	info, r, err := detectFormat(r, ext)
+	if err != nil {
+		return nil, info, o.finish(err)
+	}
+
+	if info.Format == FormatFastText {
+		if scalarTypeOf[T]() != scalarFloat32 {
+			return nil, info, errors.New("fastText models can only be " +
+				"loaded as float32")
+		}
+		m := NewFastTextModel()
+		if err := m.LoadFastText(r, opts...); err != nil {
+			return nil, info, o.finish(err)
+		}
+		o.loaded(int(m.VocabularySize()))
+		return any(m).(Model[T]), info, o.finish(nil)
+	}
+
+	m := newModel[T]()
+	opts = append(info.Options(), opts...)
+	switch info.Format {
+	case FormatPlain:
+		err = m.LoadPlain(r, opts...)
+	case FormatBinary:
+		err = m.LoadBinary(r, opts...)
+	case FormatNative:
+		err = m.LoadNative(r, opts...)
+	}
+	if err != nil {
+		return nil, info, o.finish(err)
+	}
+	return m, info, o.finish(nil)
+}
@@ -0,0 +1,169 @@
+/*
+
+Copyright (C) 2024 Jackie Deng
+
+Permission to use, copy, modify, and/or distribute this software for any
+purpose with or without fee is hereby granted.
+
+THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES WITH
+REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF MERCHANTABILITY AND
+FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY SPECIAL, DIRECT,
+INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES WHATSOEVER RESULTING FROM
+LOSS OF USE, DATA OR PROFITS, WHETHER IN AN ACTION OF CONTRACT, NEGLIGENCE OR
+OTHER TORTIOUS ACTION, ARISING OUT OF OR IN CONNECTION WITH THE USE OR
+PERFORMANCE OF THIS SOFTWARE.
+
+*/
+
+package gowe
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func testBinary64() []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%d %d\n", len(testWords), len(testVectors[0]))
+	for i, word := range testWords {
+		buf.WriteString(word + " ")
+		for _, f := range testVectors[i] {
+			binary.Write(&buf, binary.LittleEndian, float64(f))
+		}
+		buf.WriteString("\n")
+	}
+	return buf.Bytes()
+}
+
+func TestDetectFormat(t *testing.T) {
+	var native bytes.Buffer
+	m := NewFloatModel[float32]()
+	err := m.LoadPlain(strings.NewReader(testPlain(false)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.WriteNativeTo(&native); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		data []byte
+		want FormatInfo
+	}{
+		{"plain", []byte(testPlain(false)),
+			FormatInfo{Format: FormatPlain, Dim: 3}},
+		{"plain header", []byte(testPlain(true)),
+			FormatInfo{Format: FormatPlain, Header: true, Size: 3, Dim: 3}},
+		{"binary32", testBinary(), FormatInfo{Format: FormatBinary,
+			Header: true, Size: 3, Dim: 3, BitSize: 32}},
+		{"binary64", testBinary64(), FormatInfo{Format: FormatBinary,
+			Header: true, Size: 3, Dim: 3, BitSize: 64}},
+		{"gzip binary", gzipped(testBinary()), FormatInfo{
+			Format: FormatBinary, Compression: "gzip", Header: true, Size: 3,
+			Dim: 3, BitSize: 32}},
+		{"native", native.Bytes(), FormatInfo{Format: FormatNative,
+			Header: true, Size: 3, Dim: 3, BitSize: 32, Scalar: "float32"}},
+	}
+	for _, test := range tests {
+		info, r, err := DetectFormat(bytes.NewReader(test.data))
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if info != test.want {
+			t.Errorf("%s: should detect %v, got %v", test.name, test.want,
+				info)
+		}
+
+		m, info, err := LoadReader[float32](bytes.NewReader(test.data))
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		checkTestFloatModel(t, m.(*FloatModel[float32]))
+
+		// The returned reader should replay the sniffed bytes
+		data, err := io.ReadAll(r)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		}
+		if info.Compression == "" && !bytes.Equal(data, test.data) {
+			t.Errorf("%s: reader should start at the beginning of the model",
+				test.name)
+		}
+	}
+
+	for _, data := range []string{"", "cat dog road\n", "3 3\ncat 1 2\n"} {
+		if _, _, err := DetectFormat(strings.NewReader(data)); err == nil {
+			t.Errorf("DetectFormat of %q should fail", data)
+		}
+	}
+}
+
+func TestLoad(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "model.bin.gz")
+	if err := os.WriteFile(p, gzipped(testBinary64()), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	m, info, err := Load[int16](p, WithMaxMagnitude(2.0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.BitSize != 64 {
+		t.Errorf("Load should detect 64 bit floats, got %d", info.BitSize)
+	}
+	if m.VocabularySize() != 3 || m.Dimensions() != 3 {
+		t.Errorf("Load should load 3 words of 3 dimensions, got %d of %d",
+			m.VocabularySize(), m.Dimensions())
+	}
+	if s := m.Similarity("cat", "dog"); s < 0.9 {
+		t.Errorf("Similarity of cat and dog should be about 0.94, got %f", s)
+	}
+}
+
+func TestLoadNativeOptions(t *testing.T) {
+	q := NewIntModel[int8]()
+	if err := q.LoadPlain(strings.NewReader(testPlain(false)),
+		WithMaxMagnitude(2)); err != nil {
+		t.Fatal(err)
+	}
+	p := filepath.Join(t.TempDir(), "model.gowe")
+	if err := q.WriteNativeFile(p); err != nil {
+		t.Fatal(err)
+	}
+
+	var calls progressCalls
+	m, _, err := Load[float32](p, WithMaxWords(2),
+		WithKeep(func(word string) bool { return word != "cat" }),
+		WithProgress(calls.record, 1<<62))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if words := slices.Collect(m.Words()); !slices.Equal(words,
+		[]string{"dog", "road"}) {
+		t.Errorf("Load of a native model should filter to [dog road], got %v",
+			words)
+	}
+	if len(calls) != 1 || calls[0][0] != 2 {
+		t.Errorf("Load of a native model should report 2 words once, got %v",
+			calls)
+	}
+
+	// The shift of the model can't be changed by WithMaxMagnitude
+	if _, _, err := Load[int8](p, WithMaxMagnitude(100)); err == nil {
+		t.Error("Load of a native model with another shift should fail")
+	}
+	if _, _, err := Load[int8](p, WithMaxMagnitude(2)); err != nil {
+		t.Errorf("Load of a native model with its shift should work, got %v",
+			err)
+	}
+}
@@ -0,0 +1,613 @@
+/*
+
+Copyright (C) 2024 Jackie Deng
+
+Permission to use, copy, modify, and/or distribute this software for any
+purpose with or without fee is hereby granted.
+
+THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES WITH
+REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF MERCHANTABILITY AND
+FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY SPECIAL, DIRECT,
+INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES WHATSOEVER RESULTING FROM
+LOSS OF USE, DATA OR PROFITS, WHETHER IN AN ACTION OF CONTRACT, NEGLIGENCE OR
+OTHER TORTIOUS ACTION, ARISING OUT OF OR IN CONNECTION WITH THE USE OR
+PERFORMANCE OF THIS SOFTWARE.
+
+*/
+
+package gowe
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+)
+
+/** fastText **/
+
+// fastText .bin and .ftz files start with this magic number and version, the
+// version is 12 since quantization was added and 11 before
+const (
+	fastTextMagic   = 793712314
+	fastTextVersion = 12
+
+	fastTextBOW = "<"
+	fastTextEOW = ">"
+	fastTextEOS = "</s>"
+
+	fastTextWordEntry = 0
+	// fastTextSupervised is the model type of classifiers, which before
+	// version 12 were trained without character n-grams
+	fastTextSupervised = 3
+	// fastTextKsub is the number of centroids of each sub-quantizer of a
+	// quantized (.ftz) model
+	fastTextKsub = 256
+	// fastTextChunk bounds how many floats are allocated ahead of reading
+	// them, so that a corrupt matrix size fails on EOF rather than allocation
+	fastTextChunk = 1 << 20
+)
+
+// FastTextModel is a float32 model of the word vectors of a fastText model
+// trained with character n-grams. Like fastText, the vector of a word is the
+// average of the vectors of the word and its n-grams, so Vector and Similarity
+// also work for words out of the vocabulary as long as they share n-grams
+// with it.
+type FastTextModel struct {
+	*FloatModel[float32]
+	minn, maxn int
+	bucket     uint32
+	nwords     int32
+	// pruneidxSize is the number of n-gram buckets kept when quantizing, or
+	// -1 if all buckets are kept, pruneidx maps the kept buckets to their rows
+	pruneidxSize int64
+	pruneidx     map[int32]int32
+	// dropped holds the ids of the words skipped by a LoadFilter, which still
+	// have rows in the input matrix
+	dropped map[string]int32
+	input   fastTextMatrix
+}
+
+func NewFastTextModel() *FastTextModel {
+	return &FastTextModel{
+		FloatModel:   NewFloatModel[float32](),
+		pruneidxSize: -1,
+	}
+}
+
+// Vector returns the vector of a word, words out of the vocabulary are built
+// from their n-grams and get a zero vector if they have none
+func (m *FastTextModel) Vector(s string) []float32 {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	v, _ := m.vector(s)
+	return slices.Clone(v)
+}
+
+// Lookup returns the vector of a word and whether it is in the vocabulary or
+// has n-grams to build it from
+func (m *FastTextModel) Lookup(s string) ([]float32, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	v, ok := m.vector(s)
+	if !ok {
+		return nil, false
+	}
+	return slices.Clone(v), true
+}
+
+func (m *FastTextModel) Similarity(s, t string) float64 {
+	similarity, _ := m.SimilarityE(s, t)
+	return similarity
+}
+
+// SimilarityE returns the cosine similarity between two words, or an error
+// wrapping ErrWordNotFound if either is out of the vocabulary and has no
+// n-grams
+func (m *FastTextModel) SimilarityE(s, t string) (float64, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	v, ok := m.vector(s)
+	if !ok {
+		return 0, wordNotFound(s)
+	}
+	u, ok := m.vector(t)
+	if !ok {
+		return 0, wordNotFound(t)
+	}
+	return cosineSimilarity(v, u), nil
+}
+
+// readLock read locks the model for a search, whose query words are looked
+// up with their n-grams like Lookup
+func (m *FastTextModel) readLock() (Embedding[float32], func()) {
+	m.mu.RLock()
+	return fastTextView{storeView[float32]{store: &m.store}, m},
+		m.mu.RUnlock
+}
+
+// fastTextView is a storeView of a read locked FastTextModel whose words out
+// of the vocabulary are built from their n-grams
+type fastTextView struct {
+	storeView[float32]
+	m *FastTextModel
+}
+
+func (v fastTextView) Vector(s string) []float32 {
+	vector, _ := v.m.vector(s)
+	return vector
+}
+
+func (v fastTextView) Lookup(s string) ([]float32, bool) {
+	vector, ok := v.m.vector(s)
+	if !ok {
+		return nil, false
+	}
+	return vector, true
+}
+
+func (v fastTextView) Similarity(s, t string) float64 {
+	similarity, _ := v.SimilarityE(s, t)
+	return similarity
+}
+
+func (v fastTextView) SimilarityE(s, t string) (float64, error) {
+	a, ok := v.m.vector(s)
+	if !ok {
+		return 0, wordNotFound(s)
+	}
+	b, ok := v.m.vector(t)
+	if !ok {
+		return 0, wordNotFound(t)
+	}
+	return cosineSimilarity(a, b), nil
+}
+
+// vector returns the vector of a word and whether it is in the vocabulary or
+// has n-grams
+func (m *FastTextModel) vector(s string) ([]float32, bool) {
+	if v, ok := m.store.lookup(s); ok {
+		return v, true
+	}
+	var ids []int32
+	if id, ok := m.dropped[s]; ok {
+		ids = append(ids, id)
+	}
+	if m.input == nil {
+		return make([]float32, m.store.dim), false
+	}
+	ids = m.subwords(ids, s)
+	v := make([]float32, m.store.dim)
+	m.averageRows(v, ids)
+	return v, len(ids) > 0
+}
+
+// fastTextHash is the 32 bit FNV-1a hash used by fastText, which sign extends
+// each byte as C++ chars are signed
+func fastTextHash(s string) uint32 {
+	h := uint32(2166136261)
+	for i := 0; i < len(s); i++ {
+		h ^= uint32(int8(s[i]))
+		h *= 16777619
+	}
+	return h
+}
+
+// subwords appends the input matrix rows of the character n-grams of a word
+// to ids, n-grams are counted in UTF-8 characters and include the "<" and ">"
+// that fastText wraps words in
+func (m *FastTextModel) subwords(ids []int32, word string) []int32 {
+	if word == fastTextEOS || m.pruneidxSize == 0 || m.bucket == 0 {
+		return ids
+	}
+	word = fastTextBOW + word + fastTextEOW
+	for i := 0; i < len(word); i++ {
+		if word[i]&0xc0 == 0x80 {
+			continue
+		}
+		j := i
+		for n := 1; j < len(word) && n <= m.maxn; n++ {
+			j++
+			for j < len(word) && word[j]&0xc0 == 0x80 {
+				j++
+			}
+			// Single characters at the ends are just "<" or ">"
+			if n < m.minn || (n == 1 && (i == 0 || j == len(word))) {
+				continue
+			}
+			h := int32(fastTextHash(word[i:j]) % m.bucket)
+			if m.pruneidxSize > 0 {
+				var ok bool
+				if h, ok = m.pruneidx[h]; !ok {
+					continue
+				}
+			}
+			ids = append(ids, m.nwords+h)
+		}
+	}
+	return ids
+}
+
+// averageRows sets v to the average of rows of the input matrix
+func (m *FastTextModel) averageRows(v []float32, ids []int32) {
+	clear(v)
+	if len(ids) == 0 {
+		return
+	}
+	for _, id := range ids {
+		m.input.addRow(v, int64(id))
+	}
+	scale := 1 / float32(len(ids))
+	for i := range v {
+		v[i] *= scale
+	}
+}
+
+/** fastText Loading **/
+
+// fastTextArgs is the training arguments stored at the start of a model
+type fastTextArgs struct {
+	Dim, WS, Epoch, MinCount, Neg, WordNgrams, Loss, Model, Bucket, Minn,
+	Maxn, LRUpdateRate int32
+	T float64
+}
+
+type fastTextDictionary struct {
+	Size, NWords, NLabels int32
+	NTokens               int64
+}
+
+// LoadFastTextFile loads the word vectors of the fastText model file at p,
+// either a .bin model or a quantized .ftz model
+func (m *FastTextModel) LoadFastTextFile(p string, opts ...LoadOption) error {
+	return loadModelFile(p, opts, m.LoadFastText)
+}
+
+// LoadFastText loads the word vectors of a fastText model, only the
+// LoadFilter, context and progress of opts apply as the format is fully
+// described by the model. The vectors of the vocabulary are computed while
+// loading while the n-gram buckets are kept for words out of the vocabulary.
+// Labels and the output matrix of the model are ignored.
+func (m *FastTextModel) LoadFastText(r io.Reader, opts ...LoadOption) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	o := newLoadOptions(opts)
+
+	r, err := o.open(r)
+	if err != nil {
+		return o.finish(err)
+	}
+	return o.finish(m.readFastText(bufio.NewReader(r), o))
+}
+
+// readFastText reads a fastText model from its opened stream
+func (m *FastTextModel) readFastText(br *bufio.Reader, o *LoadOptions) error {
+	var magic [2]int32
+	if err := binary.Read(br, binary.LittleEndian, &magic); err != nil {
+		return err
+	}
+	if magic[0] != fastTextMagic {
+		return errors.New("Not a fastText model, magic number doesn't match")
+	}
+	version := magic[1]
+	if version > fastTextVersion {
+		return fmt.Errorf("Unsupported fastText model version %d", version)
+	}
+
+	var args fastTextArgs
+	if err := binary.Read(br, binary.LittleEndian, &args); err != nil {
+		return err
+	}
+	if args.Dim <= 0 || args.Bucket < 0 || args.Minn < 0 || args.Maxn < 0 {
+		return errors.New("Invalid fastText model arguments")
+	}
+	if version == 11 && args.Model == fastTextSupervised {
+		args.Maxn = 0
+	}
+	if m.input != nil || m.store.len() > 0 {
+		return errors.New("FastTextModel is already loaded")
+	}
+	if err := m.store.setDim(uint(args.Dim)); err != nil {
+		return err
+	}
+	m.minn, m.maxn = int(args.Minn), int(args.Maxn)
+	m.bucket = uint32(args.Bucket)
+
+	words, err := m.readDictionary(br, version)
+	if err != nil {
+		return err
+	}
+
+	quantized := false
+	if version >= fastTextVersion {
+		if err := binary.Read(br, binary.LittleEndian,
+			&quantized); err != nil {
+			return err
+		}
+	}
+	if quantized {
+		m.input, err = readFastTextQuant(br)
+	} else {
+		m.input, err = readFastTextDense(br)
+	}
+	if err != nil {
+		return err
+	}
+	// Quantization prunes the n-gram buckets to the rows in pruneidx
+	buckets := int64(args.Bucket)
+	if m.pruneidxSize >= 0 {
+		buckets = m.pruneidxSize
+	}
+	if m.input.dim() != int64(args.Dim) ||
+		m.input.rows() < int64(m.nwords)+buckets {
+		return errors.New("fastText input matrix doesn't match the " +
+			"dictionary")
+	}
+
+	m.store.reserve(o.Filter.capacity(uint(len(words))))
+	var ids []int32
+	for id, word := range words {
+		if !o.Filter.accepts(word) || o.Filter.full(m.store.len()) {
+			if m.dropped == nil {
+				m.dropped = make(map[string]int32)
+			}
+			m.dropped[word] = int32(id)
+			continue
+		}
+		ids = m.subwords(append(ids[:0], int32(id)), word)
+		m.averageRows(m.store.addRow(word), ids)
+		o.loaded(m.store.len())
+	}
+	return nil
+}
+
+// readDictionary reads the dictionary of a model and returns its words in
+// order of their ids
+func (m *FastTextModel) readDictionary(br *bufio.Reader,
+	version int32) ([]string, error) {
+
+	var dict fastTextDictionary
+	if err := binary.Read(br, binary.LittleEndian, &dict); err != nil {
+		return nil, err
+	}
+	if version >= fastTextVersion {
+		err := binary.Read(br, binary.LittleEndian, &m.pruneidxSize)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if dict.Size < 0 || dict.NWords < 0 || dict.NWords > dict.Size {
+		return nil, errors.New("Invalid fastText dictionary size")
+	}
+	m.nwords = dict.NWords
+
+	words := make([]string, 0, min(int(dict.NWords), maxReserve))
+	var entry [9]byte
+	for i := int32(0); i < dict.Size; i++ {
+		word, err := br.ReadString(0)
+		if err != nil {
+			return nil, err
+		}
+		// Each entry is followed by its int64 count and int8 type
+		if _, err := io.ReadFull(br, entry[:]); err != nil {
+			return nil, err
+		}
+		if entry[8] == fastTextWordEntry {
+			words = append(words, strings.TrimSuffix(word, "\x00"))
+		}
+	}
+	if len(words) != int(dict.NWords) {
+		return nil, errors.New("fastText dictionary has the wrong number " +
+			"of words")
+	}
+
+	if m.pruneidxSize > 0 {
+		m.pruneidx = make(map[int32]int32, min(m.pruneidxSize, maxReserve))
+		var pair [2]int32
+		for i := int64(0); i < m.pruneidxSize; i++ {
+			err := binary.Read(br, binary.LittleEndian, &pair)
+			if err != nil {
+				return nil, err
+			}
+			if pair[1] < 0 || int64(pair[1]) >= m.pruneidxSize {
+				return nil, errors.New("Invalid fastText pruned bucket")
+			}
+			m.pruneidx[pair[0]] = pair[1]
+		}
+	}
+	return words, nil
+}
+
+// readFastTextFloats reads n float32s, growing the slice as they are read
+func readFastTextFloats(br *bufio.Reader, n int64) ([]float32, error) {
+	if n < 0 {
+		return nil, errors.New("Invalid fastText matrix size")
+	}
+	var s []float32
+	for int64(len(s)) < n {
+		k := int(min(n-int64(len(s)), fastTextChunk))
+		s = slices.Grow(s, k)
+		chunk := s[len(s) : len(s)+k]
+		if err := readScalars(br, chunk, binary.LittleEndian); err != nil {
+			return nil, err
+		}
+		s = s[:len(s)+k]
+	}
+	return s, nil
+}
+
+/** fastText Matrices **/
+
+// fastTextMatrix is the input matrix of a model, with a row for each word
+// followed by a row for each n-gram bucket
+type fastTextMatrix interface {
+	rows() int64
+	dim() int64
+	// addRow adds row i of the matrix to v
+	addRow(v []float32, i int64)
+}
+
+type fastTextDense struct {
+	m, n int64
+	data []float32
+}
+
+func readFastTextDense(br *bufio.Reader) (*fastTextDense, error) {
+	var d fastTextDense
+	var size [2]int64
+	if err := binary.Read(br, binary.LittleEndian, &size); err != nil {
+		return nil, err
+	}
+	d.m, d.n = size[0], size[1]
+	if d.m < 0 || d.n <= 0 || d.m > (1<<62)/d.n {
+		return nil, errors.New("Invalid fastText matrix size")
+	}
+	data, err := readFastTextFloats(br, d.m*d.n)
+	if err != nil {
+		return nil, err
+	}
+	d.data = data
+	return &d, nil
+}
+
+func (d *fastTextDense) rows() int64 { return d.m }
+func (d *fastTextDense) dim() int64  { return d.n }
+
+func (d *fastTextDense) addRow(v []float32, i int64) {
+	row := d.data[i*d.n : (i+1)*d.n]
+	for j := range row {
+		v[j] += row[j]
+	}
+}
+
+// fastTextPQ is a product quantizer, which splits vectors into nsubq
+// sub-vectors of dsub dimensions (the last of lastdsub dimensions) that are
+// each encoded as one of 256 centroids
+type fastTextPQ struct {
+	dim, nsubq, dsub, lastdsub int32
+	centroids                  []float32
+}
+
+func readFastTextPQ(br *bufio.Reader) (*fastTextPQ, error) {
+	var pq fastTextPQ
+	var size [4]int32
+	if err := binary.Read(br, binary.LittleEndian, &size); err != nil {
+		return nil, err
+	}
+	pq.dim, pq.nsubq, pq.dsub, pq.lastdsub = size[0], size[1], size[2],
+		size[3]
+	if pq.dim <= 0 || pq.nsubq <= 0 || pq.dsub <= 0 || pq.lastdsub <= 0 ||
+		(pq.nsubq-1)*pq.dsub+pq.lastdsub != pq.dim {
+		return nil, errors.New("Invalid fastText product quantizer")
+	}
+	centroids, err := readFastTextFloats(br, int64(pq.dim)*fastTextKsub)
+	if err != nil {
+		return nil, err
+	}
+	pq.centroids = centroids
+	return &pq, nil
+}
+
+// centroid returns centroid i of sub-quantizer j
+func (pq *fastTextPQ) centroid(j int32, i uint8) []float32 {
+	if j == pq.nsubq-1 {
+		off := j*fastTextKsub*pq.dsub + int32(i)*pq.lastdsub
+		return pq.centroids[off : off+pq.lastdsub]
+	}
+	off := (j*fastTextKsub + int32(i)) * pq.dsub
+	return pq.centroids[off : off+pq.dsub]
+}
+
+// addCode adds the vector encoded by codes, scaled by alpha, to v
+func (pq *fastTextPQ) addCode(v []float32, codes []uint8, alpha float32) {
+	for j := int32(0); j < pq.nsubq; j++ {
+		c := pq.centroid(j, codes[j])
+		sub := v[j*pq.dsub:]
+		for k := range c {
+			sub[k] += alpha * c[k]
+		}
+	}
+}
+
+// fastTextQuant is the input matrix of a quantized model, rows are product
+// quantized and optionally normalized with their norms quantized separately
+type fastTextQuant struct {
+	m, n      int64
+	codes     []uint8
+	pq        *fastTextPQ
+	normCodes []uint8
+	npq       *fastTextPQ
+}
+
+func readFastTextQuant(br *bufio.Reader) (*fastTextQuant, error) {
+	var q fastTextQuant
+	var qnorm bool
+	if err := binary.Read(br, binary.LittleEndian, &qnorm); err != nil {
+		return nil, err
+	}
+	var size [2]int64
+	if err := binary.Read(br, binary.LittleEndian, &size); err != nil {
+		return nil, err
+	}
+	q.m, q.n = size[0], size[1]
+	var codesize int32
+	if err := binary.Read(br, binary.LittleEndian, &codesize); err != nil {
+		return nil, err
+	}
+	if q.m < 0 || q.n <= 0 || codesize < 0 {
+		return nil, errors.New("Invalid fastText matrix size")
+	}
+	codes, err := readFastTextCodes(br, int64(codesize))
+	if err != nil {
+		return nil, err
+	}
+	q.codes = codes
+	if q.pq, err = readFastTextPQ(br); err != nil {
+		return nil, err
+	}
+	if int64(q.pq.dim) != q.n || int64(codesize) < q.m*int64(q.pq.nsubq) {
+		return nil, errors.New("fastText quantized matrix doesn't match " +
+			"its product quantizer")
+	}
+	if qnorm {
+		if q.normCodes, err = readFastTextCodes(br, q.m); err != nil {
+			return nil, err
+		}
+		if q.npq, err = readFastTextPQ(br); err != nil {
+			return nil, err
+		}
+		if q.npq.dim != 1 {
+			return nil, errors.New("Invalid fastText norm quantizer")
+		}
+	}
+	return &q, nil
+}
+
+func readFastTextCodes(br *bufio.Reader, n int64) ([]uint8, error) {
+	var codes []uint8
+	for int64(len(codes)) < n {
+		k := int(min(n-int64(len(codes)), fastTextChunk))
+		codes = slices.Grow(codes, k)
+		if _, err := io.ReadFull(br,
+			codes[len(codes):len(codes)+k]); err != nil {
+			return nil, err
+		}
+		codes = codes[:len(codes)+k]
+	}
+	return codes, nil
+}
+
+func (q *fastTextQuant) rows() int64 { return q.m }
+func (q *fastTextQuant) dim() int64  { return q.n }
+
+func (q *fastTextQuant) addRow(v []float32, i int64) {
+	norm := float32(1)
+	if q.npq != nil {
+		norm = q.npq.centroid(0, q.normCodes[i])[0]
+	}
+	nsubq := int64(q.pq.nsubq)
+	q.pq.addCode(v, q.codes[i*nsubq:(i+1)*nsubq], norm)
+}
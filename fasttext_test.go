@@ -0,0 +1,219 @@
+/*
+
+Copyright (C) 2024 Jackie Deng
+
+Permission to use, copy, modify, and/or distribute this software for any
+purpose with or without fee is hereby granted.
+
+THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES WITH
+REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF MERCHANTABILITY AND
+FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY SPECIAL, DIRECT,
+INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES WHATSOEVER RESULTING FROM
+LOSS OF USE, DATA OR PROFITS, WHETHER IN AN ACTION OF CONTRACT, NEGLIGENCE OR
+OTHER TORTIOUS ACTION, ARISING OUT OF OR IN CONNECTION WITH THE USE OR
+PERFORMANCE OF THIS SOFTWARE.
+
+*/
+
+package gowe
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"math"
+	"slices"
+	"testing"
+)
+
+// testFastText builds a fastText model of dim 2 with minn 3, maxn 4 and 7
+// buckets where row i of the input matrix is {i, 2i + 1}, quantized models
+// encode row i as centroid i
+func testFastText(quantized bool) []byte {
+	var buf bytes.Buffer
+	w := func(data any) {
+		binary.Write(&buf, binary.LittleEndian, data)
+	}
+	w([]int32{fastTextMagic, fastTextVersion})
+	w(fastTextArgs{Dim: 2, WS: 5, Epoch: 5, MinCount: 5, Neg: 5,
+		WordNgrams: 1, Loss: 2, Model: 2, Bucket: 7, Minn: 3, Maxn: 4,
+		LRUpdateRate: 100, T: 1e-4})
+	w(fastTextDictionary{Size: 3, NWords: 2, NLabels: 1, NTokens: 100})
+	w(int64(-1))
+	for i, word := range []string{"cat", "dög", "__label__x"} {
+		buf.WriteString(word + "\x00")
+		w(int64(10))
+		w(int8(i / 2))
+	}
+	w(quantized)
+
+	const rows = 9
+	if !quantized {
+		w([]int64{rows, 2})
+		for i := range rows {
+			w([]float32{float32(i), float32(2*i + 1)})
+		}
+		return buf.Bytes()
+	}
+	w(true)
+	w([]int64{rows, 2})
+	w(int32(rows))
+	for i := range rows {
+		w(uint8(i))
+	}
+	w([]int32{2, 1, 2, 2})
+	for i := range fastTextKsub {
+		w([]float32{float32(i), float32(2*i + 1)})
+	}
+	w(make([]uint8, rows))
+	w([]int32{1, 1, 1, 1})
+	w(slices.Repeat([]float32{1}, fastTextKsub))
+	return buf.Bytes()
+}
+
+func TestFastTextHash(t *testing.T) {
+	for s, want := range map[string]uint32{
+		"":     2166136261,
+		"<ca":  1066916747,
+		"dög>": 2441492611,
+	} {
+		if got := fastTextHash(s); got != want {
+			t.Errorf("Hash of %q should be %d, got %d", s, want, got)
+		}
+	}
+}
+
+func TestFastTextModel(t *testing.T) {
+	want := map[string][]float32{
+		"cat":  {4.3333335, 9.666667},
+		"dög":  {3.8333333, 8.666667},
+		"cats": {4.428571, 9.857142},
+		"x":    {4, 9},
+	}
+	for _, quantized := range []bool{false, true} {
+		m := NewFastTextModel()
+		if err := m.LoadFastText(
+			bytes.NewReader(testFastText(quantized))); err != nil {
+			t.Fatal(err)
+		}
+		if m.VocabularySize() != 2 || m.Dimensions() != 2 {
+			t.Fatalf("Model should be 2 words of 2 dimensions, got %d of %d",
+				m.VocabularySize(), m.Dimensions())
+		}
+		if _, ok := m.ID("__label__x"); ok {
+			t.Error("Labels should not be in the vocabulary")
+		}
+		for word, v := range want {
+			got := m.Vector(word)
+			for i := range v {
+				if math.Abs(float64(got[i]-v[i])) > 1e-5 {
+					t.Errorf("Vector for %q should be %v, got %v", word, v,
+						got)
+					break
+				}
+			}
+		}
+		if s := m.Similarity("cat", "cats"); s < 0.99 {
+			t.Errorf("Similarity of cat and cats should be about 1, got %f",
+				s)
+		}
+	}
+
+	// Words skipped while loading still use their own row
+	m := NewFastTextModel()
+	err := m.LoadFastText(bytes.NewReader(testFastText(false)),
+		WithMaxWords(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.VocabularySize() != 1 {
+		t.Errorf("Model should have 1 word, got %d", m.VocabularySize())
+	}
+	if v := m.Vector("dög"); math.Abs(float64(v[0]-want["dög"][0])) > 1e-5 {
+		t.Errorf("Vector for skipped word should be %v, got %v",
+			want["dög"], v)
+	}
+
+	var _ Model[float32] = m
+	loaded, info, err := LoadReader[float32](
+		bytes.NewReader(testFastText(true)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Format != FormatFastText || info.Size != 2 || info.Dim != 2 {
+		t.Errorf("Should detect fastText model of 2 words of 2 dimensions, "+
+			"got %v", info)
+	}
+	if _, ok := loaded.(*FastTextModel); !ok {
+		t.Error("Load should return a FastTextModel for fastText models")
+	}
+	if _, _, err := LoadReader[int8](
+		bytes.NewReader(testFastText(false))); err == nil {
+		t.Error("fastText models should only load as float32")
+	}
+
+	data := testFastText(false)
+	for _, n := range []int{0, 8, 100, len(data) - 4} {
+		err := NewFastTextModel().LoadFastText(bytes.NewReader(data[:n]))
+		if err == nil {
+			t.Errorf("Model truncated to %d bytes should fail to load", n)
+		}
+	}
+
+	// Loading directly reports progress and stops for its context
+	var calls progressCalls
+	err = NewFastTextModel().LoadFastText(bytes.NewReader(data),
+		WithProgress(calls.record, 0))
+	size := int64(len(data))
+	if err != nil || len(calls) == 0 ||
+		calls[len(calls)-1] != [3]int64{2, size, size} {
+		t.Errorf("fastText load should report progress up to 2 words and %d "+
+			"bytes, got %v and %v", size, calls, err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = NewFastTextModel().LoadFastText(bytes.NewReader(data),
+		WithContext(ctx))
+	if err != context.Canceled {
+		t.Errorf("fastText load with a canceled context should fail with %v, "+
+			"got %v", context.Canceled, err)
+	}
+}
+
+func TestFastTextSearch(t *testing.T) {
+	m := NewFastTextModel()
+	if err := m.LoadFastText(
+		bytes.NewReader(testFastText(false))); err != nil {
+		t.Fatal(err)
+	}
+
+	// "cats" is out of the vocabulary but has n-grams
+	nearest, err := NNearest(m, "cats", 2)
+	if err != nil || len(nearest) != 2 || nearest[0].Word != "cat" {
+		t.Errorf("Nearest to \"cats\" should start with cat, got %v and %v",
+			nearest, err)
+	}
+	nearest, err = MostSimilar(m, []string{"cats"}, nil, 1)
+	if err != nil || len(nearest) != 1 || nearest[0].Word != "cat" {
+		t.Errorf("Most similar to \"cats\" should be cat, got %v and %v",
+			nearest, err)
+	}
+	nearest, err = MostSimilarCosMul(m, []string{"cats"}, nil, 1)
+	if err != nil || len(nearest) != 1 {
+		t.Errorf("Most similar to \"cats\" by 3CosMul should find a word, "+
+			"got %v and %v", nearest, err)
+	}
+	results, err := BatchNNearest(m, []string{"cats", "cat"}, 1)
+	if err != nil || results[0].Err != nil || results[0].Neighbors[0].Word !=
+		"cat" || results[1].Neighbors[0].Word != "dög" {
+		t.Errorf("Batch nearest to [cats cat] should be [cat dög], got %v "+
+			"and %v", results, err)
+	}
+
+	// Words in the vocabulary are still excluded from their own results
+	nearest, err = NNearest(m, "cat", 2)
+	if err != nil || len(nearest) != 1 || nearest[0].Word != "dög" {
+		t.Errorf("Nearest to \"cat\" should be dög, got %v and %v", nearest,
+			err)
+	}
+}
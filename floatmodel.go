@@ -19,293 +19,468 @@ package gowe
 
 import (
 	"bufio"
-	"encoding/binary"
-	"errors"
-	"fmt"
 	"io"
-	"os"
-	"strconv"
-	"strings"
+	"iter"
+	"maps"
+	"slices"
+	"sync"
 )
 
 /** FloatModel **/
 type FloatModel[F FloatScalar] struct {
-	dim     uint
-	vectors map[string]*FloatVector[F]
+	// mu guards store so that the model can be changed while it is read
+	mu       sync.RWMutex
+	store    vectorStore[F]
+	metadata map[string]string
 }
 
 func NewFloatModel[F FloatScalar]() *FloatModel[F] {
 	return &FloatModel[F]{
-		dim:     uint(0),
-		vectors: make(map[string]*FloatVector[F], 0),
+		store:    newVectorStore[F](),
+		metadata: make(map[string]string),
 	}
 }
 
+// Vector returns a copy of the vector of a word, or a zero vector if the word
+// isn't in the model
 func (m *FloatModel[F]) Vector(s string) []F {
-	if _, ok := m.vectors[s]; !ok {
-		return make([]F, m.dim)
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return slices.Clone(m.vector(s))
+}
+
+// Lookup returns a copy of the vector of a word and whether the word is in
+// the model
+func (m *FloatModel[F]) Lookup(s string) ([]F, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	v, ok := m.store.lookup(s)
+	return slices.Clone(v), ok
+}
+
+// vector returns the vector of a word in the model's storage, the model must
+// be locked
+func (m *FloatModel[F]) vector(s string) []F {
+	v, ok := m.store.lookup(s)
+	if !ok {
+		return make([]F, m.store.dim)
 	}
-	return m.vectors[s].scalars
+	return v
 }
 
 func (m *FloatModel[F]) Dimensions() uint {
-	return m.dim
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.store.dim
 }
 
 func (m *FloatModel[F]) VocabularySize() uint {
-	return uint(len(m.vectors))
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return uint(m.store.len())
+}
+
+func (m *FloatModel[F]) idLimit() int {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.store.rows()
+}
+
+// Words returns the vocabulary in the order it was loaded, which for most
+// published models is the order of corpus frequency. Words set after the
+// call aren't seen by the iterator, and words deleted before they are reached
+// are skipped.
+func (m *FloatModel[F]) Words() iter.Seq[string] {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.store.allLocked(m.mu.RLocker())
+}
+
+// All returns the words and vectors of the model in the order they were
+// loaded. Each vector is copied into a buffer which is reused by the next
+// iteration, so it must be copied to be kept. Words set after the call aren't
+// seen by the iterator, and words deleted before they are reached are
+// skipped.
+func (m *FloatModel[F]) All() iter.Seq2[string, []F] {
+	words := m.Words()
+	return func(yield func(string, []F) bool) {
+		vector := make([]F, m.Dimensions())
+		for word := range words {
+			m.mu.RLock()
+			v, ok := m.store.lookup(word)
+			copy(vector, v)
+			m.mu.RUnlock()
+			if ok && !yield(word, vector) {
+				return
+			}
+		}
+	}
+}
+
+// ID returns the id of a word, ids number the vocabulary from 0 in the order
+// it was loaded and don't change when other words are deleted
+func (m *FloatModel[F]) ID(s string) (int, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.store.id(s)
+}
+
+// Word returns the word with an id, or "" if there is no such id
+func (m *FloatModel[F]) Word(id int) string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.store.word(id)
+}
+
+// VectorByID returns the vector of the word with an id, or nil if there is no
+// such id. Unlike Vector, it isn't copied, so it must not be read while Set
+// replaces the vector of the same word.
+func (m *FloatModel[F]) VectorByID(id int) []F {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.store.vectorByID(id)
 }
 
+// Metadata returns a copy of the metadata saved with the model in the native
+// format
+func (m *FloatModel[F]) Metadata() map[string]string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return maps.Clone(m.metadata)
+}
+
+// SetMetadata sets an entry of the metadata saved with the model in the
+// native format
+func (m *FloatModel[F]) SetMetadata(key, value string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.metadata[key] = value
+}
+
+// Similarity returns the cosine similarity between two words, or 0 if either
+// isn't in the model. Use SimilarityE to tell missing words apart.
 func (m *FloatModel[F]) Similarity(s, t string) float64 {
-	v, ok := m.vectors[s]
+	similarity, _ := m.SimilarityE(s, t)
+	return similarity
+}
+
+// SimilarityE returns the cosine similarity between two words, or an error
+// wrapping ErrWordNotFound if either isn't in the model
+func (m *FloatModel[F]) SimilarityE(s, t string) (float64, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	v, ok := m.store.lookup(s)
 	if !ok {
-		return 0
+		return 0, wordNotFound(s)
 	}
-	u, ok := m.vectors[t]
+	u, ok := m.store.lookup(t)
 	if !ok {
-		return 0
+		return 0, wordNotFound(t)
 	}
-	return (*v).CosineSimilarity(*u)
+	return FloatVector[F]{scalars: v}.CosineSimilarity(
+		FloatVector[F]{scalars: u}), nil
 }
 
-// readPlainVector reads a line from reader to add a word entry, it returns
-// true if successfully added and false if there is nothing left to read or if
-// there was an error.
-func (m *FloatModel[F]) readPlainVector(br *bufio.Reader) (bool, error) {
+// Set adds a word to the model or replaces its vector, the vector is copied.
+// It can be called while the model is being read or searched.
+func (m *FloatModel[F]) Set(s string, v []F) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.store.put(s, v)
+}
 
-	word, err := br.ReadString(' ')
-	if err != nil {
-		return false, nil
-	}
-	word = strings.TrimRight(word, " ")
-
-	line, err := br.ReadString('\n')
-	splits := strings.Split(strings.TrimRight(line, "\n"), " ")
-	if uint(len(splits)) != m.dim {
-		return false, fmt.Errorf(
-			"Plaintext line has %d values but Model has %d dimensions",
-			len(splits), m.dim)
-	}
+// Delete removes a word from the model and returns whether it was in the
+// model. The ids of other words don't change, the id of the deleted word is
+// left as a gap that Word and VectorByID return nothing for, and setting the
+// word again gives it a new id. The row of a deleted word is kept until
+// Compact is called.
+func (m *FloatModel[F]) Delete(s string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.store.delete(s)
+}
 
-	vector := make([]F, m.dim)
-	// Parse differently depending on model's vector type
-	switch interface{}(vector).(type) {
-	case []float32:
-		for i := range m.dim {
-			val, err := strconv.ParseFloat(splits[i], 32)
-			if err != nil {
-				return false, errors.Join(errors.New("Invalid plaintext float"),
-					err)
-			}
-			vector[i] = F(val)
-		}
-	case []float64:
-		for i := range m.dim {
-			val, err := strconv.ParseFloat(splits[i], 64)
-			if err != nil {
-				return false, errors.Join(errors.New("Invalid plaintext float"),
-					err)
-			}
-			vector[i] = F(val)
-		}
-	default:
-		return false, errors.New("Invalid type T when adding plaintext line")
-	}
-	m.vectors[word] = &FloatVector[F]{scalars: vector}
-	return true, nil
+// Compact frees the rows of deleted words. The ids of the words after them
+// change, so ids held by callers and indexes built from the model are
+// invalid afterwards, and it must not be called while iterating over the
+// model.
+func (m *FloatModel[F]) Compact() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.store.compact()
+}
+
+// Has returns whether a word is in the model
+func (m *FloatModel[F]) Has(s string) bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	_, ok := m.store.id(s)
+	return ok
+}
+
+func (m *FloatModel[F]) readLock() (Embedding[F], func()) {
+	m.mu.RLock()
+	return storeView[F]{store: &m.store}, m.mu.RUnlock
 }
 
+// FromPlainFile loads a plaintext file, see LoadPlainFile
+//
+// Deprecated: opts are untyped, use LoadPlainFile with WithHeader instead.
 func (m *FloatModel[F]) FromPlainFile(
-	p string, desc bool, _ ...interface{}) error {
+	p string, desc bool, opts ...interface{}) error {
 
-	file, err := os.Open(p)
-	defer file.Close()
+	lopts, err := legacyLoadOptions(opts)
 	if err != nil {
 		return err
 	}
+	return m.LoadPlainFile(p, append(lopts, WithHeader(desc))...)
+}
 
-	reader := bufio.NewReader(file)
-	if desc {
-		// Scan the first line if description is provided
-		var size, dim uint
-		n, err := fmt.Fscanln(file, &size, &dim)
-		if err != nil {
-			return errors.Join(
-				errors.New("Could not scan description in plaintext"), err)
-		}
-		if n < 2 {
-			return errors.New(
-				"Size and dim not found in description in plaintext")
-		}
-		// Save the dimension but vocabulary size will be dynamically
-		// determined
-		m.dim = dim
-	} else {
-		// Read the first line and determine dim
-		line, err := reader.ReadString('\n')
-		if err != nil {
-			return errors.New("Could not read first line in plaintext")
-		}
-		splits := strings.Split(line, " ")
-		m.dim = uint(len(splits) - 1)
-		if m.dim == 0 {
-			return errors.New("Zero dimensions detected in plaintext")
-		}
+// FromPlainReader loads a plaintext stream, see LoadPlain
+//
+// Deprecated: opts are untyped, use LoadPlain with WithHeader instead.
+func (m *FloatModel[F]) FromPlainReader(
+	r io.Reader, desc bool, opts ...interface{}) error {
 
-		// Seek back to the beginning
-		file.Seek(0, io.SeekStart)
-		reader = bufio.NewReader(file)
+	lopts, err := legacyLoadOptions(opts)
+	if err != nil {
+		return err
 	}
+	return m.LoadPlain(r, append(lopts, WithHeader(desc))...)
+}
+
+// LoadPlainFile loads the model from a plaintext file, see LoadPlain
+func (m *FloatModel[F]) LoadPlainFile(p string, opts ...LoadOption) error {
+	return loadModelFile(p, opts, m.LoadPlain)
+}
+
+// LoadPlain loads the model from a plaintext stream, WithHeader must be set
+// if the stream starts with a "<size> <dim>" description. The stream is
+// consumed once and never rewound.
+func (m *FloatModel[F]) LoadPlain(r io.Reader, opts ...LoadOption) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	o := newLoadOptions(opts)
 
-	readMore := true
-	for readMore {
-		readMore, err = m.readPlainVector(reader)
-		if err != nil {
+	r, err := o.open(r)
+	if err != nil {
+		return o.finish(err)
+	}
+	pr, err := newPlainReader(bufio.NewReader(r), o.Header)
+	if err != nil {
+		return o.finish(err)
+	}
+	if err := m.store.setDim(pr.dim); err != nil {
+		return o.finish(err)
+	}
+	m.store.reserve(o.Filter.capacity(pr.size))
+
+	return o.finish(loadPlain(pr, &m.store, o,
+		func() plainParser[F] {
+			return parsePlainValues[F]
+		}))
+}
+
+// readBinaryVectors reads the vectors of r as binary scalars B into buf,
+// then adds them to the model, casting if the model has a different float
+// type.
+func readBinaryVectors[F FloatScalar, B FloatScalar](m *FloatModel[F],
+	r *binaryReader, buf []B, o *LoadOptions) error {
+
+	start := m.store.len()
+	for !o.Filter.full(m.store.len() - start) {
+		word, ok, err := readBinaryRecord(r, buf, &o.Filter)
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
 			return err
 		}
+		if ok {
+			castScalars(m.store.addRow(word), buf)
+			o.loaded(m.store.len() - start)
+		}
 	}
-
 	return nil
 }
 
-// readBinaryVector handles reading vectors when the file and model have the
-// same float type
-func (m *FloatModel[F]) readBinaryVector(
-	br *bufio.Reader) (bool, error) {
+// FromBinaryFile loads a binary file, see LoadBinaryFile
+//
+// Deprecated: opts are untyped, use LoadBinaryFile with WithBitSize instead.
+func (m *FloatModel[F]) FromBinaryFile(
+	p string, bitSize int, opts ...interface{}) error {
 
-	word, err := br.ReadString(' ')
+	lopts, err := legacyLoadOptions(opts)
 	if err != nil {
-		return false, nil
+		return err
 	}
-	word = strings.TrimRight(word, " ")
+	return m.LoadBinaryFile(p, append(lopts, WithBitSize(bitSize))...)
+}
 
-	vector := make([]F, m.dim)
-	err = binary.Read(br, binary.LittleEndian, vector)
+// FromBinaryReader loads a binary stream, see LoadBinary
+//
+// Deprecated: opts are untyped, use LoadBinary with WithBitSize instead.
+func (m *FloatModel[F]) FromBinaryReader(
+	r io.Reader, bitSize int, opts ...interface{}) error {
+
+	lopts, err := legacyLoadOptions(opts)
 	if err != nil {
-		return false, err
+		return err
 	}
+	return m.LoadBinary(r, append(lopts, WithBitSize(bitSize))...)
+}
 
-	m.vectors[word] = &FloatVector[F]{scalars: vector}
-	return true, nil
+// LoadBinaryFile loads the model from a binary file, see LoadBinary
+func (m *FloatModel[F]) LoadBinaryFile(p string, opts ...LoadOption) error {
+	return loadModelFile(p, opts, m.LoadBinary)
 }
 
-// castReadFloat32BinaryVector handles reading vectors when the file has
-// float32 values but the model doesn't use them
-func (m *FloatModel[F]) castReadFloat32BinaryVector(
-	br *bufio.Reader) (bool, error) {
+// LoadBinary loads the model from a binary stream. Binary streams always
+// start with a description and their floats are float32 unless WithBitSize
+// sets 64.
+func (m *FloatModel[F]) LoadBinary(r io.Reader, opts ...LoadOption) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	o := newLoadOptions(opts)
 
-	word, err := br.ReadString(' ')
+	r, err := o.open(r)
 	if err != nil {
-		return false, nil
+		return o.finish(err)
 	}
-	word = strings.TrimRight(word, " ")
-
-	vector := make([]float32, m.dim)
-	err = binary.Read(br, binary.LittleEndian, vector)
+	br, err := newBinaryReader(bufio.NewReader(r), o.ByteOrder)
 	if err != nil {
-		return false, err
+		return o.finish(err)
 	}
+	if err := m.store.setDim(br.dim); err != nil {
+		return o.finish(err)
+	}
+	m.store.reserve(o.Filter.capacity(br.size))
 
-	vectorf := make([]F, m.dim)
-	for i, _ := range vector {
-		vectorf[i] = F(vector[i])
+	// Vectors are read in the binary's float type and cast to the model's
+	// float type when they don't match
+	if o.BitSize == 64 {
+		err = readBinaryVectors(m, br, make([]float64, br.dim), o)
+	} else {
+		err = readBinaryVectors(m, br, make([]float32, br.dim), o)
 	}
+	return o.finish(err)
+}
 
-	m.vectors[word] = &FloatVector[F]{scalars: vectorf}
-	return true, nil
+// WritePlainTo writes the model to w in the plaintext format with a
+// "<size> <dim>" description. Words are written in the order they were
+// loaded, it fails before writing anything if a word is empty or contains
+// whitespace.
+func (m *FloatModel[F]) WritePlainTo(w io.Writer) error {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return writePlainVectors(w, m.store.dim, m.store.vocabulary(),
+		m.vector)
 }
 
-// castReadFloat64BinaryVector handles reading vectors when the file has
-// float64 values but the model doesn't use them
-func (m *FloatModel[F]) castReadFloat64BinaryVector(
-	br *bufio.Reader) (bool, error) {
+// WritePlainFile writes the model to a plaintext file, see WritePlainTo
+func (m *FloatModel[F]) WritePlainFile(p string) error {
+	return createModelFile(p, m.WritePlainTo)
+}
+
+// WriteBinaryTo writes the model to w in the binary format with scalars of
+// bitSize, which defaults to 32 if it is not 64. Words are written in the
+// order they were loaded, it fails before writing anything if a word is
+// empty or contains whitespace.
+func (m *FloatModel[F]) WriteBinaryTo(w io.Writer, bitSize int) error {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return writeBinaryVectors(w, m.store.dim, m.store.vocabulary(),
+		m.vector, bitSize)
+}
 
-	word, err := br.ReadString(' ')
+// WriteBinaryFile writes the model to a binary file, see WriteBinaryTo
+func (m *FloatModel[F]) WriteBinaryFile(p string, bitSize int) error {
+	return createModelFile(p, func(w io.Writer) error {
+		return m.WriteBinaryTo(w, bitSize)
+	})
+}
+
+// FromNativeReader loads a model from a stream in the native gowe format,
+// see LoadNative
+func (m *FloatModel[F]) FromNativeReader(r io.Reader) error {
+	return m.LoadNative(r)
+}
+
+// LoadNative loads a model from a stream in the native gowe format. Scalars
+// of any type are accepted, integer scalars are dequantized. The LoadFilter,
+// context and progress of opts apply, the other options are described by
+// the model itself. Skipped vectors aren't read into memory, except that a
+// filter of words needs the words ahead of the vectors, which only an
+// uncompressed io.ReaderAt such as a file can provide.
+func (m *FloatModel[F]) LoadNative(r io.Reader, opts ...LoadOption) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	o := newLoadOptions(opts)
+
+	src := r
+	r, err := o.open(r)
 	if err != nil {
-		return false, nil
+		return o.finish(err)
 	}
-	word = strings.TrimRight(word, " ")
-
-	vector := make([]float64, m.dim)
-	err = binary.Read(br, binary.LittleEndian, vector)
+	reader := bufio.NewReader(r)
+	h, meta, err := readNativeHeader(reader)
 	if err != nil {
-		return false, err
+		return o.finish(err)
+	}
+	if err := m.store.setDim(uint(h.dim)); err != nil {
+		return o.finish(err)
 	}
 
-	vectorf := make([]F, m.dim)
-	for i, _ := range vector {
-		vectorf[i] = F(vector[i])
+	var n int
+	switch h.scalar {
+	case scalarFloat32:
+		n, err = readNativeFloats[F, float32](src, reader, h, &m.store,
+			&o.Filter)
+	case scalarFloat64:
+		n, err = readNativeFloats[F, float64](src, reader, h, &m.store,
+			&o.Filter)
+	case scalarInt8:
+		n, err = readNativeFloats[F, int8](src, reader, h, &m.store,
+			&o.Filter)
+	case scalarInt16:
+		n, err = readNativeFloats[F, int16](src, reader, h, &m.store,
+			&o.Filter)
+	case scalarInt32:
+		n, err = readNativeFloats[F, int32](src, reader, h, &m.store,
+			&o.Filter)
+	}
+	if err != nil {
+		return o.finish(err)
 	}
 
-	m.vectors[word] = &FloatVector[F]{scalars: vectorf}
-	return true, nil
+	o.loaded(n)
+	for key, value := range meta {
+		m.metadata[key] = value
+	}
+	return o.finish(nil)
 }
 
-func (m *FloatModel[F]) FromBinaryFile(
-	p string, bitSize int, _ ...interface{}) error {
+// FromNativeFile loads a model from a file in the native gowe format, see
+// LoadNative
+func (m *FloatModel[F]) FromNativeFile(p string) error {
+	return m.LoadNativeFile(p)
+}
 
-	file, err := os.Open(p)
-	defer file.Close()
-	if err != nil {
-		return err
-	}
+// LoadNativeFile loads a model from a file in the native gowe format, see
+// LoadNative
+func (m *FloatModel[F]) LoadNativeFile(p string, opts ...LoadOption) error {
+	return loadModelFile(p, opts, m.LoadNative)
+}
 
-	reader := bufio.NewReader(file)
-	// First line must describe size and dimensions
-	var size, dim uint
-	n, err := fmt.Fscanln(file, &size, &dim)
-	if err != nil {
-		return err
-	}
-	if n < 2 {
-		return errors.New("Size and dimensions not found in binary")
-	}
-	m.dim = dim
-
-	// Since golang doesn't support function overloading and method type
-	// parameters, this section looks a little repetitious but the main idea is
-	// that when the model vector type matches the binary vector type, we can
-	// avoid a cast over every single scalar value on load.
-	var f F
-	switch any(f).(type) {
-	case float32:
-		readMore := true
-		if bitSize == 64 {
-			for readMore {
-				readMore, err = m.castReadFloat64BinaryVector(reader)
-				if err != nil {
-					break
-				}
-			}
-		} else {
-			for readMore {
-				readMore, err = m.readBinaryVector(reader)
-				if err != nil {
-					break
-				}
-			}
-		}
-	case float64:
-		readMore := true
-		if bitSize == 64 {
-			for readMore {
-				readMore, err = m.readBinaryVector(reader)
-				if err != nil {
-					break
-				}
-			}
-		} else {
-			for readMore {
-				readMore, err = m.castReadFloat32BinaryVector(reader)
-				if err != nil {
-					break
-				}
-			}
-		}
-	default:
-		return errors.New("Loading binary failed. FloatModel should not be " +
-			"a type other than a float32 or float64")
-	}
+// WriteNativeTo writes the model and its metadata to w in the native gowe
+// format. Words are written in the order they were loaded.
+func (m *FloatModel[F]) WriteNativeTo(w io.Writer) error {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return writeNative(w, m.store.dim, 0, m.store.vocabulary(),
+		m.vector, m.metadata)
+}
 
-	return nil
+// WriteNativeFile writes the model to a native gowe file, see WriteNativeTo
+func (m *FloatModel[F]) WriteNativeFile(p string) error {
+	return createModelFile(p, m.WriteNativeTo)
 }
@@ -1,5 +1,5 @@
 module github.com/jackiedeng0/gowe
 
-go 1.22.1
+go 1.23
 
 retract v0.1.0 // package was in subfolder
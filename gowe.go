@@ -21,40 +21,147 @@ PERFORMANCE OF THIS SOFTWARE.
 //   - plaintext (plain) e.g. "the 0.418 0.24968 ..."
 //     The first line may be the vocabulary size and dim e.g. "300000 128",
 //     in this case, we skip it
+//   - binary (bin) as written by the original word2vec tool, the first line is
+//     always the vocabulary size and dim
+//   - native gowe format (gowe) which stores vectors exactly as they are held
+//     in memory, including quantized IntModels and their shift. Native files
+//     can also be memory mapped as a read-only MappedModel.
+//   - fastText (.bin, .ftz) models including quantized ones, loaded into a
+//     FastTextModel which builds vectors for out of vocabulary words from
+//     their character n-grams
+//
+// Models compressed with gzip or bzip2 are decompressed transparently while
+// loading, xz and zstd are supported through RegisterDecompressor.
 package gowe
 
 import (
+	"bufio"
 	"cmp"
+	"context"
 	"errors"
+	"fmt"
+	"io"
+	"iter"
 	"slices"
+	"strings"
 )
 
-type Model[T VectorScalar] interface {
-	// Loads model from plaintext file
-	FromPlainFile(p string, desc bool, opts ...interface{}) error
-	// Loads model from binary file
-	// Binary files must have a description and scalars can be either float32
-	// or float64, and the user passes that in via bitSize. If bitSize is not
-	// 64, it defaults to 32, which is the standard.
-	FromBinaryFile(p string, bitSize int, opts ...interface{}) error
+// ErrWordNotFound is returned for words that aren't in a model, errors that
+// name the word wrap it so it can be checked with errors.Is
+var ErrWordNotFound = errors.New("Word is not in the model")
+
+// wordNotFound returns ErrWordNotFound for a word
+func wordNotFound(word string) error {
+	return fmt.Errorf("%w: %q", ErrWordNotFound, word)
+}
+
+// Embedding is the read-only part of a Model that is needed to query it, it
+// is also implemented by read-only models such as MappedModel
+type Embedding[T VectorScalar] interface {
 	// Returns vector as array of scalars for a word. Note that for IntModels,
 	// this will return the shifted quantized ints.
 	Vector(s string) []T
+	// Returns the vector for a word and whether the word is in the model,
+	// unlike Vector which returns a zero vector for missing words
+	Lookup(s string) ([]T, bool)
 	// Returns dimensions
 	Dimensions() uint
 	// Returns size of vocabulary
 	VocabularySize() uint
 	// Returns the cosine similarity between two strings
 	Similarity(s, t string) float64
+	// Returns the cosine similarity between two strings, or an error wrapping
+	// ErrWordNotFound if either isn't in the model
+	SimilarityE(s, t string) (float64, error)
+	// Returns the vocabulary in the order of the model file
+	Words() iter.Seq[string]
+	// Returns the words and vectors in the order of the model file
+	All() iter.Seq2[string, []T]
+	// Returns the id of a word, its position in the order of the model file.
+	// Ids don't change when words are deleted, which leaves gaps.
+	ID(s string) (int, bool)
+	// Returns the word with an id, or "" if there is no such id
+	Word(id int) string
+	// Returns the vector of the word with an id, or nil if there is no such id
+	VectorByID(id int) []T
+}
+
+type Model[T VectorScalar] interface {
+	Embedding[T]
+	// Loads model from a plaintext file
+	LoadPlainFile(p string, opts ...LoadOption) error
+	// Loads model from a plaintext stream, the reader is consumed once and
+	// never rewound
+	LoadPlain(r io.Reader, opts ...LoadOption) error
+	// Loads model from a binary file
+	LoadBinaryFile(p string, opts ...LoadOption) error
+	// Loads model from a binary stream
+	LoadBinary(r io.Reader, opts ...LoadOption) error
+	// Loads model from plaintext file
+	//
+	// Deprecated: use LoadPlainFile
+	FromPlainFile(p string, desc bool, opts ...interface{}) error
+	// Loads model from a plaintext stream
+	//
+	// Deprecated: use LoadPlain
+	FromPlainReader(r io.Reader, desc bool, opts ...interface{}) error
+	// Loads model from binary file
+	// Binary files must have a description and scalars can be either float32
+	// or float64, and the user passes that in via bitSize. If bitSize is not
+	// 64, it defaults to 32, which is the standard.
+	//
+	// Deprecated: use LoadBinaryFile
+	FromBinaryFile(p string, bitSize int, opts ...interface{}) error
+	// Loads model from a binary stream, see FromBinaryFile
+	//
+	// Deprecated: use LoadBinary
+	FromBinaryReader(r io.Reader, bitSize int, opts ...interface{}) error
+	// Writes model to a plaintext file with a description
+	WritePlainFile(p string) error
+	// Writes model to a plaintext stream with a description
+	WritePlainTo(w io.Writer) error
+	// Writes model to a binary file with scalars of bitSize (32 or 64)
+	WriteBinaryFile(p string, bitSize int) error
+	// Writes model to a binary stream with scalars of bitSize (32 or 64)
+	WriteBinaryTo(w io.Writer, bitSize int) error
+	// Loads model from a native gowe file
+	LoadNativeFile(p string, opts ...LoadOption) error
+	// Loads model from a native gowe stream
+	LoadNative(r io.Reader, opts ...LoadOption) error
+	// Loads model from a native gowe file, see LoadNativeFile
+	FromNativeFile(p string) error
+	// Loads model from a native gowe stream, see LoadNative
+	FromNativeReader(r io.Reader) error
+	// Writes model to a native gowe file
+	WriteNativeFile(p string) error
+	// Writes model to a native gowe stream
+	WriteNativeTo(w io.Writer) error
+	// Returns a copy of the metadata stored with the model in the native
+	// format
+	Metadata() map[string]string
+	// Sets an entry of the metadata stored with the model in the native
+	// format
+	SetMetadata(key, value string)
 }
 
 /** Common Functions **/
+
+// readBinaryWord reads the word that precedes a vector in binary files. The
+// original word2vec tool ends each vector with a newline which is skipped.
+func readBinaryWord(br *bufio.Reader) (string, error) {
+	word, err := br.ReadString(' ')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimLeft(strings.TrimRight(word, " "), "\n"), nil
+}
+
 type relativeWord struct {
 	word       string
 	similarity float64
 }
 
-func RankSimilarity[T VectorScalar, M Model[T]](m M, s string, vocab []string) []string {
+func RankSimilarity[T VectorScalar, M Embedding[T]](m M, s string, vocab []string) []string {
 	relativeWords := make([]relativeWord, len(vocab))
 	for i, word := range vocab {
 		relativeWords[i] = relativeWord{
@@ -73,12 +180,68 @@ func RankSimilarity[T VectorScalar, M Model[T]](m M, s string, vocab []string) [
 	return rankedWords
 }
 
-func NNearestIn[T VectorScalar, M Model[T]](m M, s string, vocab []string, n uint) ([]string, error) {
+// NNearestIn returns the n words of vocab most similar to s, only the n most
+// similar words are kept while ranking so vocab is never sorted. s must be in
+// the model, candidates that aren't are ranked with a similarity of 0 unless
+// NNearestInContext is given WithMissing.
+func NNearestIn[T VectorScalar, M Embedding[T]](m M, s string, vocab []string, n uint) ([]string, error) {
+	return NNearestInContext[T](context.Background(), m, s, vocab, n)
+}
+
+// NNearestInContext is NNearestIn split across workers, it stops early with
+// the error of ctx if ctx is done
+func NNearestInContext[T VectorScalar, M Embedding[T]](ctx context.Context,
+	m M, s string, vocab []string, n uint,
+	opts ...SearchOption) ([]string, error) {
+
 	if n == 0 {
 		return nil, errors.New("n = 0 for NNearestIn() is invalid")
 	} else if n > uint(len(vocab)) {
 		return nil, errors.New("n > vocabulary size for NNearestIn() is invalid")
 	}
 
-	return RankSimilarity[T](m, s, vocab)[:n], nil
+	// The query is resolved once and the model can't change during the
+	// scan, the policy only applies to the candidates
+	view, release := readLocked[T](m)
+	defer release()
+	v, ok := view.Lookup(s)
+	if !ok {
+		return nil, wordNotFound(s)
+	}
+	target := unitVector(v)
+	if target == nil {
+		return nil, fmt.Errorf("Vector for %q has no magnitude", s)
+	}
+	o := newSearchOptions(opts)
+	if o.Missing == MissingError {
+		for _, word := range vocab {
+			if _, ok := view.Lookup(word); !ok {
+				return nil, wordNotFound(word)
+			}
+		}
+	}
+
+	nearest, err := scanVocabulary(ctx, len(vocab), n, o,
+		func(top *topNeighbors, i int) {
+			similarity := float64(0)
+			// Candidates without magnitude have no similarity either
+			u, ok := view.Lookup(vocab[i])
+			d, mag := dotMagnitude(target, u)
+			if ok && mag != 0 {
+				similarity = d / mag
+			} else if o.Missing != MissingRank {
+				return
+			}
+			if top.accepts(similarity) {
+				top.offer(Neighbor{Word: vocab[i], Similarity: similarity})
+			}
+		})
+	if err != nil {
+		return nil, err
+	}
+	words := make([]string, len(nearest))
+	for i, nb := range nearest {
+		words[i] = nb.Word
+	}
+	return words, nil
 }
@@ -18,9 +18,12 @@ PERFORMANCE OF THIS SOFTWARE.
 package gowe
 
 import (
+	"errors"
+	"io/fs"
 	"log"
 	"os"
 	"strings"
+	"sync"
 	"testing"
 )
 
@@ -29,17 +32,6 @@ var model *IntModel[int8]
 var testVocab []string
 
 func TestMain(m *testing.M) {
-	// Glove model retrieved from https://github.com/stanfordnlp/GloVe/
-	// Download model and place in this directory if you wish to run this test
-	var err error
-	// model = NewFloatModel[float32]()
-	// err = model.FromPlainFile("glove.6B.50d.txt", false, 5.0)
-	model = NewIntModel[int8]()
-	err = model.FromBinaryFile("model.bin", 32, 2.0)
-	if err != nil {
-		log.Fatal(err)
-	}
-
 	data, err := os.ReadFile("test_vocabulary.txt")
 	if err != nil {
 		log.Fatal(err)
@@ -49,7 +41,32 @@ func TestMain(m *testing.M) {
 	os.Exit(m.Run())
 }
 
+// loadModel loads the downloaded model once for the tests that need it
+var loadModel = sync.OnceValue(func() error {
+	// Glove model retrieved from https://github.com/stanfordnlp/GloVe/
+	// Download model and place in this directory if you wish to run this test
+	// model = NewFloatModel[float32]()
+	// err = model.FromPlainFile("glove.6B.50d.txt", false, 5.0)
+	if _, err := os.Stat("model.bin"); err != nil {
+		return err
+	}
+	model = NewIntModel[int8]()
+	return model.FromBinaryFile("model.bin", 32, 2.0)
+})
+
+// requireModel loads the downloaded model, skipping the tests and benchmarks
+// that depend on it if it isn't there
+func requireModel(tb testing.TB) {
+	err := loadModel()
+	if errors.Is(err, fs.ErrNotExist) {
+		tb.Skip("model.bin not found, skipping")
+	} else if err != nil {
+		tb.Fatal(err)
+	}
+}
+
 func TestEmbedding(t *testing.T) {
+	requireModel(t)
 	t.Logf("model has %d dimensions and a vocabulary of %d words",
 		model.Dimensions(), model.VocabularySize())
 
@@ -65,19 +82,29 @@ func TestEmbedding(t *testing.T) {
 }
 
 func BenchmarkNNearest5in10(b *testing.B) {
+	requireModel(b)
 	for i := 0; i < b.N; i++ {
 		NNearestIn(model, "cat", testVocab[:10], 5)
 	}
 }
 
 func BenchmarkNNearest5in100(b *testing.B) {
+	requireModel(b)
 	for i := 0; i < b.N; i++ {
 		NNearestIn(model, "cat", testVocab[:100], 5)
 	}
 }
 
 func BenchmarkNNearest5in1000(b *testing.B) {
+	requireModel(b)
 	for i := 0; i < b.N; i++ {
 		NNearestIn(model, "cat", testVocab[:1000], 5)
 	}
 }
+
+func BenchmarkNNearest10InModel(b *testing.B) {
+	requireModel(b)
+	for i := 0; i < b.N; i++ {
+		NNearest(model, "cat", 10)
+	}
+}
@@ -0,0 +1,639 @@
+/*
+
+Copyright (C) 2024 Jackie Deng
+
+Permission to use, copy, modify, and/or distribute this software for any
+purpose with or without fee is hereby granted.
+
+THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES WITH
+REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF MERCHANTABILITY AND
+FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY SPECIAL, DIRECT,
+INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES WHATSOEVER RESULTING FROM
+LOSS OF USE, DATA OR PROFITS, WHETHER IN AN ACTION OF CONTRACT, NEGLIGENCE OR
+OTHER TORTIOUS ACTION, ARISING OUT OF OR IN CONNECTION WITH THE USE OR
+PERFORMANCE OF THIS SOFTWARE.
+
+*/
+
+package gowe
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"math"
+	"math/rand/v2"
+	"os"
+	"slices"
+	"sync"
+)
+
+/** HNSW Index **/
+
+// HNSWConfig holds the parameters of an HNSW index, zero values are replaced
+// by the defaults
+type HNSWConfig struct {
+	// M is the number of links of each word in the upper layers, words have
+	// 2*M links in the bottom layer. Defaults to 16.
+	M int
+	// EfConstruction is the size of the candidate list while building, larger
+	// values build a more accurate graph more slowly. Defaults to 200.
+	EfConstruction int
+	// EfSearch is the size of the candidate list while searching, larger
+	// values trade speed for recall. Defaults to 64.
+	EfSearch int
+	// Seed seeds the random layers of words so that builds are reproducible
+	Seed uint64
+}
+
+func (c *HNSWConfig) setDefaults() {
+	if c.M <= 0 {
+		c.M = 16
+	}
+	if c.EfConstruction <= 0 {
+		c.EfConstruction = 200
+	}
+	if c.EfSearch <= 0 {
+		c.EfSearch = 64
+	}
+}
+
+// clamp bounds the parameters by the number of words they can reach, so that
+// every saved index passes the checks of LoadHNSW
+func (c *HNSWConfig) clamp(size int) {
+	size = max(size, 1)
+	c.M = min(c.M, hnswMaxM, size)
+	c.EfConstruction = min(c.EfConstruction, size)
+	c.EfSearch = min(c.EfSearch, size)
+}
+
+// hnswMaxM bounds M, which keeps the links a loaded index may claim small
+const hnswMaxM = 256
+
+// hnswMaxLevel bounds the layers of the graph, which for any practical
+// vocabulary never exceed log_M(V)
+const hnswMaxLevel = 32
+
+// HNSW is a Hierarchical Navigable Small World graph over the vocabulary of a
+// model for approximate nearest neighbor search by cosine similarity. It
+// reads vectors from the model it was built from, including the quantized
+// vectors of IntModels and MappedModels, so the model must outlive the index
+// and must not be changed while it is in use. Searches are safe to run
+// concurrently.
+type HNSW[T VectorScalar] struct {
+	m      Embedding[T]
+	config HNSWConfig
+	// inverse holds the inverse magnitude of each vector, or 0 if it has no
+	// magnitude
+	inverse []float64
+	// links holds the neighbors of each word in each of its layers
+	links    [][][]int32
+	entry    int32
+	maxLevel int
+
+	visited sync.Pool
+}
+
+func newHNSW[T VectorScalar](m Embedding[T], config HNSWConfig) *HNSW[T] {
+	config.setDefaults()
+	size := idLimit(m)
+	config.clamp(size)
+	view, release := readLocked[T](m)
+	defer release()
+	h := &HNSW[T]{
+		m:       m,
+		config:  config,
+		inverse: make([]float64, size),
+		links:   make([][][]int32, size),
+		entry:   -1,
+	}
+	h.visited.New = func() any { return &hnswVisited{} }
+	for id := range size {
+		if mag := magnitudeScalars(view.VectorByID(id)); mag != 0 {
+			h.inverse[id] = 1 / mag
+		}
+	}
+	return h
+}
+
+// NewHNSW builds an HNSW index over the vocabulary of a model
+func NewHNSW[T VectorScalar](m Embedding[T], config HNSWConfig) *HNSW[T] {
+	h := newHNSW(m, config)
+	rng := rand.New(rand.NewPCG(h.config.Seed, 0x9e3779b97f4a7c15))
+	levelMult := 1 / math.Log(float64(max(h.config.M, 2)))
+	view, release := readLocked[T](m)
+	defer release()
+	for id := range int32(len(h.links)) {
+		level := int(-math.Log(1-rng.Float64()) * levelMult)
+		// The ids of deleted words are left out of the graph
+		if view.VectorByID(int(id)) == nil {
+			continue
+		}
+		h.insert(view, id, min(level, hnswMaxLevel-1))
+	}
+	return h
+}
+
+// SetEfSearch sets the size of the candidate list of searches, up to the
+// number of words, it must not be called concurrently with searches
+func (h *HNSW[T]) SetEfSearch(ef int) {
+	if ef > 0 {
+		h.config.EfSearch = min(ef, max(len(h.links), 1))
+	}
+}
+
+// Config returns the parameters the index was built with
+func (h *HNSW[T]) Config() HNSWConfig {
+	return h.config
+}
+
+// Search returns approximately the k words most similar to a vector of the
+// model's scalar type and their cosine similarities
+func (h *HNSW[T]) Search(v []T, k uint) ([]Neighbor, error) {
+	view, release := readLocked[T](h.m)
+	defer release()
+	return h.search(view, v, k, -1)
+}
+
+// SearchWord returns approximately the k words most similar to a word of the
+// model, excluding the word itself
+func (h *HNSW[T]) SearchWord(s string, k uint) ([]Neighbor, error) {
+	view, release := readLocked[T](h.m)
+	defer release()
+	v, ok := view.Lookup(s)
+	if !ok {
+		return nil, wordNotFound(s)
+	}
+	// Words out of the vocabulary of models with subwords have no id
+	id, ok := view.ID(s)
+	if !ok {
+		id = -1
+	}
+	return h.search(view, v, k, int32(id))
+}
+
+// search reads the vectors and words of a view of the model, which is read
+// locked once for the whole search rather than for every candidate
+func (h *HNSW[T]) search(view Embedding[T], v []T, k uint,
+	exclude int32) ([]Neighbor, error) {
+
+	if k == 0 {
+		return nil, errors.New("k = 0 for Search() is invalid")
+	}
+	if uint(len(v)) != view.Dimensions() {
+		return nil, fmt.Errorf("Vector has %d dimensions, model has %d",
+			len(v), view.Dimensions())
+	}
+	mag := magnitudeScalars(v)
+	if mag == 0 {
+		return nil, errors.New("Vector has no magnitude")
+	}
+	if h.entry < 0 {
+		return nil, nil
+	}
+
+	q := hnswQuery[T]{view: view, vector: v, inverse: 1 / mag}
+	want := int(k)
+	if exclude >= 0 {
+		want++
+	}
+	ep := []hnswCandidate{{h.entry, h.distance(q, h.entry)}}
+	for level := h.maxLevel; level > 0; level-- {
+		ep = h.searchLayer(q, ep, 1, level)
+	}
+	found := h.searchLayer(q, ep, max(h.config.EfSearch, want), 0)
+
+	neighbors := make([]Neighbor, 0, min(len(found), int(k)))
+	for _, c := range found {
+		if c.id == exclude {
+			continue
+		}
+		if len(neighbors) == int(k) {
+			break
+		}
+		neighbors = append(neighbors, Neighbor{
+			Word:       view.Word(int(c.id)),
+			Similarity: 1 - c.dist,
+		})
+	}
+	slices.SortStableFunc(neighbors, compareNeighbors)
+	return neighbors, nil
+}
+
+/** HNSW Construction **/
+
+// hnswQuery is a vector whose distances to words are measured with the
+// vectors of a view of the model
+type hnswQuery[T VectorScalar] struct {
+	view    Embedding[T]
+	vector  []T
+	inverse float64
+}
+
+type hnswCandidate struct {
+	id   int32
+	dist float64
+}
+
+// distance is the cosine distance from a query to a word
+func (h *HNSW[T]) distance(q hnswQuery[T], id int32) float64 {
+	return 1 - dotScalars(q.vector, q.view.VectorByID(int(id)))*q.inverse*
+		h.inverse[id]
+}
+
+func (h *HNSW[T]) query(view Embedding[T], id int32) hnswQuery[T] {
+	return hnswQuery[T]{view: view, vector: view.VectorByID(int(id)),
+		inverse: h.inverse[id]}
+}
+
+func (h *HNSW[T]) maxLinks(level int) int {
+	if level == 0 {
+		return 2 * h.config.M
+	}
+	return h.config.M
+}
+
+func (h *HNSW[T]) insert(view Embedding[T], id int32, level int) {
+	h.links[id] = make([][]int32, level+1)
+	if h.entry < 0 {
+		h.entry = id
+		h.maxLevel = level
+		return
+	}
+
+	q := h.query(view, id)
+	ep := []hnswCandidate{{h.entry, h.distance(q, h.entry)}}
+	for l := h.maxLevel; l > level; l-- {
+		ep = h.searchLayer(q, ep, 1, l)
+	}
+	for l := min(level, h.maxLevel); l >= 0; l-- {
+		found := h.searchLayer(q, ep, h.config.EfConstruction, l)
+		neighbors := h.selectNeighbors(q, found, h.config.M)
+		h.links[id][l] = make([]int32, len(neighbors), h.maxLinks(l)+1)
+		for i, nb := range neighbors {
+			h.links[id][l][i] = nb.id
+			h.connect(q, nb.id, id, l)
+		}
+		ep = found
+	}
+	if level > h.maxLevel {
+		h.entry = id
+		h.maxLevel = level
+	}
+}
+
+// connect links word a to word b in a layer, pruning the links of a if it
+// has too many, distances are measured with the view of query q
+func (h *HNSW[T]) connect(q hnswQuery[T], a, b int32, level int) {
+	links := append(h.links[a][level], b)
+	if len(links) <= h.maxLinks(level) {
+		h.links[a][level] = links
+		return
+	}
+	q = h.query(q.view, a)
+	candidates := make([]hnswCandidate, len(links))
+	for i, id := range links {
+		candidates[i] = hnswCandidate{id, h.distance(q, id)}
+	}
+	sortCandidates(candidates)
+	selected := h.selectNeighbors(q, candidates, h.maxLinks(level))
+	links = links[:len(selected)]
+	for i, c := range selected {
+		links[i] = c.id
+	}
+	h.links[a][level] = links
+}
+
+// selectNeighbors picks up to m of candidates sorted by distance with the
+// heuristic of the HNSW paper, a candidate is only kept if it is closer to the
+// query than to any kept candidate, which keeps links to distant clusters
+func (h *HNSW[T]) selectNeighbors(q hnswQuery[T], candidates []hnswCandidate,
+	m int) []hnswCandidate {
+
+	if len(candidates) <= m {
+		return candidates
+	}
+	selected := make([]hnswCandidate, 0, m)
+	for _, c := range candidates {
+		if len(selected) == m {
+			break
+		}
+		cq := h.query(q.view, c.id)
+		keep := true
+		for _, s := range selected {
+			if h.distance(cq, s.id) < c.dist {
+				keep = false
+				break
+			}
+		}
+		if keep {
+			selected = append(selected, c)
+		}
+	}
+	return selected
+}
+
+// searchLayer returns the ef words nearest to a query found by a best first
+// search of a layer from the entry points ep, sorted by distance
+func (h *HNSW[T]) searchLayer(q hnswQuery[T], ep []hnswCandidate, ef int,
+	level int) []hnswCandidate {
+
+	visited := h.visited.Get().(*hnswVisited)
+	defer h.visited.Put(visited)
+	visited.reset(len(h.links))
+
+	candidates := candidateHeap{}
+	results := candidateHeap{farthest: true}
+	for _, c := range ep {
+		visited.visit(c.id)
+		candidates.push(c)
+		results.push(c)
+		if results.len() > ef {
+			results.pop()
+		}
+	}
+	for candidates.len() > 0 {
+		c := candidates.pop()
+		if results.len() >= ef && c.dist > results.top().dist {
+			break
+		}
+		for _, id := range h.links[c.id][level] {
+			if !visited.visit(id) {
+				continue
+			}
+			dist := h.distance(q, id)
+			if results.len() < ef || dist < results.top().dist {
+				candidates.push(hnswCandidate{id, dist})
+				results.push(hnswCandidate{id, dist})
+				if results.len() > ef {
+					results.pop()
+				}
+			}
+		}
+	}
+	sortCandidates(results.items)
+	return results.items
+}
+
+func sortCandidates(candidates []hnswCandidate) {
+	slices.SortFunc(candidates, func(a, b hnswCandidate) int {
+		if a.dist != b.dist {
+			if a.dist < b.dist {
+				return -1
+			}
+			return 1
+		}
+		return int(a.id - b.id)
+	})
+}
+
+// candidateHeap is a binary heap of candidates with the nearest on top, or
+// the farthest if farthest is set
+type candidateHeap struct {
+	items    []hnswCandidate
+	farthest bool
+}
+
+func (c *candidateHeap) len() int           { return len(c.items) }
+func (c *candidateHeap) top() hnswCandidate { return c.items[0] }
+
+func (c *candidateHeap) less(i, j int) bool {
+	if c.farthest {
+		return c.items[i].dist > c.items[j].dist
+	}
+	return c.items[i].dist < c.items[j].dist
+}
+
+func (c *candidateHeap) push(x hnswCandidate) {
+	c.items = append(c.items, x)
+	for i := len(c.items) - 1; i > 0; {
+		parent := (i - 1) / 2
+		if !c.less(i, parent) {
+			break
+		}
+		c.items[i], c.items[parent] = c.items[parent], c.items[i]
+		i = parent
+	}
+}
+
+func (c *candidateHeap) pop() hnswCandidate {
+	x := c.items[0]
+	last := len(c.items) - 1
+	c.items[0] = c.items[last]
+	c.items = c.items[:last]
+	for i := 0; ; {
+		least, l, r := i, 2*i+1, 2*i+2
+		if l < last && c.less(l, least) {
+			least = l
+		}
+		if r < last && c.less(r, least) {
+			least = r
+		}
+		if least == i {
+			break
+		}
+		c.items[i], c.items[least] = c.items[least], c.items[i]
+		i = least
+	}
+	return x
+}
+
+// hnswVisited marks the words visited by a search, marks are cleared by
+// incrementing the generation rather than clearing the slice
+type hnswVisited struct {
+	marks []uint16
+	gen   uint16
+}
+
+func (v *hnswVisited) reset(size int) {
+	if len(v.marks) < size {
+		v.marks = make([]uint16, size)
+		v.gen = 0
+	}
+	v.gen++
+	if v.gen == 0 {
+		clear(v.marks)
+		v.gen = 1
+	}
+}
+
+// visit marks a word as visited and returns whether it wasn't already
+func (v *hnswVisited) visit(id int32) bool {
+	if v.marks[id] == v.gen {
+		return false
+	}
+	v.marks[id] = v.gen
+	return true
+}
+
+/** HNSW Serialization **/
+
+const (
+	hnswMagic   = "GWHN"
+	hnswVersion = 1
+)
+
+// hnswHeader starts a saved index, the fingerprint of the vocabulary makes
+// sure that an index is only loaded with the model it was built from
+type hnswHeader struct {
+	Magic                       [4]byte
+	Version                     uint32
+	M, EfConstruction, EfSearch uint32
+	Size                        uint64
+	Dim                         uint32
+	Entry                       int32
+	MaxLevel                    uint32
+	Fingerprint                 uint64
+}
+
+// vocabularyFingerprint hashes the dimensions and words of a model in order
+func vocabularyFingerprint[T VectorScalar](m Embedding[T]) uint64 {
+	f := fnv.New64a()
+	fmt.Fprintf(f, "%d\n", m.Dimensions())
+	for word := range m.Words() {
+		io.WriteString(f, word)
+		f.Write([]byte{0})
+	}
+	return f.Sum64()
+}
+
+// Save writes the graph of the index, which can be loaded again with the
+// same model by LoadHNSW
+func (h *HNSW[T]) Save(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	hdr := hnswHeader{
+		Version:        hnswVersion,
+		M:              uint32(h.config.M),
+		EfConstruction: uint32(h.config.EfConstruction),
+		EfSearch:       uint32(h.config.EfSearch),
+		Size:           uint64(len(h.links)),
+		Dim:            uint32(h.m.Dimensions()),
+		Entry:          h.entry,
+		MaxLevel:       uint32(h.maxLevel),
+		Fingerprint:    vocabularyFingerprint(h.m),
+	}
+	copy(hdr.Magic[:], hnswMagic)
+	if err := binary.Write(bw, binary.LittleEndian, &hdr); err != nil {
+		return err
+	}
+	for _, levels := range h.links {
+		bw.WriteByte(uint8(len(levels)))
+		for _, links := range levels {
+			binary.Write(bw, binary.LittleEndian, uint32(len(links)))
+			if err := binary.Write(bw, binary.LittleEndian,
+				links); err != nil {
+				return err
+			}
+		}
+	}
+	return bw.Flush()
+}
+
+// SaveFile writes the graph of the index to a file
+func (h *HNSW[T]) SaveFile(p string) error {
+	return createModelFile(p, h.Save)
+}
+
+// LoadHNSW loads an index saved by Save for the model it was built from
+func LoadHNSW[T VectorScalar](r io.Reader, m Embedding[T]) (*HNSW[T],
+	error) {
+
+	br := bufio.NewReader(r)
+	var hdr hnswHeader
+	if err := binary.Read(br, binary.LittleEndian, &hdr); err != nil {
+		return nil, err
+	}
+	if string(hdr.Magic[:]) != hnswMagic {
+		return nil, errors.New("Not an HNSW index, magic bytes don't match")
+	}
+	if hdr.Version != hnswVersion {
+		return nil, fmt.Errorf("Unsupported HNSW index version %d",
+			hdr.Version)
+	}
+	if hdr.Size != uint64(idLimit(m)) ||
+		hdr.Dim != uint32(m.Dimensions()) ||
+		hdr.Fingerprint != vocabularyFingerprint(m) {
+		return nil, errors.New("HNSW index was built from a different model")
+	}
+	if hdr.MaxLevel >= hnswMaxLevel ||
+		hdr.Entry < -1 || (hdr.Entry >= 0 && uint64(hdr.Entry) >= hdr.Size) {
+		return nil, errors.New("Invalid HNSW index header")
+	}
+	// The candidate lists and links can't hold more than every word
+	limit := max(hdr.Size, 1)
+	if hdr.M == 0 || hdr.M > hnswMaxM || uint64(hdr.M) > limit ||
+		hdr.EfConstruction == 0 || uint64(hdr.EfConstruction) > limit ||
+		hdr.EfSearch == 0 || uint64(hdr.EfSearch) > limit {
+		return nil, errors.New("Invalid HNSW index header")
+	}
+
+	h := newHNSW(m, HNSWConfig{
+		M:              int(hdr.M),
+		EfConstruction: int(hdr.EfConstruction),
+		EfSearch:       int(hdr.EfSearch),
+	})
+	if hdr.Entry >= 0 {
+		h.entry = hdr.Entry
+		h.maxLevel = int(hdr.MaxLevel)
+	}
+	for id := range h.links {
+		levels, err := br.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		// Only the ids of deleted words have no layers
+		if (levels == 0) != (m.VectorByID(id) == nil) ||
+			levels > hnswMaxLevel {
+			return nil, errors.New("Invalid HNSW index layers")
+		}
+		h.links[id] = make([][]int32, levels)
+		for l := range h.links[id] {
+			var n uint32
+			if err := binary.Read(br, binary.LittleEndian, &n); err != nil {
+				return nil, err
+			}
+			if int(n) > h.maxLinks(l) {
+				return nil, errors.New("Invalid HNSW index links")
+			}
+			// Loaded graphs aren't extended, so links take no spare room
+			links := make([]int32, n)
+			if err := binary.Read(br, binary.LittleEndian,
+				links); err != nil {
+				return nil, err
+			}
+			h.links[id][l] = links
+		}
+	}
+	// Links must point at words with the layer they are linked in
+	for _, levels := range h.links {
+		for l, links := range levels {
+			for _, id := range links {
+				if id < 0 || int(id) >= len(h.links) ||
+					len(h.links[id]) <= l {
+					return nil, errors.New("Invalid HNSW index links")
+				}
+			}
+		}
+	}
+	if h.entry >= 0 && len(h.links[h.entry]) <= h.maxLevel {
+		return nil, errors.New("Invalid HNSW index entry point")
+	}
+	return h, nil
+}
+
+// LoadHNSWFile loads an index saved by SaveFile for the model it was built
+// from
+func LoadHNSWFile[T VectorScalar](p string, m Embedding[T]) (*HNSW[T],
+	error) {
+
+	file, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return LoadHNSW(file, m)
+}
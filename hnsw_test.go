@@ -0,0 +1,234 @@
+/*
+
+Copyright (C) 2024 Jackie Deng
+
+Permission to use, copy, modify, and/or distribute this software for any
+purpose with or without fee is hereby granted.
+
+THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES WITH
+REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF MERCHANTABILITY AND
+FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY SPECIAL, DIRECT,
+INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES WHATSOEVER RESULTING FROM
+LOSS OF USE, DATA OR PROFITS, WHETHER IN AN ACTION OF CONTRACT, NEGLIGENCE OR
+OTHER TORTIOUS ACTION, ARISING OUT OF OR IN CONNECTION WITH THE USE OR
+PERFORMANCE OF THIS SOFTWARE.
+
+*/
+
+package gowe
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math/rand/v2"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testRandomPlain returns a plaintext model of random vectors with clusters
+// so that neighbors are meaningful
+func testRandomPlain(size, dim int, seed uint64) string {
+	rng := rand.New(rand.NewPCG(seed, 1))
+	centers := make([][]float64, 20)
+	for i := range centers {
+		centers[i] = make([]float64, dim)
+		for j := range centers[i] {
+			centers[i][j] = rng.NormFloat64() / 2
+		}
+	}
+	var sb strings.Builder
+	for i := range size {
+		fmt.Fprintf(&sb, "w%d", i)
+		center := centers[rng.IntN(len(centers))]
+		for j := range dim {
+			fmt.Fprintf(&sb, " %.4f", center[j]+rng.NormFloat64()/4)
+		}
+		sb.WriteString("\n")
+	}
+	return sb.String()
+}
+
+// recall measures the fraction of the exact nearest neighbors of queries
+// found by an approximate search
+func recall[T VectorScalar](t *testing.T, m Embedding[T], k uint,
+	search func(word string) ([]Neighbor, error)) float64 {
+
+	t.Helper()
+	found, total := 0, 0
+	for id := 0; id < int(m.VocabularySize()); id += 20 {
+		word := m.Word(id)
+		exact, err := NNearest(m, word, k)
+		if err != nil {
+			t.Fatal(err)
+		}
+		approx, err := search(word)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := make(map[string]bool)
+		for _, nb := range exact {
+			want[nb.Word] = true
+		}
+		for _, nb := range approx {
+			if want[nb.Word] {
+				found++
+			}
+		}
+		total += len(exact)
+	}
+	return float64(found) / float64(total)
+}
+
+func TestHNSWRecall(t *testing.T) {
+	plain := testRandomPlain(2000, 24, 1)
+	fm := NewFloatModel[float32]()
+	if err := fm.LoadPlain(strings.NewReader(plain)); err != nil {
+		t.Fatal(err)
+	}
+	im := NewIntModel[int8]()
+	err := im.LoadPlain(strings.NewReader(plain), WithMaxMagnitude(4))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := HNSWConfig{M: 12, EfConstruction: 100, EfSearch: 64, Seed: 1}
+	fh := NewHNSW(fm, config)
+	if r := recall(t, fm, 10, func(word string) ([]Neighbor, error) {
+		return fh.SearchWord(word, 10)
+	}); r < 0.95 {
+		t.Errorf("FloatModel HNSW recall@10 should be at least 0.95, got %f",
+			r)
+	}
+	ih := NewHNSW(im, config)
+	if r := recall(t, im, 10, func(word string) ([]Neighbor, error) {
+		return ih.SearchWord(word, 10)
+	}); r < 0.95 {
+		t.Errorf("IntModel HNSW recall@10 should be at least 0.95, got %f",
+			r)
+	}
+
+	nearest, err := fh.Search(fm.Vector("w7"), 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nearest) != 3 || nearest[0].Word != "w7" ||
+		nearest[0].Similarity < 0.999 {
+		t.Errorf("Nearest to the vector of w7 should be w7, got %v", nearest)
+	}
+	nearest, err = fh.SearchWord("w7", 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, nb := range nearest {
+		if nb.Word == "w7" {
+			t.Error("SearchWord should exclude the word itself")
+		}
+	}
+	if _, err := fh.SearchWord("cat", 3); err == nil {
+		t.Error("Words not in the model should fail")
+	}
+	if _, err := fh.Search([]float32{1}, 3); err == nil {
+		t.Error("Vectors of the wrong dimensions should fail")
+	}
+}
+
+func TestHNSWSaveLoad(t *testing.T) {
+	m := NewFloatModel[float32]()
+	err := m.LoadPlain(strings.NewReader(testRandomPlain(500, 8, 2)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The id of a deleted word is a gap that is left out of the graph
+	m.Delete("w200")
+	h := NewHNSW(m, HNSWConfig{Seed: 2})
+
+	p := filepath.Join(t.TempDir(), "model.hnsw")
+	if err := h.SaveFile(p); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadHNSWFile(p, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.Config() != (HNSWConfig{M: 16, EfConstruction: 200,
+		EfSearch: 64}) {
+		t.Errorf("Loaded config should be the defaults, got %v",
+			loaded.Config())
+	}
+	for _, word := range []string{"w0", "w123", "w499"} {
+		want, _ := h.SearchWord(word, 5)
+		got, err := loaded.SearchWord(word, 5)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("Loaded index should find %v for %q, got %v", want,
+				word, got)
+		}
+		for _, nb := range got {
+			if nb.Word == "" || nb.Word == "w200" {
+				t.Errorf("Index should not find deleted words, got %v", got)
+			}
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := h.Save(&buf); err != nil {
+		t.Fatal(err)
+	}
+	other := NewFloatModel[float32]()
+	err = other.LoadPlain(strings.NewReader(
+		strings.ReplaceAll(testRandomPlain(500, 8, 2), "w", "v")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadHNSW(bytes.NewReader(buf.Bytes()), other); err == nil {
+		t.Error("Index should not load for a different model")
+	}
+	data := buf.Bytes()
+	if _, err := LoadHNSW(bytes.NewReader(data[:len(data)/2]),
+		m); err == nil {
+		t.Error("Truncated index should fail to load")
+	}
+
+	// Parameters beyond what the vocabulary can reach would allocate
+	// without bound
+	for _, tt := range []struct {
+		name   string
+		offset int
+		v      uint32
+	}{
+		{"zero M", 8, 0},
+		{"huge M", 8, 1 << 30},
+		{"huge efConstruction", 12, 501},
+		{"huge efSearch", 16, 1 << 31},
+	} {
+		corrupt := bytes.Clone(data)
+		binary.LittleEndian.PutUint32(corrupt[tt.offset:], tt.v)
+		if _, err := LoadHNSW(bytes.NewReader(corrupt), m); err == nil {
+			t.Errorf("Index with %s should fail to load", tt.name)
+		}
+	}
+
+	// The parameters of indexes of small vocabularies are bounded when built
+	small := NewFloatModel[float32]()
+	err = small.LoadPlain(strings.NewReader(testRandomPlain(10, 8, 2)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf.Reset()
+	if err := NewHNSW(small, HNSWConfig{}).Save(&buf); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err = LoadHNSW(bytes.NewReader(buf.Bytes()), small)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.Config() != (HNSWConfig{M: 10, EfConstruction: 10,
+		EfSearch: 10}) {
+		t.Errorf("Config of a 10 word index should be bounded by 10, got %v",
+			loaded.Config())
+	}
+}
@@ -19,248 +19,548 @@ package gowe
 
 import (
 	"bufio"
-	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
-	"os"
-	"strconv"
-	"strings"
+	"iter"
+	"maps"
+	"math"
+	"slices"
+	"sync"
+	"unsafe"
 )
 
 /** IntModel **/
 type IntModel[I IntScalar] struct {
-	dim     uint
-	vectors map[string]*IntVector[I]
+	// mu guards store so that the model can be changed while it is read
+	mu    sync.RWMutex
+	store vectorStore[I]
+	// shift is the QuantizationShift shared by every vector in the model,
+	// shiftSet is whether a load has set it
+	shift    uint8
+	shiftSet bool
+	metadata map[string]string
 }
 
 func NewIntModel[I IntScalar]() *IntModel[I] {
 	return &IntModel[I]{
-		dim:     uint(0),
-		vectors: make(map[string]*IntVector[I], 0),
+		store:    newVectorStore[I](),
+		metadata: make(map[string]string),
 	}
 }
 
+// Vector returns a copy of the vector of a word, or a zero vector if the word
+// isn't in the model
 func (m *IntModel[I]) Vector(s string) []I {
-	if _, ok := m.vectors[s]; !ok {
-		return make([]I, m.dim)
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return slices.Clone(m.vector(s))
+}
+
+// Lookup returns a copy of the vector of a word and whether the word is in
+// the model
+func (m *IntModel[I]) Lookup(s string) ([]I, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	v, ok := m.store.lookup(s)
+	return slices.Clone(v), ok
+}
+
+// vector returns the vector of a word in the model's storage, the model must
+// be locked
+func (m *IntModel[I]) vector(s string) []I {
+	v, ok := m.store.lookup(s)
+	if !ok {
+		return make([]I, m.store.dim)
 	}
-	return m.vectors[s].scalars
+	return v
 }
 
 func (m *IntModel[I]) Dimensions() uint {
-	return m.dim
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.store.dim
 }
 
 func (m *IntModel[I]) VocabularySize() uint {
-	return uint(len(m.vectors))
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return uint(m.store.len())
+}
+
+func (m *IntModel[I]) idLimit() int {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.store.rows()
 }
 
+// Shift returns the QuantizationShift of the vectors in the model
+func (m *IntModel[I]) Shift() uint8 {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.shift
+}
+
+// Words returns the vocabulary in the order it was loaded, which for most
+// published models is the order of corpus frequency. Words set after the
+// call aren't seen by the iterator, and words deleted before they are reached
+// are skipped.
+func (m *IntModel[I]) Words() iter.Seq[string] {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.store.allLocked(m.mu.RLocker())
+}
+
+// All returns the words and vectors of the model in the order they were
+// loaded. Each vector is copied into a buffer which is reused by the next
+// iteration, so it must be copied to be kept. Words set after the call aren't
+// seen by the iterator, and words deleted before they are reached are
+// skipped.
+func (m *IntModel[I]) All() iter.Seq2[string, []I] {
+	words := m.Words()
+	return func(yield func(string, []I) bool) {
+		vector := make([]I, m.Dimensions())
+		for word := range words {
+			m.mu.RLock()
+			v, ok := m.store.lookup(word)
+			copy(vector, v)
+			m.mu.RUnlock()
+			if ok && !yield(word, vector) {
+				return
+			}
+		}
+	}
+}
+
+// ID returns the id of a word, ids number the vocabulary from 0 in the order
+// it was loaded and don't change when other words are deleted
+func (m *IntModel[I]) ID(s string) (int, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.store.id(s)
+}
+
+// Word returns the word with an id, or "" if there is no such id
+func (m *IntModel[I]) Word(id int) string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.store.word(id)
+}
+
+// VectorByID returns the vector of the word with an id, or nil if there is no
+// such id. Unlike Vector, it isn't copied, so it must not be read while Set
+// replaces the vector of the same word.
+func (m *IntModel[I]) VectorByID(id int) []I {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.store.vectorByID(id)
+}
+
+// Metadata returns a copy of the metadata saved with the model in the native
+// format
+func (m *IntModel[I]) Metadata() map[string]string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return maps.Clone(m.metadata)
+}
+
+// SetMetadata sets an entry of the metadata saved with the model in the
+// native format
+func (m *IntModel[I]) SetMetadata(key, value string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.metadata[key] = value
+}
+
+// Similarity returns the cosine similarity between two words, or 0 if either
+// isn't in the model. Use SimilarityE to tell missing words apart.
 func (m *IntModel[I]) Similarity(s, t string) float64 {
-	v, ok := m.vectors[s]
+	similarity, _ := m.SimilarityE(s, t)
+	return similarity
+}
+
+// SimilarityE returns the cosine similarity between two words, or an error
+// wrapping ErrWordNotFound if either isn't in the model
+func (m *IntModel[I]) SimilarityE(s, t string) (float64, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	v, ok := m.store.lookup(s)
 	if !ok {
-		return 0
+		return 0, wordNotFound(s)
 	}
-	u, ok := m.vectors[t]
+	u, ok := m.store.lookup(t)
 	if !ok {
-		return 0
+		return 0, wordNotFound(t)
 	}
-	return (*v).CosineSimilarity(*u)
+	return IntVector[I]{scalars: v, shift: m.shift}.CosineSimilarity(
+		IntVector[I]{scalars: u, shift: m.shift}), nil
 }
 
-// plainLineToIntModel reads a line from reader to add a word entry, it
-// returns true if successfully added and false if there is nothing left to
-// read or if there was an error.
-func (m *IntModel[I]) plainLineToIntModel(
-	br *bufio.Reader, quantShift uint8) (bool, error) {
+// Set adds a word to the model or replaces its vector, the vector is copied.
+// It can be called while the model is being read or searched.
+func (m *IntModel[I]) Set(s string, v []I) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.store.put(s, v)
+}
 
-	word, err := br.ReadString(' ')
-	word = strings.TrimRight(word, " ")
-	if err != nil {
-		return false, nil
+// SetFloat is Set for a float vector, which is quantized with the shift of
+// the model. The shift is set by the first load, which must come first.
+func (m *IntModel[I]) SetFloat(s string, v []float64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.shiftSet {
+		return errors.New("IntModel has no quantization shift, load vectors " +
+			"before SetFloat")
 	}
-
-	line, err := br.ReadString('\n')
-	splits := strings.Split(strings.TrimRight(line, "\n"), " ")
-	if uint(len(splits)) != m.dim {
-		return false, fmt.Errorf(
-			"Plaintext line has %d values but Model has %d dimensions",
-			len(splits), m.dim)
+	var precision I
+	limit := math.Ldexp(1, int(unsafe.Sizeof(precision))*8-1)
+	scale := math.Ldexp(1, int(m.shift))
+	for _, f := range v {
+		if q := f * scale; q < -limit || q >= limit || math.IsNaN(q) {
+			return fmt.Errorf("Scalar %g of %q is out of range for the "+
+				"quantization shift %d", f, s, m.shift)
+		}
 	}
+	q := make([]I, len(v))
+	quantizeScalars(q, v, m.shift)
+	return m.store.put(s, q)
+}
 
-	vector := make([]float64, m.dim)
-	for i := range m.dim {
-		val, err := strconv.ParseFloat(splits[i], 64)
-		if err != nil {
-			return false, errors.Join(errors.New("Invalid plaintext float"),
-				err)
-		}
-		vector[i] = val
+// Delete removes a word from the model and returns whether it was in the
+// model. The ids of other words don't change, the id of the deleted word is
+// left as a gap that Word and VectorByID return nothing for, and setting the
+// word again gives it a new id. The row of a deleted word is kept until
+// Compact is called.
+func (m *IntModel[I]) Delete(s string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.store.delete(s)
+}
+
+// Compact frees the rows of deleted words. The ids of the words after them
+// change, so ids held by callers and indexes built from the model are
+// invalid afterwards, and it must not be called while iterating over the
+// model.
+func (m *IntModel[I]) Compact() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.store.compact()
+}
+
+// Has returns whether a word is in the model
+func (m *IntModel[I]) Has(s string) bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	_, ok := m.store.id(s)
+	return ok
+}
+
+func (m *IntModel[I]) readLock() (Embedding[I], func()) {
+	m.mu.RLock()
+	return storeView[I]{store: &m.store}, m.mu.RUnlock
+}
+
+// setShift sets the shift of the model, which can't change once the model has
+// any vectors
+func (m *IntModel[I]) setShift(shift uint8) error {
+	if m.store.len() > 0 && shift != m.shift {
+		return fmt.Errorf("IntModel has shift %d but vectors with shift %d "+
+			"were loaded", m.shift, shift)
 	}
-	qv := QuantizeFloatVector[I](FloatVector[float64]{scalars: vector},
-		quantShift)
-	m.vectors[word] = &qv
-	return true, nil
+	m.shift, m.shiftSet = shift, true
+	return nil
 }
 
+// FromPlainFile loads a plaintext file, see LoadPlainFile
+//
+// Deprecated: opts are untyped, use LoadPlainFile with WithHeader and
+// WithMaxMagnitude instead.
 func (m *IntModel[I]) FromPlainFile(
 	p string, desc bool, opts ...interface{}) error {
 
-	if len(opts) != 1 {
-		return errors.New("Missing maxMagnitude (float64) as opts for " +
-			"parsing plaintext into IntModel")
+	lopts, err := legacyLoadOptions(opts)
+	if err != nil {
+		return err
 	}
+	return m.LoadPlainFile(p, append(lopts, WithHeader(desc))...)
+}
 
-	maxMagnitude, ok := opts[0].(float64)
-	if !ok {
-		return errors.New("maxMagnitude opt should be type float64")
-	}
+// FromPlainReader loads a plaintext stream, see LoadPlain
+//
+// Deprecated: opts are untyped, use LoadPlain with WithHeader and
+// WithMaxMagnitude instead.
+func (m *IntModel[I]) FromPlainReader(
+	r io.Reader, desc bool, opts ...interface{}) error {
 
-	file, err := os.Open(p)
-	defer file.Close()
+	lopts, err := legacyLoadOptions(opts)
 	if err != nil {
 		return err
 	}
+	return m.LoadPlain(r, append(lopts, WithHeader(desc))...)
+}
 
-	reader := bufio.NewReader(file)
-	if desc {
-		// Scan the first line if description is provided
-		var size, dim uint
-		n, err := fmt.Fscanln(file, &size, &dim)
-		if err != nil {
-			return errors.Join(
-				errors.New("Could not scan description in plaintext"), err)
-		}
-		if n <= 2 {
-			return errors.New(
-				"Size and dim not found in description in plaintext")
-		}
-		// Save the dimension but vocabulary size will be dynamically
-		// determined
-		m.dim = dim
-	} else {
-		// Read the first line and determine dim
-		line, err := reader.ReadString('\n')
-		if err != nil {
-			return errors.New("Could not read first line in plaintext")
-		}
-		splits := strings.Split(line, " ")
-		m.dim = uint(len(splits) - 1)
-		if m.dim == 0 {
-			return errors.New("Zero dimensions detected in plaintext")
-		}
+// LoadPlainFile loads the model from a plaintext file, see LoadPlain
+func (m *IntModel[I]) LoadPlainFile(p string, opts ...LoadOption) error {
+	return loadModelFile(p, opts, m.LoadPlain)
+}
 
-		// Seek back to the beginning
-		file.Seek(0, io.SeekStart)
-		reader = bufio.NewReader(file)
+// LoadPlain loads and quantizes the model from a plaintext stream,
+// WithMaxMagnitude is required and WithHeader must be set if the stream
+// starts with a "<size> <dim>" description.
+func (m *IntModel[I]) LoadPlain(r io.Reader, opts ...LoadOption) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	o := newLoadOptions(opts)
+	if err := o.checkMaxMagnitude(); err != nil {
+		return o.finish(err)
 	}
 
-	quantShift := QuantizationShift[I](maxMagnitude)
-	readMore := true
-	for readMore {
-		readMore, err = m.plainLineToIntModel(reader, quantShift)
-		if err != nil {
+	r, err := o.open(r)
+	if err != nil {
+		return o.finish(err)
+	}
+	pr, err := newPlainReader(bufio.NewReader(r), o.Header)
+	if err != nil {
+		return o.finish(err)
+	}
+	if err := m.store.setDim(pr.dim); err != nil {
+		return o.finish(err)
+	}
+	// The shift is only set once the header and dimensions check out, so a
+	// failed load leaves an empty model as it was
+	if err := m.setShift(QuantizationShift[I](o.MaxMagnitude)); err != nil {
+		return o.finish(err)
+	}
+	m.store.reserve(o.Filter.capacity(pr.size))
+
+	// Each worker parses into its own float64 vector and quantizes it
+	shift := m.shift
+	return o.finish(loadPlain(pr, &m.store, o,
+		func() plainParser[I] {
+			vector := make([]float64, pr.dim)
+			return func(dst []I, values []byte) error {
+				if err := parsePlainValues(vector, values); err != nil {
+					return err
+				}
+				quantizeScalars(dst, vector, shift)
+				return nil
+			}
+		}))
+}
+
+// readQuantizedBinaryVectors reads the vectors of r as binary scalars B
+// into buf, then quantizes them into the model
+func readQuantizedBinaryVectors[I IntScalar, B FloatScalar](m *IntModel[I],
+	r *binaryReader, buf []B, o *LoadOptions) error {
+
+	start := m.store.len()
+	for !o.Filter.full(m.store.len() - start) {
+		word, ok, err := readBinaryRecord(r, buf, &o.Filter)
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
 			return err
 		}
+		if ok {
+			quantizeScalars(m.store.addRow(word), buf, m.shift)
+			o.loaded(m.store.len() - start)
+		}
 	}
-
 	return nil
 }
 
-// readFloat32BinaryVector handles reading vectors when the file has float32
-// values
-func (m *IntModel[I]) readFloat32BinaryVector(
-	br *bufio.Reader, quantShift uint8) (bool, error) {
+// FromBinaryFile loads a binary file, see LoadBinaryFile
+//
+// Deprecated: opts are untyped, use LoadBinaryFile with WithBitSize and
+// WithMaxMagnitude instead.
+func (m *IntModel[I]) FromBinaryFile(
+	p string, bitSize int, opts ...interface{}) error {
 
-	word, err := br.ReadString(' ')
+	lopts, err := legacyLoadOptions(opts)
 	if err != nil {
-		return false, nil
+		return err
 	}
-	word = strings.TrimRight(word, " ")
+	return m.LoadBinaryFile(p, append(lopts, WithBitSize(bitSize))...)
+}
 
-	vector := make([]float32, m.dim)
-	err = binary.Read(br, binary.LittleEndian, vector)
+// FromBinaryReader loads a binary stream, see LoadBinary
+//
+// Deprecated: opts are untyped, use LoadBinary with WithBitSize and
+// WithMaxMagnitude instead.
+func (m *IntModel[I]) FromBinaryReader(
+	r io.Reader, bitSize int, opts ...interface{}) error {
+
+	lopts, err := legacyLoadOptions(opts)
 	if err != nil {
-		return false, err
+		return err
 	}
+	return m.LoadBinary(r, append(lopts, WithBitSize(bitSize))...)
+}
 
-	qv := QuantizeFloatVector[I](
-		FloatVector[float32]{scalars: vector}, quantShift)
-	m.vectors[word] = &qv
-	return true, nil
+// LoadBinaryFile loads the model from a binary file, see LoadBinary
+func (m *IntModel[I]) LoadBinaryFile(p string, opts ...LoadOption) error {
+	return loadModelFile(p, opts, m.LoadBinary)
 }
 
-// readFloat64BinaryVector handles reading vectors when the file has float64
-// values
-func (m *IntModel[I]) readFloat64BinaryVector(
-	br *bufio.Reader, quantShift uint8) (bool, error) {
+// LoadBinary loads and quantizes the model from a binary stream,
+// WithMaxMagnitude is required. Binary streams always start with a
+// description and their floats are float32 unless WithBitSize sets 64.
+func (m *IntModel[I]) LoadBinary(r io.Reader, opts ...LoadOption) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	o := newLoadOptions(opts)
+	if err := o.checkMaxMagnitude(); err != nil {
+		return o.finish(err)
+	}
 
-	word, err := br.ReadString(' ')
+	r, err := o.open(r)
 	if err != nil {
-		return false, nil
+		return o.finish(err)
 	}
-	word = strings.TrimRight(word, " ")
-
-	vector := make([]float64, m.dim)
-	err = binary.Read(br, binary.LittleEndian, vector)
+	br, err := newBinaryReader(bufio.NewReader(r), o.ByteOrder)
 	if err != nil {
-		return false, err
+		return o.finish(err)
+	}
+	if err := m.store.setDim(br.dim); err != nil {
+		return o.finish(err)
+	}
+	// The shift is only set once the header and dimensions check out, so a
+	// failed load leaves an empty model as it was
+	if err := m.setShift(QuantizationShift[I](o.MaxMagnitude)); err != nil {
+		return o.finish(err)
 	}
+	m.store.reserve(o.Filter.capacity(br.size))
 
-	qv := QuantizeFloatVector[I](
-		FloatVector[float64]{scalars: vector}, quantShift)
-	m.vectors[word] = &qv
-	return true, nil
+	if o.BitSize == 64 {
+		err = readQuantizedBinaryVectors(m, br, make([]float64, br.dim), o)
+	} else {
+		err = readQuantizedBinaryVectors(m, br, make([]float32, br.dim), o)
+	}
+	return o.finish(err)
 }
 
-func (m *IntModel[I]) FromBinaryFile(
-	p string, bitSize int, opts ...interface{}) error {
+// dequantizedVector returns the vector for a word as floats
+func (m *IntModel[I]) dequantizedVector(s string) []float64 {
+	return DequantizeIntVector[float64](
+		IntVector[I]{scalars: m.vector(s), shift: m.shift}).scalars
+}
 
-	if len(opts) != 1 {
-		return errors.New("Missing maxMagnitude (float64) as opts for " +
-			"parsing plaintext into IntModel")
-	}
+// WritePlainTo writes the dequantized model to w in the plaintext format with
+// a "<size> <dim>" description. Words are written in the order they were
+// loaded, it fails before writing anything if a word is empty or contains
+// whitespace.
+func (m *IntModel[I]) WritePlainTo(w io.Writer) error {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return writePlainVectors(w, m.store.dim, m.store.vocabulary(),
+		m.dequantizedVector)
+}
 
-	maxMagnitude, ok := opts[0].(float64)
-	if !ok {
-		return errors.New("maxMagnitude opt should be type float64")
-	}
+// WritePlainFile writes the model to a plaintext file, see WritePlainTo
+func (m *IntModel[I]) WritePlainFile(p string) error {
+	return createModelFile(p, m.WritePlainTo)
+}
 
-	file, err := os.Open(p)
-	defer file.Close()
+// WriteBinaryTo writes the dequantized model to w in the binary format with
+// scalars of bitSize, which defaults to 32 if it is not 64. Words are written
+// in the order they were loaded, it fails before writing anything if a word
+// is empty or contains whitespace.
+func (m *IntModel[I]) WriteBinaryTo(w io.Writer, bitSize int) error {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return writeBinaryVectors(w, m.store.dim, m.store.vocabulary(),
+		m.dequantizedVector, bitSize)
+}
+
+// WriteBinaryFile writes the model to a binary file, see WriteBinaryTo
+func (m *IntModel[I]) WriteBinaryFile(p string, bitSize int) error {
+	return createModelFile(p, func(w io.Writer) error {
+		return m.WriteBinaryTo(w, bitSize)
+	})
+}
+
+// FromNativeReader loads a model from a stream in the native gowe format,
+// see LoadNative
+func (m *IntModel[I]) FromNativeReader(r io.Reader) error {
+	return m.LoadNative(r)
+}
+
+// LoadNative loads a model from a stream in the native gowe format. The
+// quantized scalars are used as they are, so they must be of type I. The
+// LoadFilter, context and progress of opts apply, and WithMaxMagnitude is
+// only allowed if it gives the shift the model was quantized with. Skipped
+// vectors aren't read into memory, except that a filter of words needs the
+// words ahead of the vectors, which only an uncompressed io.ReaderAt such as
+// a file can provide.
+func (m *IntModel[I]) LoadNative(r io.Reader, opts ...LoadOption) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	o := newLoadOptions(opts)
+
+	src := r
+	r, err := o.open(r)
 	if err != nil {
-		return err
+		return o.finish(err)
 	}
-
-	reader := bufio.NewReader(file)
-	// First line must describe size and dimensions
-	var size, dim uint
-	n, err := fmt.Fscanln(file, &size, &dim)
+	reader := bufio.NewReader(r)
+	h, meta, err := readNativeHeader(reader)
 	if err != nil {
-		return err
+		return o.finish(err)
 	}
-	if n < 2 {
-		return errors.New("Size and dimensions not found in binary")
+	if h.scalar != scalarTypeOf[I]() {
+		return o.finish(fmt.Errorf("Native gowe model has %s scalars but "+
+			"IntModel has %s scalars", h.scalar, scalarTypeOf[I]()))
 	}
-	m.dim = dim
-
-	quantShift := QuantizationShift[I](maxMagnitude)
-	readMore := true
-	if bitSize == 64 {
-		for readMore {
-			readMore, err = m.readFloat64BinaryVector(reader, quantShift)
-			if err != nil {
-				break
-			}
-		}
-	} else {
-		for readMore {
-			readMore, err = m.readFloat32BinaryVector(reader, quantShift)
-			if err != nil {
-				break
-			}
+	if o.MaxMagnitude > 0 {
+		if shift := QuantizationShift[I](o.MaxMagnitude); shift != h.shift {
+			return o.finish(fmt.Errorf("Native gowe model is quantized "+
+				"with shift %d but maxMagnitude %g gives shift %d", h.shift,
+				o.MaxMagnitude, shift))
 		}
 	}
+	if err := m.store.setDim(uint(h.dim)); err != nil {
+		return o.finish(err)
+	}
+	if err := m.setShift(h.shift); err != nil {
+		return o.finish(err)
+	}
+	n, err := readNativeRows(src, reader, h, &m.store, &o.Filter,
+		func(dst, src []I) { copy(dst, src) })
+	if err != nil {
+		return o.finish(err)
+	}
 
-	return nil
+	o.loaded(n)
+	for key, value := range meta {
+		m.metadata[key] = value
+	}
+	return o.finish(nil)
+}
+
+// FromNativeFile loads a model from a file in the native gowe format, see
+// LoadNative
+func (m *IntModel[I]) FromNativeFile(p string) error {
+	return m.LoadNativeFile(p)
+}
+
+// LoadNativeFile loads a model from a file in the native gowe format, see
+// LoadNative
+func (m *IntModel[I]) LoadNativeFile(p string, opts ...LoadOption) error {
+	return loadModelFile(p, opts, m.LoadNative)
+}
+
+// WriteNativeTo writes the quantized model, its shift and its metadata to w
+// in the native gowe format. Words are written in the order they were
+// loaded.
+func (m *IntModel[I]) WriteNativeTo(w io.Writer) error {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return writeNative(w, m.store.dim, m.shift, m.store.vocabulary(),
+		m.vector, m.metadata)
+}
+
+// WriteNativeFile writes the model to a native gowe file, see WriteNativeTo
+func (m *IntModel[I]) WriteNativeFile(p string) error {
+	return createModelFile(p, m.WriteNativeTo)
 }
@@ -0,0 +1,666 @@
+/*
+
+Copyright (C) 2024 Jackie Deng
+
+Permission to use, copy, modify, and/or distribute this software for any
+purpose with or without fee is hereby granted.
+
+THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES WITH
+REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF MERCHANTABILITY AND
+FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY SPECIAL, DIRECT,
+INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES WHATSOEVER RESULTING FROM
+LOSS OF USE, DATA OR PROFITS, WHETHER IN AN ACTION OF CONTRACT, NEGLIGENCE OR
+OTHER TORTIOUS ACTION, ARISING OUT OF OR IN CONNECTION WITH THE USE OR
+PERFORMANCE OF THIS SOFTWARE.
+
+*/
+
+package gowe
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"math"
+	"math/rand/v2"
+	"os"
+	"slices"
+)
+
+/** IVF-PQ Index **/
+
+// ivfpqKsub is the number of codes of each sub-quantizer, so that each code
+// is a byte
+const ivfpqKsub = 256
+
+// IVFPQConfig holds the parameters of an IVF-PQ index, zero values are
+// replaced by the defaults
+type IVFPQConfig struct {
+	// NList is the number of coarse k-means centroids, each of which has an
+	// inverted list of the words nearest to it. Defaults to 256.
+	NList int
+	// M is the number of sub-quantizers, each word is stored as M bytes. It
+	// must divide the dimensions and defaults to a quarter of them.
+	M int
+	// NProbe is the number of lists searched per query. Defaults to 8.
+	NProbe int
+	// Rerank is the number of candidates re-ranked by their exact similarity
+	// when the index has a model, 0 disables re-ranking
+	Rerank int
+	// Iterations is the number of k-means iterations when training. Defaults
+	// to 20.
+	Iterations int
+	// TrainSize bounds the number of vectors BuildIVFPQ trains on. Defaults
+	// to 100000.
+	TrainSize int
+	// Seed seeds the sampling and k-means initialization
+	Seed uint64
+}
+
+func (c *IVFPQConfig) setDefaults(dim int) {
+	if c.NList <= 0 {
+		c.NList = 256
+	}
+	if c.M <= 0 {
+		c.M = max(dim/4, 1)
+		for dim%c.M != 0 {
+			c.M--
+		}
+	}
+	if c.NProbe <= 0 {
+		c.NProbe = 8
+	}
+	if c.Iterations <= 0 {
+		c.Iterations = 20
+	}
+	if c.TrainSize <= 0 {
+		c.TrainSize = 100000
+	}
+}
+
+// IVFPQ is an inverted file index with product quantization for approximate
+// nearest neighbor search by cosine similarity in very large vocabularies.
+// Unit vectors are assigned to the nearest of NList coarse centroids and the
+// residual from the centroid is encoded as M bytes, each the nearest of 256
+// centroids of a slice of the dimensions. Searches probe the NProbe nearest
+// lists and compare the query to the codes with asymmetric distance
+// computation, then optionally re-rank candidates with the vectors of a
+// model.
+type IVFPQ[T VectorScalar] struct {
+	config  IVFPQConfig
+	dim     int
+	dsub    int
+	trained bool
+	// coarse holds NList centroids and codebooks holds the 256 centroids of
+	// each sub-quantizer, indexed by (sub-quantizer * 256 + code) * dsub
+	coarse    []float32
+	codebooks []float32
+	lists     []ivfList
+	words     []string
+	// m is the model used for re-ranking and SearchWord, it may be nil
+	m Embedding[T]
+}
+
+// ivfList is an inverted list, the codes of ids[i] are codes[i*M:(i+1)*M]
+type ivfList struct {
+	ids   []int32
+	codes []uint8
+}
+
+// NewIVFPQ returns an empty index for vectors of dim dimensions, which must
+// be trained before words are added
+func NewIVFPQ[T VectorScalar](dim uint, config IVFPQConfig) (*IVFPQ[T],
+	error) {
+
+	config.setDefaults(int(dim))
+	if dim == 0 || int(dim)%config.M != 0 {
+		return nil, fmt.Errorf("IVFPQ M = %d must divide the dimensions %d",
+			config.M, dim)
+	}
+	return &IVFPQ[T]{
+		config: config,
+		dim:    int(dim),
+		dsub:   int(dim) / config.M,
+		lists:  make([]ivfList, config.NList),
+	}, nil
+}
+
+// BuildIVFPQ trains an index on a sample of the vectors of a model and adds
+// its whole vocabulary, the model is kept for re-ranking and SearchWord
+func BuildIVFPQ[T VectorScalar](m Embedding[T],
+	config IVFPQConfig) (*IVFPQ[T], error) {
+
+	ix, err := NewIVFPQ[T](m.Dimensions(), config)
+	if err != nil {
+		return nil, err
+	}
+	size := idLimit(m)
+	rng := rand.New(rand.NewPCG(ix.config.Seed, 0x6a09e667f3bcc909))
+	vectors := make([][]T, 0, min(size, ix.config.TrainSize))
+	if size <= ix.config.TrainSize {
+		for id := range size {
+			if v := m.VectorByID(id); v != nil {
+				vectors = append(vectors, v)
+			}
+		}
+	} else {
+		sampled := make(map[int]struct{}, ix.config.TrainSize)
+		for len(sampled) < ix.config.TrainSize {
+			sampled[rng.IntN(size)] = struct{}{}
+		}
+		sample := slices.Sorted(maps.Keys(sampled))
+		for _, id := range sample {
+			if v := m.VectorByID(id); v != nil {
+				vectors = append(vectors, v)
+			}
+		}
+	}
+	if err := ix.Train(vectors); err != nil {
+		return nil, err
+	}
+	for id := range size {
+		// The ids of deleted words have no vector
+		v := m.VectorByID(id)
+		if v == nil {
+			continue
+		}
+		if err := ix.Add(m.Word(id), v); err != nil {
+			return nil, err
+		}
+	}
+	ix.SetModel(m)
+	return ix, nil
+}
+
+// SetModel sets the model whose vectors re-rank candidates and are looked up
+// by SearchWord, it must have the vocabulary that was added to the index
+func (ix *IVFPQ[T]) SetModel(m Embedding[T]) {
+	ix.m = m
+}
+
+// SetNProbe sets the number of lists searched per query, it must not be
+// called concurrently with searches
+func (ix *IVFPQ[T]) SetNProbe(n int) {
+	if n > 0 {
+		ix.config.NProbe = min(n, ix.config.NList)
+	}
+}
+
+// SetRerank sets the number of candidates re-ranked with the model, it must
+// not be called concurrently with searches
+func (ix *IVFPQ[T]) SetRerank(n int) {
+	ix.config.Rerank = max(n, 0)
+}
+
+// Config returns the parameters of the index
+func (ix *IVFPQ[T]) Config() IVFPQConfig {
+	return ix.config
+}
+
+// Len returns the number of words in the index
+func (ix *IVFPQ[T]) Len() int {
+	return len(ix.words)
+}
+
+// unitFloat32 writes v scaled to a magnitude of 1 into dst, it returns false
+// if v has no magnitude
+func unitFloat32[T VectorScalar](dst []float32, v []T) bool {
+	mag := magnitudeScalars(v)
+	if mag == 0 {
+		return false
+	}
+	for i := range v {
+		dst[i] = float32(float64(v[i]) / mag)
+	}
+	return true
+}
+
+// squaredDistance is the squared euclidean distance of two vectors
+func squaredDistance(v, u []float32) float32 {
+	d := float32(0)
+	for i := range v {
+		diff := v[i] - u[i]
+		d += diff * diff
+	}
+	return d
+}
+
+// nearestCentroid returns the index of the centroid nearest to v
+func nearestCentroid(centroids, v []float32) int {
+	dim := len(v)
+	best, bestDist := 0, float32(math.Inf(1))
+	for c := 0; c*dim < len(centroids); c++ {
+		if d := squaredDistance(v, centroids[c*dim:(c+1)*dim]); d < bestDist {
+			best, bestDist = c, d
+		}
+	}
+	return best
+}
+
+// kmeans clusters the vectors of dim dimensions in data into k centroids with
+// Lloyd's algorithm, empty clusters are restarted at a random vector
+func kmeans(data []float32, dim, k, iterations int,
+	rng *rand.Rand) []float32 {
+
+	n := len(data) / dim
+	centroids := make([]float32, k*dim)
+	for c, i := range rng.Perm(n)[:k] {
+		copy(centroids[c*dim:], data[i*dim:(i+1)*dim])
+	}
+	sums := make([]float64, k*dim)
+	counts := make([]int, k)
+	for range iterations {
+		clear(sums)
+		clear(counts)
+		for i := range n {
+			v := data[i*dim : (i+1)*dim]
+			c := nearestCentroid(centroids, v)
+			counts[c]++
+			for j, f := range v {
+				sums[c*dim+j] += float64(f)
+			}
+		}
+		for c := range k {
+			centroid := centroids[c*dim : (c+1)*dim]
+			if counts[c] == 0 {
+				i := rng.IntN(n)
+				copy(centroid, data[i*dim:(i+1)*dim])
+				continue
+			}
+			for j := range centroid {
+				centroid[j] = float32(sums[c*dim+j] / float64(counts[c]))
+			}
+		}
+	}
+	return centroids
+}
+
+// Train learns the coarse centroids and the codebooks of the sub-quantizers
+// from a sample of vectors, which needs at least as many vectors as NList
+// and 256. Training discards any words already added.
+func (ix *IVFPQ[T]) Train(vectors [][]T) error {
+	data := make([]float32, 0, len(vectors)*ix.dim)
+	unit := make([]float32, ix.dim)
+	for _, v := range vectors {
+		if len(v) != ix.dim {
+			return fmt.Errorf("Vector has %d dimensions, index has %d",
+				len(v), ix.dim)
+		}
+		if unitFloat32(unit, v) {
+			data = append(data, unit...)
+		}
+	}
+	n := len(data) / ix.dim
+	if n < max(ix.config.NList, ivfpqKsub) {
+		return fmt.Errorf("IVFPQ needs at least %d training vectors, got %d",
+			max(ix.config.NList, ivfpqKsub), n)
+	}
+
+	rng := rand.New(rand.NewPCG(ix.config.Seed, 0xbb67ae8584caa73b))
+	ix.coarse = kmeans(data, ix.dim, ix.config.NList, ix.config.Iterations,
+		rng)
+
+	// Sub-quantizers are trained on the residuals from the coarse centroids,
+	// gathered per sub-quantizer so that each is contiguous
+	residuals := make([]float32, n*ix.dim)
+	for i := range n {
+		v := data[i*ix.dim : (i+1)*ix.dim]
+		c := nearestCentroid(ix.coarse, v)
+		for j := range v {
+			sub, k := j/ix.dsub, j%ix.dsub
+			residuals[(sub*n+i)*ix.dsub+k] = v[j] - ix.coarse[c*ix.dim+j]
+		}
+	}
+	ix.codebooks = make([]float32, 0, ix.config.M*ivfpqKsub*ix.dsub)
+	for sub := range ix.config.M {
+		ix.codebooks = append(ix.codebooks, kmeans(
+			residuals[sub*n*ix.dsub:(sub+1)*n*ix.dsub], ix.dsub, ivfpqKsub,
+			ix.config.Iterations, rng)...)
+	}
+
+	ix.trained = true
+	ix.lists = make([]ivfList, ix.config.NList)
+	ix.words = nil
+	return nil
+}
+
+// Add encodes the vector of a word and adds it to the index
+func (ix *IVFPQ[T]) Add(word string, v []T) error {
+	if !ix.trained {
+		return errors.New("IVFPQ must be trained before adding words")
+	}
+	if len(v) != ix.dim {
+		return fmt.Errorf("Vector has %d dimensions, index has %d", len(v),
+			ix.dim)
+	}
+	unit := make([]float32, ix.dim)
+	// Vectors without magnitude are encoded as their nearest centroid
+	unitFloat32(unit, v)
+	c := nearestCentroid(ix.coarse, unit)
+	for j := range unit {
+		unit[j] -= ix.coarse[c*ix.dim+j]
+	}
+	list := &ix.lists[c]
+	list.ids = append(list.ids, int32(len(ix.words)))
+	for sub := range ix.config.M {
+		codebook := ix.codebooks[sub*ivfpqKsub*ix.dsub : (sub+1)*ivfpqKsub*
+			ix.dsub]
+		list.codes = append(list.codes, uint8(nearestCentroid(codebook,
+			unit[sub*ix.dsub:(sub+1)*ix.dsub])))
+	}
+	ix.words = append(ix.words, word)
+	return nil
+}
+
+// Search returns approximately the k words most similar to a vector. Without
+// re-ranking, similarities are estimated from the codes.
+func (ix *IVFPQ[T]) Search(v []T, k uint) ([]Neighbor, error) {
+	if ix.m == nil {
+		return ix.search(nil, v, k, nil)
+	}
+	view, release := readLocked[T](ix.m)
+	defer release()
+	return ix.search(view, v, k, nil)
+}
+
+// SearchWord returns approximately the k words most similar to a word of the
+// model set with SetModel, excluding the word itself
+func (ix *IVFPQ[T]) SearchWord(s string, k uint) ([]Neighbor, error) {
+	if ix.m == nil {
+		return nil, errors.New("IVFPQ SearchWord needs a model, see SetModel")
+	}
+	view, release := readLocked[T](ix.m)
+	defer release()
+	v, ok := view.Lookup(s)
+	if !ok {
+		return nil, wordNotFound(s)
+	}
+	return ix.search(view, v, k, []string{s})
+}
+
+// search is Search leaving out the words in exclude, candidates are
+// re-ranked with a view of the model that is read locked for the whole
+// search, or not at all if view is nil
+func (ix *IVFPQ[T]) search(view Embedding[T], v []T, k uint,
+	exclude []string) ([]Neighbor, error) {
+
+	if k == 0 {
+		return nil, errors.New("k = 0 for Search() is invalid")
+	}
+	if len(v) != ix.dim {
+		return nil, fmt.Errorf("Vector has %d dimensions, index has %d",
+			len(v), ix.dim)
+	}
+	if !ix.trained {
+		return nil, errors.New("IVFPQ must be trained before searching")
+	}
+	q := make([]float32, ix.dim)
+	if !unitFloat32(q, v) {
+		return nil, errors.New("Vector has no magnitude")
+	}
+
+	// Probe the lists of the nearest coarse centroids
+	probes := make([]hnswCandidate, ix.config.NList)
+	for c := range probes {
+		probes[c] = hnswCandidate{int32(c), float64(squaredDistance(q,
+			ix.coarse[c*ix.dim:(c+1)*ix.dim]))}
+	}
+	sortCandidates(probes)
+	probes = probes[:min(ix.config.NProbe, len(probes))]
+
+	rerank := view != nil && ix.config.Rerank > 0
+	want := int(k)
+	if rerank {
+		want = max(want, ix.config.Rerank)
+	}
+	want += len(exclude)
+	results := candidateHeap{farthest: true}
+	residual := make([]float32, ix.dim)
+	table := make([]float32, ix.config.M*ivfpqKsub)
+	for _, probe := range probes {
+		c := int(probe.id)
+		list := &ix.lists[c]
+		if len(list.ids) == 0 {
+			continue
+		}
+		// Asymmetric distance computation, the distance from the residual of
+		// the query to each code of each sub-quantizer is tabulated once per
+		// list
+		for j := range q {
+			residual[j] = q[j] - ix.coarse[c*ix.dim+j]
+		}
+		for sub := range ix.config.M {
+			r := residual[sub*ix.dsub : (sub+1)*ix.dsub]
+			for code := range ivfpqKsub {
+				off := (sub*ivfpqKsub + code) * ix.dsub
+				table[sub*ivfpqKsub+code] = squaredDistance(r,
+					ix.codebooks[off:off+ix.dsub])
+			}
+		}
+		for i, id := range list.ids {
+			codes := list.codes[i*ix.config.M : (i+1)*ix.config.M]
+			d := float32(0)
+			for sub, code := range codes {
+				d += table[sub*ivfpqKsub+int(code)]
+			}
+			if results.len() < want || float64(d) < results.top().dist {
+				results.push(hnswCandidate{id, float64(d)})
+				if results.len() > want {
+					results.pop()
+				}
+			}
+		}
+	}
+
+	top := newTopNeighbors(k)
+	for _, c := range results.items {
+		word := ix.words[c.id]
+		if slices.Contains(exclude, word) {
+			continue
+		}
+		// Unit vectors at squared distance d have a cosine similarity of
+		// 1 - d/2
+		similarity := 1 - c.dist/2
+		if rerank {
+			id, ok := view.ID(word)
+			if !ok {
+				continue
+			}
+			similarity = cosineSimilarity(v, view.VectorByID(id))
+		}
+		top.offer(Neighbor{Word: word, Similarity: similarity})
+	}
+	return top.sorted(), nil
+}
+
+/** IVF-PQ Serialization **/
+
+const (
+	ivfpqMagic   = "GWIV"
+	ivfpqVersion = 1
+)
+
+type ivfpqHeader struct {
+	Magic          [4]byte
+	Version        uint32
+	Dim, NList, M  uint32
+	NProbe, Rerank uint32
+	Size           uint64
+}
+
+// Save writes a trained index including its words, so that it can be loaded
+// and searched without the model
+func (ix *IVFPQ[T]) Save(w io.Writer) error {
+	if !ix.trained {
+		return errors.New("IVFPQ must be trained before saving")
+	}
+	bw := bufio.NewWriter(w)
+	hdr := ivfpqHeader{
+		Version: ivfpqVersion,
+		Dim:     uint32(ix.dim),
+		NList:   uint32(ix.config.NList),
+		M:       uint32(ix.config.M),
+		NProbe:  uint32(ix.config.NProbe),
+		Rerank:  uint32(ix.config.Rerank),
+		Size:    uint64(len(ix.words)),
+	}
+	copy(hdr.Magic[:], ivfpqMagic)
+	binary.Write(bw, binary.LittleEndian, &hdr)
+	writeScalars(bw, ix.coarse)
+	writeScalars(bw, ix.codebooks)
+	for _, list := range ix.lists {
+		binary.Write(bw, binary.LittleEndian, uint32(len(list.ids)))
+		writeScalars(bw, list.ids)
+		bw.Write(list.codes)
+	}
+	for _, word := range ix.words {
+		binary.Write(bw, binary.LittleEndian, uint32(len(word)))
+		bw.WriteString(word)
+	}
+	return bw.Flush()
+}
+
+// SaveFile writes a trained index to a file
+func (ix *IVFPQ[T]) SaveFile(p string) error {
+	return createModelFile(p, ix.Save)
+}
+
+// LoadIVFPQ loads an index saved by Save, m is the model used for re-ranking
+// and SearchWord and may be nil
+func LoadIVFPQ[T VectorScalar](r io.Reader, m Embedding[T]) (*IVFPQ[T],
+	error) {
+
+	br := bufio.NewReader(r)
+	var hdr ivfpqHeader
+	if err := binary.Read(br, binary.LittleEndian, &hdr); err != nil {
+		return nil, err
+	}
+	if string(hdr.Magic[:]) != ivfpqMagic {
+		return nil, errors.New("Not an IVFPQ index, magic bytes don't match")
+	}
+	if hdr.Version != ivfpqVersion {
+		return nil, fmt.Errorf("Unsupported IVFPQ index version %d",
+			hdr.Version)
+	}
+	if hdr.NList == 0 || hdr.M == 0 || hdr.M > hdr.Dim ||
+		hdr.NList > 1<<24 || hdr.Dim > maxDimensions {
+		return nil, errors.New("Invalid IVFPQ index header")
+	}
+	// Training needs at least NList vectors and every word of the index must
+	// be in the model
+	if m != nil {
+		if uint32(m.Dimensions()) != hdr.Dim {
+			return nil, fmt.Errorf("Model has %d dimensions, index has %d",
+				m.Dimensions(), hdr.Dim)
+		}
+		size := uint64(m.VocabularySize())
+		if uint64(hdr.NList) > size || hdr.Size > size {
+			return nil, fmt.Errorf("IVFPQ index of %d lists and %d words "+
+				"doesn't match a model of %d words", hdr.NList, hdr.Size,
+				size)
+		}
+	}
+	if hdr.Dim%hdr.M != 0 {
+		return nil, fmt.Errorf("IVFPQ M = %d must divide the dimensions %d",
+			hdr.M, hdr.Dim)
+	}
+	// The header is untrusted, so everything sized by it grows as it is read
+	// rather than being allocated by NewIVFPQ
+	config := IVFPQConfig{
+		NList:  int(hdr.NList),
+		M:      int(hdr.M),
+		NProbe: int(hdr.NProbe),
+		Rerank: int(hdr.Rerank),
+	}
+	config.setDefaults(int(hdr.Dim))
+	ix := &IVFPQ[T]{
+		config: config,
+		dim:    int(hdr.Dim),
+		dsub:   int(hdr.Dim / hdr.M),
+	}
+	var err error
+	readFloats := func(s []float32) error {
+		return readScalars(br, s, binary.LittleEndian)
+	}
+	ix.coarse, err = readNativeChunks(uint64(ix.config.NList*ix.dim),
+		readFloats)
+	if err != nil {
+		return nil, err
+	}
+	ix.codebooks, err = readNativeChunks(uint64(ix.config.M*ivfpqKsub*
+		ix.dsub), readFloats)
+	if err != nil {
+		return nil, err
+	}
+	ix.lists = make([]ivfList, 0, min(ix.config.NList, maxReserve))
+	total := uint64(0)
+	for range ix.config.NList {
+		var n uint32
+		if err := binary.Read(br, binary.LittleEndian, &n); err != nil {
+			return nil, err
+		}
+		total += uint64(n)
+		if total > hdr.Size {
+			return nil, errors.New("IVFPQ lists don't match the words")
+		}
+		var list ivfList
+		list.ids, err = readNativeChunks(uint64(n), func(s []int32) error {
+			return readScalars(br, s, binary.LittleEndian)
+		})
+		if err != nil {
+			return nil, err
+		}
+		list.codes, err = readNativeChunks(uint64(n)*uint64(ix.config.M),
+			func(s []uint8) error {
+				_, err := io.ReadFull(br, s)
+				return err
+			})
+		if err != nil {
+			return nil, err
+		}
+		for _, id := range list.ids {
+			if id < 0 || uint64(id) >= hdr.Size {
+				return nil, errors.New("Invalid IVFPQ word id")
+			}
+		}
+		ix.lists = append(ix.lists, list)
+	}
+	if total != hdr.Size {
+		return nil, errors.New("IVFPQ lists don't match the words")
+	}
+	ix.words = make([]string, 0, min(hdr.Size, maxReserve))
+	for range hdr.Size {
+		var n uint32
+		if err := binary.Read(br, binary.LittleEndian, &n); err != nil {
+			return nil, err
+		}
+		word := make([]byte, min(n, 1<<20))
+		if uint32(len(word)) != n {
+			return nil, errors.New("Invalid IVFPQ word length")
+		}
+		if _, err := io.ReadFull(br, word); err != nil {
+			return nil, err
+		}
+		ix.words = append(ix.words, string(word))
+	}
+	ix.trained = true
+	ix.m = m
+	return ix, nil
+}
+
+// LoadIVFPQFile loads an index saved by SaveFile, m is the model used for
+// re-ranking and SearchWord and may be nil
+func LoadIVFPQFile[T VectorScalar](p string, m Embedding[T]) (*IVFPQ[T],
+	error) {
+
+	file, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return LoadIVFPQ(file, m)
+}
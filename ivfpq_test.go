@@ -0,0 +1,192 @@
+/*
+
+Copyright (C) 2024 Jackie Deng
+
+Permission to use, copy, modify, and/or distribute this software for any
+purpose with or without fee is hereby granted.
+
+THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES WITH
+REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF MERCHANTABILITY AND
+FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY SPECIAL, DIRECT,
+INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES WHATSOEVER RESULTING FROM
+LOSS OF USE, DATA OR PROFITS, WHETHER IN AN ACTION OF CONTRACT, NEGLIGENCE OR
+OTHER TORTIOUS ACTION, ARISING OUT OF OR IN CONNECTION WITH THE USE OR
+PERFORMANCE OF THIS SOFTWARE.
+
+*/
+
+package gowe
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestIVFPQRecall(t *testing.T) {
+	plain := testRandomPlain(4000, 32, 4)
+	fm := NewFloatModel[float32]()
+	if err := fm.LoadPlain(strings.NewReader(plain)); err != nil {
+		t.Fatal(err)
+	}
+	im := NewIntModel[int16]()
+	err := im.LoadPlain(strings.NewReader(plain), WithMaxMagnitude(4))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := IVFPQConfig{NList: 16, M: 8, NProbe: 4, Rerank: 100,
+		Iterations: 10, Seed: 1}
+	fix, err := BuildIVFPQ(fm, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fix.Len() != 4000 {
+		t.Errorf("Index should have 4000 words, got %d", fix.Len())
+	}
+	search := func(word string) ([]Neighbor, error) {
+		return fix.SearchWord(word, 10)
+	}
+	if r := recall(t, fm, 10, search); r < 0.9 {
+		t.Errorf("Re-ranked recall@10 should be at least 0.9, got %f", r)
+	}
+	fix.SetRerank(0)
+	if r := recall(t, fm, 10, search); r < 0.5 {
+		t.Errorf("Recall@10 should be at least 0.5, got %f", r)
+	}
+
+	iix, err := BuildIVFPQ(im, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := recall(t, im, 10, func(word string) ([]Neighbor, error) {
+		return iix.SearchWord(word, 10)
+	}); r < 0.9 {
+		t.Errorf("IntModel re-ranked recall@10 should be at least 0.9, "+
+			"got %f", r)
+	}
+
+	nearest, err := iix.SearchWord("w3", 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, nb := range nearest {
+		if nb.Word == "w3" {
+			t.Error("SearchWord should exclude the word itself")
+		}
+	}
+	if _, err := iix.Search([]int16{1, 2}, 5); err == nil {
+		t.Error("Vectors of the wrong dimensions should fail")
+	}
+}
+
+func TestIVFPQTrainAdd(t *testing.T) {
+	if _, err := NewIVFPQ[float32](10, IVFPQConfig{M: 3}); err == nil {
+		t.Error("M should have to divide the dimensions")
+	}
+	ix, err := NewIVFPQ[float32](4, IVFPQConfig{NList: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ix.Add("cat", []float32{1, 2, 3, 4}); err == nil {
+		t.Error("Adding before training should fail")
+	}
+	if err := ix.Train([][]float32{{1, 2, 3, 4}}); err == nil {
+		t.Error("Training on fewer than 256 vectors should fail")
+	}
+}
+
+func TestIVFPQSaveLoad(t *testing.T) {
+	m := NewFloatModel[float32]()
+	err := m.LoadPlain(strings.NewReader(testRandomPlain(1000, 16, 5)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ix, err := BuildIVFPQ(m, IVFPQConfig{NList: 8, Iterations: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ix.SetRerank(0)
+
+	var buf bytes.Buffer
+	if err := ix.Save(&buf); err != nil {
+		t.Fatal(err)
+	}
+	// Without the model the loaded index can only search vectors
+	loaded, err := LoadIVFPQ[float32](bytes.NewReader(buf.Bytes()), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c := loaded.Config(); c.NList != 8 || c.M != 4 || c.NProbe != 8 {
+		t.Errorf("Loaded config should have NList 8, M 4 and NProbe 8, "+
+			"got %v", c)
+	}
+	for _, word := range []string{"w0", "w500", "w999"} {
+		want, _ := ix.Search(m.Vector(word), 5)
+		got, err := loaded.Search(m.Vector(word), 5)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("Loaded index should find %v for %q, got %v", want,
+				word, got)
+		}
+	}
+	if _, err := loaded.SearchWord("w0", 5); err == nil {
+		t.Error("SearchWord without a model should fail")
+	}
+
+	data := buf.Bytes()
+	if _, err := LoadIVFPQ(bytes.NewReader(data[:len(data)-3]),
+		m); err == nil {
+		t.Error("Truncated index should fail to load")
+	}
+}
+
+func TestIVFPQCorrupt(t *testing.T) {
+	m := NewFloatModel[float32]()
+	err := m.LoadPlain(strings.NewReader(testRandomPlain(300, 16, 5)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ix, err := BuildIVFPQ(m, IVFPQConfig{NList: 8, Iterations: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := ix.Save(&buf); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+	// The header is followed by 8 coarse centroids and 4 codebooks of 256
+	// centroids, then the length of the first list
+	lists := 36 + (8*16+4*256*4)*4
+
+	small := NewFloatModel[float32]()
+	err = small.LoadPlain(strings.NewReader(testRandomPlain(4, 16, 5)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		name string
+		data []byte
+		m    Embedding[float32]
+	}{
+		{"zero dim", withUint32(data, 8, 0), nil},
+		{"huge dim", withUint32(data, 8, math.MaxUint32), nil},
+		{"huge lists", withUint32(data, 12, 1<<24), nil},
+		{"M past dim", withUint32(data, 16, 32), nil},
+		{"M not dividing dim", withUint32(data, 16, 3), nil},
+		{"huge size", withUint32(data, 28, math.MaxUint32), nil},
+		{"huge list", withUint32(data, lists, math.MaxUint32), nil},
+		{"bad word id", withUint32(data, lists+4, 1000), nil},
+		{"more words than the model", data, small},
+		{"more lists than the model", withUint32(data, 28, 4), small},
+	} {
+		if _, err := LoadIVFPQ(bytes.NewReader(c.data), c.m); err == nil {
+			t.Errorf("Loading IVFPQ index with %s should fail", c.name)
+		}
+	}
+}
@@ -0,0 +1,55 @@
+/*
+
+Copyright (C) 2024 Jackie Deng
+
+Permission to use, copy, modify, and/or distribute this software for any
+purpose with or without fee is hereby granted.
+
+THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES WITH
+REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF MERCHANTABILITY AND
+FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY SPECIAL, DIRECT,
+INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES WHATSOEVER RESULTING FROM
+LOSS OF USE, DATA OR PROFITS, WHETHER IN AN ACTION OF CONTRACT, NEGLIGENCE OR
+OTHER TORTIOUS ACTION, ARISING OUT OF OR IN CONNECTION WITH THE USE OR
+PERFORMANCE OF THIS SOFTWARE.
+
+*/
+
+package gowe
+
+/** Vector Kernels **/
+
+// The kernels below compute the dot products that similarities are built
+// from. On amd64 they are implemented in assembly with AVX2 or AVX-512 when
+// the CPU supports it, these pure Go versions are the fallback and handle
+// the elements left over by the assembly.
+
+// intKernelChunk bounds the elements of an int8 kernel call so that the
+// int32 lanes accumulating the products can't overflow
+const intKernelChunk = 1 << 16
+
+func dotFloat32Go(a, b []float32) float64 {
+	d := float64(0)
+	for i := range a {
+		d += float64(a[i]) * float64(b[i])
+	}
+	return d
+}
+
+func cosineFloat32Go(a, b []float32) (dot, aa, bb float64) {
+	for i := range a {
+		x, y := float64(a[i]), float64(b[i])
+		dot += x * y
+		aa += x * x
+		bb += y * y
+	}
+	return dot, aa, bb
+}
+
+func dotIntGo[I IntScalar](a, b []I) int64 {
+	d := int64(0)
+	for i := range a {
+		d += int64(a[i]) * int64(b[i])
+	}
+	return d
+}
@@ -0,0 +1,159 @@
+//go:build amd64 && !purego
+
+/*
+
+Copyright (C) 2024 Jackie Deng
+
+Permission to use, copy, modify, and/or distribute this software for any
+purpose with or without fee is hereby granted.
+
+THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES WITH
+REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF MERCHANTABILITY AND
+FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY SPECIAL, DIRECT,
+INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES WHATSOEVER RESULTING FROM
+LOSS OF USE, DATA OR PROFITS, WHETHER IN AN ACTION OF CONTRACT, NEGLIGENCE OR
+OTHER TORTIOUS ACTION, ARISING OUT OF OR IN CONNECTION WITH THE USE OR
+PERFORMANCE OF THIS SOFTWARE.
+
+*/
+
+package gowe
+
+// The CPU features used by the kernels, they are variables so that tests can
+// exercise every implementation
+var useAVX2, useAVX512F, useAVX512BW = detectCPU()
+
+func cpuid(eaxArg, ecxArg uint32) (eax, ebx, ecx, edx uint32)
+
+func xgetbv() (eax, edx uint32)
+
+// detectCPU checks that the CPU supports the instructions of the kernels and
+// that the OS saves the registers they use
+func detectCPU() (avx2, avx512f, avx512bw bool) {
+	maxLeaf, _, _, _ := cpuid(0, 0)
+	if maxLeaf < 7 {
+		return false, false, false
+	}
+	const (
+		fma     = 1 << 12
+		osxsave = 1 << 27
+		avx     = 1 << 28
+	)
+	_, _, ecx1, _ := cpuid(1, 0)
+	if ecx1&(fma|osxsave|avx) != fma|osxsave|avx {
+		return false, false, false
+	}
+	// XCR0 has the SSE and AVX states in bits 1 and 2, and the AVX-512
+	// opmask and upper ZMM states in bits 5 to 7
+	xcr0, _ := xgetbv()
+	if xcr0&0x6 != 0x6 {
+		return false, false, false
+	}
+	_, ebx7, _, _ := cpuid(7, 0)
+	avx2 = ebx7&(1<<5) != 0
+	if xcr0&0xe0 == 0xe0 {
+		avx512f = avx2 && ebx7&(1<<16) != 0
+		avx512bw = avx512f && ebx7&(1<<30) != 0
+	}
+	return avx2, avx512f, avx512bw
+}
+
+// The assembly kernels process the elements of a up to a multiple of 8 (AVX2
+// floats), 16 (AVX-512 floats and AVX2 ints) or 32 (AVX-512 ints), b must be
+// at least as long as a
+
+//go:noescape
+func dotFloat32AVX2(a, b []float32) float64
+
+//go:noescape
+func dotFloat32AVX512(a, b []float32) float64
+
+//go:noescape
+func cosineFloat32AVX2(a, b []float32) (dot, aa, bb float64)
+
+//go:noescape
+func cosineFloat32AVX512(a, b []float32) (dot, aa, bb float64)
+
+//go:noescape
+func dotInt8AVX2(a, b []int8) int64
+
+//go:noescape
+func dotInt8AVX512(a, b []int8) int64
+
+// dotInt16AVX2 and dotInt16AVX512 return the dot product minus 65536 for
+// each pair of elements, see dotInt16
+
+//go:noescape
+func dotInt16AVX2(a, b []int16) int64
+
+//go:noescape
+func dotInt16AVX512(a, b []int16) int64
+
+func dotFloat32(a, b []float32) float64 {
+	b = b[:len(a)]
+	n, d := 0, float64(0)
+	switch {
+	case useAVX512F && len(a) >= 16:
+		n = len(a) &^ 15
+		d = dotFloat32AVX512(a[:n], b[:n])
+	case useAVX2 && len(a) >= 8:
+		n = len(a) &^ 7
+		d = dotFloat32AVX2(a[:n], b[:n])
+	}
+	return d + dotFloat32Go(a[n:], b[n:])
+}
+
+func cosineFloat32(a, b []float32) (dot, aa, bb float64) {
+	b = b[:len(a)]
+	n := 0
+	var d, x, y float64
+	switch {
+	case useAVX512F && len(a) >= 16:
+		n = len(a) &^ 15
+		d, x, y = cosineFloat32AVX512(a[:n], b[:n])
+	case useAVX2 && len(a) >= 8:
+		n = len(a) &^ 7
+		d, x, y = cosineFloat32AVX2(a[:n], b[:n])
+	}
+	dot, aa, bb = cosineFloat32Go(a[n:], b[n:])
+	return dot + d, aa + x, bb + y
+}
+
+func dotInt8(a, b []int8) int64 {
+	b = b[:len(a)]
+	d := int64(0)
+	for len(a) > 0 {
+		chunk := min(len(a), intKernelChunk)
+		n := 0
+		switch {
+		case useAVX512BW && chunk >= 32:
+			n = chunk &^ 31
+			d += dotInt8AVX512(a[:n], b[:n])
+		case useAVX2 && chunk >= 16:
+			n = chunk &^ 15
+			d += dotInt8AVX2(a[:n], b[:n])
+		}
+		d += dotIntGo(a[n:chunk], b[n:chunk])
+		a, b = a[chunk:], b[chunk:]
+	}
+	return d
+}
+
+// dotInt16 multiplies and adds pairs of elements with VPMADDWD, whose int32
+// result only overflows for two products of -32768 * -32768. As every other
+// pair sum is greater than -2^31 + 65536, the kernels subtract 65536 from
+// each pair sum, which wraps the overflow back to 2^31 - 65536, before
+// widening to int64. The bias is added back here.
+func dotInt16(a, b []int16) int64 {
+	b = b[:len(a)]
+	n, d := 0, int64(0)
+	switch {
+	case useAVX512BW && len(a) >= 32:
+		n = len(a) &^ 31
+		d = dotInt16AVX512(a[:n], b[:n])
+	case useAVX2 && len(a) >= 16:
+		n = len(a) &^ 15
+		d = dotInt16AVX2(a[:n], b[:n])
+	}
+	return d + int64(n/2)*65536 + dotIntGo(a[n:], b[n:])
+}
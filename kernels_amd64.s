@@ -0,0 +1,339 @@
+//go:build amd64 && !purego
+
+/*
+
+Copyright (C) 2024 Jackie Deng
+
+Permission to use, copy, modify, and/or distribute this software for any
+purpose with or without fee is hereby granted.
+
+THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES WITH
+REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF MERCHANTABILITY AND
+FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY SPECIAL, DIRECT,
+INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES WHATSOEVER RESULTING FROM
+LOSS OF USE, DATA OR PROFITS, WHETHER IN AN ACTION OF CONTRACT, NEGLIGENCE OR
+OTHER TORTIOUS ACTION, ARISING OUT OF OR IN CONNECTION WITH THE USE OR
+PERFORMANCE OF THIS SOFTWARE.
+
+*/
+
+#include "textflag.h"
+
+// func cpuid(eaxArg, ecxArg uint32) (eax, ebx, ecx, edx uint32)
+TEXT ·cpuid(SB), NOSPLIT, $0-24
+	MOVL eaxArg+0(FP), AX
+	MOVL ecxArg+4(FP), CX
+	CPUID
+	MOVL AX, eax+8(FP)
+	MOVL BX, ebx+12(FP)
+	MOVL CX, ecx+16(FP)
+	MOVL DX, edx+20(FP)
+	RET
+
+// func xgetbv() (eax, edx uint32)
+TEXT ·xgetbv(SB), NOSPLIT, $0-8
+	MOVL $0, CX
+	XGETBV
+	MOVL AX, eax+0(FP)
+	MOVL DX, edx+4(FP)
+	RET
+
+// REDUCE_PD sums the 4 float64 lanes of Y into the low lane of X, which is
+// the low half of Y
+#define REDUCE_PD(Y, X, T) \
+	VEXTRACTF128 $1, Y, T \
+	VADDPD       T, X, X  \
+	VHADDPD      X, X, X
+
+// REDUCE_Q sums the 4 int64 lanes of Y into the low lane of X, which is the
+// low half of Y
+#define REDUCE_Q(Y, X, T) \
+	VEXTRACTI128 $1, Y, T \
+	VPADDQ       T, X, X  \
+	VPSHUFD      $0x4e, X, T \
+	VPADDQ       T, X, X
+
+// The float32 kernels widen each half of the elements to float64 and
+// accumulate in float64 lanes, like the pure Go kernels, so that only the
+// order of the additions differs
+
+// func dotFloat32AVX2(a, b []float32) float64
+TEXT ·dotFloat32AVX2(SB), NOSPLIT, $0-56
+	MOVQ   a_base+0(FP), SI
+	MOVQ   b_base+24(FP), DI
+	MOVQ   a_len+8(FP), CX
+	VXORPD Y0, Y0, Y0
+	VXORPD Y1, Y1, Y1
+
+loop8:
+	CMPQ        CX, $8
+	JL          done
+	VCVTPS2PD   (SI), Y2
+	VCVTPS2PD   16(SI), Y3
+	VCVTPS2PD   (DI), Y4
+	VCVTPS2PD   16(DI), Y5
+	VFMADD231PD Y4, Y2, Y0
+	VFMADD231PD Y5, Y3, Y1
+	ADDQ        $32, SI
+	ADDQ        $32, DI
+	SUBQ        $8, CX
+	JMP         loop8
+
+done:
+	VADDPD Y1, Y0, Y0
+	REDUCE_PD(Y0, X0, X1)
+	VZEROUPPER
+	MOVSD  X0, ret+48(FP)
+	RET
+
+// func dotFloat32AVX512(a, b []float32) float64
+TEXT ·dotFloat32AVX512(SB), NOSPLIT, $0-56
+	MOVQ   a_base+0(FP), SI
+	MOVQ   b_base+24(FP), DI
+	MOVQ   a_len+8(FP), CX
+	VPXORQ Z0, Z0, Z0
+	VPXORQ Z1, Z1, Z1
+
+loop16:
+	CMPQ        CX, $16
+	JL          done
+	VCVTPS2PD   (SI), Z2
+	VCVTPS2PD   32(SI), Z3
+	VCVTPS2PD   (DI), Z4
+	VCVTPS2PD   32(DI), Z5
+	VFMADD231PD Z4, Z2, Z0
+	VFMADD231PD Z5, Z3, Z1
+	ADDQ        $64, SI
+	ADDQ        $64, DI
+	SUBQ        $16, CX
+	JMP         loop16
+
+done:
+	VADDPD        Z1, Z0, Z0
+	VEXTRACTF64X4 $1, Z0, Y1
+	VADDPD        Y1, Y0, Y0
+	REDUCE_PD(Y0, X0, X1)
+	VZEROUPPER
+	MOVSD         X0, ret+48(FP)
+	RET
+
+// func cosineFloat32AVX2(a, b []float32) (dot, aa, bb float64)
+TEXT ·cosineFloat32AVX2(SB), NOSPLIT, $0-72
+	MOVQ   a_base+0(FP), SI
+	MOVQ   b_base+24(FP), DI
+	MOVQ   a_len+8(FP), CX
+	VXORPD Y0, Y0, Y0
+	VXORPD Y1, Y1, Y1
+	VXORPD Y2, Y2, Y2
+
+loop8:
+	CMPQ        CX, $8
+	JL          done
+	VCVTPS2PD   (SI), Y3
+	VCVTPS2PD   16(SI), Y4
+	VCVTPS2PD   (DI), Y5
+	VCVTPS2PD   16(DI), Y6
+	VFMADD231PD Y5, Y3, Y0
+	VFMADD231PD Y6, Y4, Y0
+	VFMADD231PD Y3, Y3, Y1
+	VFMADD231PD Y4, Y4, Y1
+	VFMADD231PD Y5, Y5, Y2
+	VFMADD231PD Y6, Y6, Y2
+	ADDQ        $32, SI
+	ADDQ        $32, DI
+	SUBQ        $8, CX
+	JMP         loop8
+
+done:
+	REDUCE_PD(Y0, X0, X3)
+	REDUCE_PD(Y1, X1, X3)
+	REDUCE_PD(Y2, X2, X3)
+	VZEROUPPER
+	MOVSD X0, dot+48(FP)
+	MOVSD X1, aa+56(FP)
+	MOVSD X2, bb+64(FP)
+	RET
+
+// func cosineFloat32AVX512(a, b []float32) (dot, aa, bb float64)
+TEXT ·cosineFloat32AVX512(SB), NOSPLIT, $0-72
+	MOVQ   a_base+0(FP), SI
+	MOVQ   b_base+24(FP), DI
+	MOVQ   a_len+8(FP), CX
+	VPXORQ Z0, Z0, Z0
+	VPXORQ Z1, Z1, Z1
+	VPXORQ Z2, Z2, Z2
+
+loop16:
+	CMPQ        CX, $16
+	JL          done
+	VCVTPS2PD   (SI), Z3
+	VCVTPS2PD   32(SI), Z4
+	VCVTPS2PD   (DI), Z5
+	VCVTPS2PD   32(DI), Z6
+	VFMADD231PD Z5, Z3, Z0
+	VFMADD231PD Z6, Z4, Z0
+	VFMADD231PD Z3, Z3, Z1
+	VFMADD231PD Z4, Z4, Z1
+	VFMADD231PD Z5, Z5, Z2
+	VFMADD231PD Z6, Z6, Z2
+	ADDQ        $64, SI
+	ADDQ        $64, DI
+	SUBQ        $16, CX
+	JMP         loop16
+
+done:
+	VEXTRACTF64X4 $1, Z0, Y3
+	VADDPD        Y3, Y0, Y0
+	VEXTRACTF64X4 $1, Z1, Y3
+	VADDPD        Y3, Y1, Y1
+	VEXTRACTF64X4 $1, Z2, Y3
+	VADDPD        Y3, Y2, Y2
+	REDUCE_PD(Y0, X0, X3)
+	REDUCE_PD(Y1, X1, X3)
+	REDUCE_PD(Y2, X2, X3)
+	VZEROUPPER
+	MOVSD         X0, dot+48(FP)
+	MOVSD         X1, aa+56(FP)
+	MOVSD         X2, bb+64(FP)
+	RET
+
+// The int8 kernels sign extend 16 or 32 bytes to int16 and multiply and add
+// pairs of them into int32 lanes, which hold at most 32768 per iteration
+
+// func dotInt8AVX2(a, b []int8) int64
+TEXT ·dotInt8AVX2(SB), NOSPLIT, $0-56
+	MOVQ  a_base+0(FP), SI
+	MOVQ  b_base+24(FP), DI
+	MOVQ  a_len+8(FP), CX
+	VPXOR Y0, Y0, Y0
+
+loop16:
+	CMPQ      CX, $16
+	JL        done
+	VPMOVSXBW (SI), Y1
+	VPMOVSXBW (DI), Y2
+	VPMADDWD  Y2, Y1, Y1
+	VPADDD    Y1, Y0, Y0
+	ADDQ      $16, SI
+	ADDQ      $16, DI
+	SUBQ      $16, CX
+	JMP       loop16
+
+done:
+	VEXTRACTI128 $1, Y0, X1
+	VPMOVSXDQ    X0, Y2
+	VPMOVSXDQ    X1, Y3
+	VPADDQ       Y3, Y2, Y2
+	REDUCE_Q(Y2, X2, X3)
+	VMOVQ        X2, AX
+	VZEROUPPER
+	MOVQ         AX, ret+48(FP)
+	RET
+
+// func dotInt8AVX512(a, b []int8) int64
+TEXT ·dotInt8AVX512(SB), NOSPLIT, $0-56
+	MOVQ   a_base+0(FP), SI
+	MOVQ   b_base+24(FP), DI
+	MOVQ   a_len+8(FP), CX
+	VPXORD Z0, Z0, Z0
+
+loop32:
+	CMPQ      CX, $32
+	JL        done
+	VPMOVSXBW (SI), Z1
+	VPMOVSXBW (DI), Z2
+	VPMADDWD  Z2, Z1, Z1
+	VPADDD    Z1, Z0, Z0
+	ADDQ      $32, SI
+	ADDQ      $32, DI
+	SUBQ      $32, CX
+	JMP       loop32
+
+done:
+	VEXTRACTI64X4 $1, Z0, Y1
+	VPMOVSXDQ     Y0, Z2
+	VPMOVSXDQ     Y1, Z3
+	VPADDQ        Z3, Z2, Z2
+	VEXTRACTI64X4 $1, Z2, Y3
+	VPADDQ        Y3, Y2, Y2
+	REDUCE_Q(Y2, X2, X3)
+	VMOVQ         X2, AX
+	VZEROUPPER
+	MOVQ          AX, ret+48(FP)
+	RET
+
+// The int16 kernels multiply and add pairs into int32 lanes, subtract the
+// 65536 bias described in dotInt16 and widen the lanes to int64 on every
+// iteration
+
+// func dotInt16AVX2(a, b []int16) int64
+TEXT ·dotInt16AVX2(SB), NOSPLIT, $0-56
+	MOVQ         a_base+0(FP), SI
+	MOVQ         b_base+24(FP), DI
+	MOVQ         a_len+8(FP), CX
+	VPXOR        Y0, Y0, Y0
+	VPXOR        Y1, Y1, Y1
+	MOVL         $65536, AX
+	VMOVD        AX, X7
+	VPBROADCASTD X7, Y7
+
+loop16:
+	CMPQ         CX, $16
+	JL           done
+	VMOVDQU      (SI), Y2
+	VPMADDWD     (DI), Y2, Y2
+	VPSUBD       Y7, Y2, Y2
+	VEXTRACTI128 $1, Y2, X3
+	VPMOVSXDQ    X2, Y4
+	VPMOVSXDQ    X3, Y5
+	VPADDQ       Y4, Y0, Y0
+	VPADDQ       Y5, Y1, Y1
+	ADDQ         $32, SI
+	ADDQ         $32, DI
+	SUBQ         $16, CX
+	JMP          loop16
+
+done:
+	VPADDQ Y1, Y0, Y0
+	REDUCE_Q(Y0, X0, X1)
+	VMOVQ  X0, AX
+	VZEROUPPER
+	MOVQ   AX, ret+48(FP)
+	RET
+
+// func dotInt16AVX512(a, b []int16) int64
+TEXT ·dotInt16AVX512(SB), NOSPLIT, $0-56
+	MOVQ         a_base+0(FP), SI
+	MOVQ         b_base+24(FP), DI
+	MOVQ         a_len+8(FP), CX
+	VPXORD       Z0, Z0, Z0
+	VPXORD       Z1, Z1, Z1
+	MOVL         $65536, AX
+	VMOVD        AX, X7
+	VPBROADCASTD X7, Z7
+
+loop32:
+	CMPQ          CX, $32
+	JL            done
+	VMOVDQU64     (SI), Z2
+	VPMADDWD      (DI), Z2, Z2
+	VPSUBD        Z7, Z2, Z2
+	VEXTRACTI64X4 $1, Z2, Y3
+	VPMOVSXDQ     Y2, Z4
+	VPMOVSXDQ     Y3, Z5
+	VPADDQ        Z4, Z0, Z0
+	VPADDQ        Z5, Z1, Z1
+	ADDQ          $64, SI
+	ADDQ          $64, DI
+	SUBQ          $32, CX
+	JMP           loop32
+
+done:
+	VPADDQ        Z1, Z0, Z0
+	VEXTRACTI64X4 $1, Z0, Y1
+	VPADDQ        Y1, Y0, Y0
+	REDUCE_Q(Y0, X0, X1)
+	VMOVQ         X0, AX
+	VZEROUPPER
+	MOVQ          AX, ret+48(FP)
+	RET
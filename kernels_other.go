@@ -0,0 +1,40 @@
+//go:build !amd64 || purego
+
+/*
+
+Copyright (C) 2024 Jackie Deng
+
+Permission to use, copy, modify, and/or distribute this software for any
+purpose with or without fee is hereby granted.
+
+THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES WITH
+REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF MERCHANTABILITY AND
+FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY SPECIAL, DIRECT,
+INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES WHATSOEVER RESULTING FROM
+LOSS OF USE, DATA OR PROFITS, WHETHER IN AN ACTION OF CONTRACT, NEGLIGENCE OR
+OTHER TORTIOUS ACTION, ARISING OUT OF OR IN CONNECTION WITH THE USE OR
+PERFORMANCE OF THIS SOFTWARE.
+
+*/
+
+package gowe
+
+func dotFloat32(a, b []float32) float64 {
+	return dotFloat32Go(a, b[:len(a)])
+}
+
+func cosineFloat32(a, b []float32) (dot, aa, bb float64) {
+	return cosineFloat32Go(a, b[:len(a)])
+}
+
+func dotInt8(a, b []int8) int64 {
+	return dotIntGo(a, b[:len(a)])
+}
+
+func dotInt16(a, b []int16) int64 {
+	return dotIntGo(a, b[:len(a)])
+}
+
+// There are no assembly kernels on this platform, these mirror the CPU
+// features of the amd64 kernels for tests
+var useAVX2, useAVX512F, useAVX512BW bool
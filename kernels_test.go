@@ -0,0 +1,127 @@
+/*
+
+Copyright (C) 2024 Jackie Deng
+
+Permission to use, copy, modify, and/or distribute this software for any
+purpose with or without fee is hereby granted.
+
+THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES WITH
+REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF MERCHANTABILITY AND
+FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY SPECIAL, DIRECT,
+INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES WHATSOEVER RESULTING FROM
+LOSS OF USE, DATA OR PROFITS, WHETHER IN AN ACTION OF CONTRACT, NEGLIGENCE OR
+OTHER TORTIOUS ACTION, ARISING OUT OF OR IN CONNECTION WITH THE USE OR
+PERFORMANCE OF THIS SOFTWARE.
+
+*/
+
+package gowe
+
+import (
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"testing"
+)
+
+// kernelImplementations runs f with each set of CPU features available to
+// the kernels, down to the pure Go fallback
+func kernelImplementations(t testing.TB, f func(name string)) {
+	avx2, avx512f, avx512bw := useAVX2, useAVX512F, useAVX512BW
+	defer func() {
+		useAVX2, useAVX512F, useAVX512BW = avx2, avx512f, avx512bw
+	}()
+	if avx512f {
+		f("AVX-512")
+	}
+	useAVX512F, useAVX512BW = false, false
+	if avx2 {
+		f("AVX2")
+	}
+	useAVX2 = false
+	f("Go")
+}
+
+func TestKernels(t *testing.T) {
+	rng := rand.New(rand.NewPCG(1, 2))
+	for _, n := range []int{0, 1, 7, 8, 15, 16, 31, 32, 33, 100, 300, 1000} {
+		a32, b32 := make([]float32, n), make([]float32, n)
+		a8, b8 := make([]int8, n), make([]int8, n)
+		a16, b16 := make([]int16, n), make([]int16, n)
+		for i := range n {
+			a32[i], b32[i] = float32(rng.NormFloat64()),
+				float32(rng.NormFloat64())
+			a8[i], b8[i] = int8(rng.IntN(256)-128), int8(rng.IntN(256)-128)
+			a16[i], b16[i] = int16(rng.IntN(65536)-32768),
+				int16(rng.IntN(65536)-32768)
+		}
+		// The extremes of int16 overflow the pair sums of VPMADDWD
+		if n >= 2 {
+			a16[0], a16[1], b16[0], b16[1] = -32768, -32768, -32768, -32768
+		}
+		wantDot, wantAA, wantBB := cosineFloat32Go(a32, b32)
+		want8, want16 := dotIntGo(a8, b8), dotIntGo(a16, b16)
+
+		kernelImplementations(t, func(name string) {
+			// Every implementation accumulates in float64, so they only differ
+			// by the order of the additions
+			tolerance := 1e-12 * (1 + math.Abs(wantAA) + math.Abs(wantBB))
+			if d := dotFloat32(a32, b32); math.Abs(d-wantDot) > tolerance {
+				t.Errorf("%s float32 dot of %d should be %f, got %f", name,
+					n, wantDot, d)
+			}
+			dot, aa, bb := cosineFloat32(a32, b32)
+			if math.Abs(dot-wantDot) > tolerance ||
+				math.Abs(aa-wantAA) > tolerance ||
+				math.Abs(bb-wantBB) > tolerance {
+				t.Errorf("%s float32 cosine of %d should be %f %f %f, got "+
+					"%f %f %f", name, n, wantDot, wantAA, wantBB, dot, aa, bb)
+			}
+			if d := dotInt8(a8, b8); d != want8 {
+				t.Errorf("%s int8 dot of %d should be %d, got %d", name, n,
+					want8, d)
+			}
+			if d := dotInt16(a16, b16); d != want16 {
+				t.Errorf("%s int16 dot of %d should be %d, got %d", name, n,
+					want16, d)
+			}
+		})
+	}
+
+	// Long int8 vectors are split so that the int32 lanes can't overflow
+	long := make([]int8, 3*intKernelChunk+5)
+	for i := range long {
+		long[i] = -128
+	}
+	kernelImplementations(t, func(name string) {
+		if d := dotInt8(long, long); d != int64(len(long))*128*128 {
+			t.Errorf("%s int8 dot of -128s should be %d, got %d", name,
+				int64(len(long))*128*128, d)
+		}
+	})
+}
+
+func BenchmarkKernels(b *testing.B) {
+	const n = 300
+	a32, a8, a16 := make([]float32, n), make([]int8, n), make([]int16, n)
+	for i := range n {
+		a32[i], a8[i], a16[i] = float32(i), int8(i), int16(i)
+	}
+	kernelImplementations(b, func(name string) {
+		b.Run(fmt.Sprintf("CosineFloat32/%s", name), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				cosineFloat32(a32, a32)
+			}
+		})
+		b.Run(fmt.Sprintf("DotInt8/%s", name), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				dotInt8(a8, a8)
+			}
+		})
+		b.Run(fmt.Sprintf("DotInt16/%s", name), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				dotInt16(a16, a16)
+			}
+		})
+	})
+}
@@ -0,0 +1,709 @@
+/*
+
+Copyright (C) 2024 Jackie Deng
+
+Permission to use, copy, modify, and/or distribute this software for any
+purpose with or without fee is hereby granted.
+
+THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES WITH
+REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF MERCHANTABILITY AND
+FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY SPECIAL, DIRECT,
+INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES WHATSOEVER RESULTING FROM
+LOSS OF USE, DATA OR PROFITS, WHETHER IN AN ACTION OF CONTRACT, NEGLIGENCE OR
+OTHER TORTIOUS ACTION, ARISING OUT OF OR IN CONNECTION WITH THE USE OR
+PERFORMANCE OF THIS SOFTWARE.
+
+*/
+
+package gowe
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"unsafe"
+)
+
+/** Load Errors **/
+
+// Errors of malformed model files, the errors of the plaintext and binary
+// loaders wrap one of these in a LoadError so they can be checked with
+// errors.Is
+var (
+	// ErrTruncated is a model that ends before its description says it
+	// should or in the middle of a vector
+	ErrTruncated = errors.New("Model is truncated")
+	// ErrDimMismatch is a vector whose dimensions don't match the model
+	ErrDimMismatch = errors.New("Dimensions don't match")
+	// ErrBadHeader is a missing or invalid "<size> <dim>" description
+	ErrBadHeader = errors.New("Invalid description")
+)
+
+// LoadError is an error at a position in a model file, Line is the line of
+// a plaintext file or the description of a binary file and Record is the
+// number of a word in a binary file, both counting from 1
+type LoadError struct {
+	Line   int
+	Record int
+	Err    error
+}
+
+func (e *LoadError) Error() string {
+	if e.Record > 0 {
+		return fmt.Sprintf("Record %d: %v", e.Record, e.Err)
+	}
+	return fmt.Sprintf("Line %d: %v", e.Line, e.Err)
+}
+
+func (e *LoadError) Unwrap() error {
+	return e.Err
+}
+
+// maxDimensions bounds the dimensions of a description, so that a corrupt
+// description can't allocate an absurd buffer for each vector
+const maxDimensions = 1 << 20
+
+// readDescription reads the "<size> <dim>" line that starts binary files and
+// some plaintext files
+func readDescription(br *bufio.Reader) (size, dim uint, err error) {
+	line, err := br.ReadString('\n')
+	if err != nil && err != io.EOF {
+		return 0, 0, err
+	}
+	fields := strings.Fields(line)
+	if len(fields) < 2 {
+		return 0, 0, fmt.Errorf("%w, size and dim not found", ErrBadHeader)
+	}
+	s, err := strconv.ParseUint(fields[0], 10, 0)
+	if err != nil {
+		return 0, 0, fmt.Errorf("%w, size %q is not a number", ErrBadHeader,
+			fields[0])
+	}
+	d, err := strconv.ParseUint(fields[1], 10, 0)
+	if err != nil {
+		return 0, 0, fmt.Errorf("%w, dim %q is not a number", ErrBadHeader,
+			fields[1])
+	}
+	if d == 0 || d > maxDimensions {
+		return 0, 0, fmt.Errorf("%w, dim %d is out of range", ErrBadHeader, d)
+	}
+	return uint(s), uint(d), nil
+}
+
+/** Plaintext Records **/
+
+// plainReader reads the words and values of a plaintext model a line at a
+// time, checking them against the description or the first line
+type plainReader struct {
+	br *bufio.Reader
+	// dim is the number of values on every line, size the number of words
+	// declared by the description if header is set
+	dim    uint
+	size   uint
+	header bool
+	// line is the number of the line last read and records the number of
+	// words read
+	line    int
+	records uint
+	// first holds the first line when there is no description, as it had to
+	// be read to find dim
+	first []byte
+	// long holds lines longer than the buffer of br
+	long []byte
+}
+
+// newPlainReader reads the description of a plaintext model if header is
+// set, otherwise the first line to determine the dimensions
+func newPlainReader(br *bufio.Reader, header bool) (*plainReader, error) {
+	r := &plainReader{br: br, header: header, line: 1}
+	if header {
+		size, dim, err := readDescription(br)
+		if err != nil {
+			return nil, r.wrap(err)
+		}
+		r.size, r.dim = size, dim
+		return r, nil
+	}
+
+	line, err := r.readLine()
+	if err != nil && err != io.EOF {
+		return nil, r.wrap(err)
+	}
+	line = trimLine(line)
+	if len(line) == 0 {
+		return nil, r.wrap(fmt.Errorf("%w, no words in plaintext",
+			ErrTruncated))
+	}
+	i := bytes.IndexByte(line, ' ')
+	if i < 0 {
+		return nil, r.wrap(fmt.Errorf("%w, first line has no values",
+			ErrDimMismatch))
+	}
+	r.first = append([]byte(nil), line...)
+	r.dim = uint(bytes.Count(line[i+1:], []byte{' '}) + 1)
+	return r, nil
+}
+
+// wrap returns err as a LoadError at the current line
+func (r *plainReader) wrap(err error) error {
+	return &LoadError{Line: r.line, Err: err}
+}
+
+// readLine reads the next line including its newline, which is only valid
+// until the next read. err is io.EOF at the end of the stream, in which case
+// line is the unterminated last line if any.
+func (r *plainReader) readLine() ([]byte, error) {
+	line, err := r.br.ReadSlice('\n')
+	if err != bufio.ErrBufferFull {
+		return line, err
+	}
+	r.long = append(r.long[:0], line...)
+	for err == bufio.ErrBufferFull {
+		line, err = r.br.ReadSlice('\n')
+		r.long = append(r.long, line...)
+	}
+	return r.long, err
+}
+
+// trimLine trims the newline and any trailing spaces from a line
+func trimLine(line []byte) []byte {
+	return bytes.TrimRight(line, " \r\n")
+}
+
+// splitLine splits a trimmed line into its word and values, terminated is
+// whether the line ended with a newline rather than the end of the stream
+func splitLine(line []byte, terminated bool) ([]byte, []byte, error) {
+	i := bytes.IndexByte(line, ' ')
+	if i < 0 {
+		if !terminated {
+			return nil, nil, fmt.Errorf("%w, last line has no values",
+				ErrTruncated)
+		}
+		return nil, nil, fmt.Errorf("%w, line has no values",
+			ErrDimMismatch)
+	}
+	return line[:i], line[i+1:], nil
+}
+
+// count counts a record and checks it against the size of the description
+func (r *plainReader) count() error {
+	r.records++
+	if r.header && r.records > r.size {
+		return fmt.Errorf("%w, description declares %d words but there "+
+			"are more", ErrBadHeader, r.size)
+	}
+	return nil
+}
+
+// end checks the number of records against the description at the end of
+// the stream
+func (r *plainReader) end() error {
+	if r.header && r.records < r.size {
+		return r.wrap(fmt.Errorf("%w, description declares %d words but "+
+			"there are %d", ErrTruncated, r.size, r.records))
+	}
+	return io.EOF
+}
+
+// next returns the word of the next line and its values, values is nil if
+// the filter skips the word and is only valid until the next call. Blank
+// lines are skipped. It returns io.EOF at the end of the model.
+func (r *plainReader) next(filter *LoadFilter) (string, []byte, error) {
+	var line []byte
+	terminated := true
+	if r.first != nil {
+		line, r.first = r.first, nil
+	} else {
+		for len(line) == 0 {
+			l, err := r.readLine()
+			if len(l) == 0 && err == io.EOF {
+				return "", nil, r.end()
+			} else if err != nil && err != io.EOF {
+				return "", nil, r.wrap(err)
+			}
+			r.line++
+			terminated = err == nil
+			line = trimLine(l)
+			if len(line) == 0 && !terminated {
+				return "", nil, r.end()
+			}
+		}
+	}
+
+	word, values, err := splitLine(line, terminated)
+	if err != nil {
+		return "", nil, r.wrap(err)
+	}
+	if err := r.count(); err != nil {
+		return "", nil, r.wrap(err)
+	}
+	if !filter.accepts(string(word)) {
+		return string(word), nil, nil
+	}
+	return string(word), values, nil
+}
+
+// parsePlainValues parses the space separated values of a plaintext line
+// into v, there must be exactly len(v) of them
+func parsePlainValues[F FloatScalar](v []F, values []byte) error {
+	n := 0
+	for {
+		i := bytes.IndexByte(values, ' ')
+		field := values
+		if i >= 0 {
+			field = values[:i]
+		}
+		if n < len(v) {
+			f, err := parseFloat[F](field)
+			if err != nil {
+				return errors.Join(errors.New("Invalid plaintext float"), err)
+			}
+			v[n] = f
+		}
+		n++
+		if i < 0 {
+			break
+		}
+		values = values[i+1:]
+	}
+	if n != len(v) {
+		return fmt.Errorf("%w, line has %d values but the model has %d "+
+			"dimensions", ErrDimMismatch, n, len(v))
+	}
+	return nil
+}
+
+/** Float Parsing **/
+
+// Powers of 10 that are exact as floats
+var (
+	float32pow10 = [...]float32{1e0, 1e1, 1e2, 1e3, 1e4, 1e5, 1e6, 1e7, 1e8,
+		1e9, 1e10}
+	float64pow10 = [...]float64{1e0, 1e1, 1e2, 1e3, 1e4, 1e5, 1e6, 1e7, 1e8,
+		1e9, 1e10, 1e11, 1e12, 1e13, 1e14, 1e15, 1e16, 1e17, 1e18, 1e19,
+		1e20, 1e21, 1e22}
+)
+
+// parseFloat parses a float from b without allocating. Decimals with a
+// mantissa and exponent small enough to be exact as floats are converted
+// with a single multiplication or division, which is correctly rounded, and
+// anything else including errors falls back to strconv.
+func parseFloat[F FloatScalar](b []byte) (F, error) {
+	var zero F
+	mant, exp, neg, ok := parseDecimal(b)
+	if ok {
+		switch any(zero).(type) {
+		case float32:
+			if mant <= 1<<24 && exp >= -10 && exp <= 10 {
+				f := float32(mant)
+				if exp < 0 {
+					f /= float32pow10[-exp]
+				} else {
+					f *= float32pow10[exp]
+				}
+				if neg {
+					f = -f
+				}
+				return F(f), nil
+			}
+		case float64:
+			if mant <= 1<<53 && exp >= -22 && exp <= 22 {
+				f := float64(mant)
+				if exp < 0 {
+					f /= float64pow10[-exp]
+				} else {
+					f *= float64pow10[exp]
+				}
+				if neg {
+					f = -f
+				}
+				return F(f), nil
+			}
+		}
+	}
+	f, err := strconv.ParseFloat(unsafe.String(unsafe.SliceData(b), len(b)),
+		int(unsafe.Sizeof(zero)*8))
+	return F(f), err
+}
+
+// parseDecimal parses b as [+-]digits[.digits][(e|E)[+-]digits] into
+// mant * 10^exp, ok is false for anything else or if the mantissa has more
+// than 19 significant digits
+func parseDecimal(b []byte) (mant uint64, exp int, neg, ok bool) {
+	i := 0
+	if i < len(b) && (b[i] == '+' || b[i] == '-') {
+		neg = b[i] == '-'
+		i++
+	}
+	digits, seen, dot := 0, false, false
+	for ; i < len(b); i++ {
+		c := b[i]
+		if c == '.' && !dot {
+			dot = true
+			continue
+		} else if c < '0' || c > '9' {
+			break
+		}
+		seen = true
+		if dot {
+			exp--
+		}
+		if mant == 0 && c == '0' {
+			continue
+		}
+		if digits == 19 {
+			return 0, 0, false, false
+		}
+		mant = mant*10 + uint64(c-'0')
+		digits++
+	}
+	if !seen {
+		return 0, 0, false, false
+	}
+
+	if i < len(b) && (b[i] == 'e' || b[i] == 'E') {
+		i++
+		eneg := false
+		if i < len(b) && (b[i] == '+' || b[i] == '-') {
+			eneg = b[i] == '-'
+			i++
+		}
+		e, eseen := 0, false
+		for ; i < len(b) && b[i] >= '0' && b[i] <= '9'; i++ {
+			eseen = true
+			// Larger exponents are out of range of any float anyway
+			if e < 10000 {
+				e = e*10 + int(b[i]-'0')
+			}
+		}
+		if !eseen {
+			return 0, 0, false, false
+		}
+		if eneg {
+			e = -e
+		}
+		exp += e
+	}
+	return mant, exp, neg, i == len(b)
+}
+
+/** Parallel Plaintext **/
+
+// plainChunkSize is the size of the runs of whole lines that plaintext
+// models are split into for parsing
+var plainChunkSize = 1 << 20
+
+// plainRecord is a parsed line of a plaintext chunk, row is the index of its
+// vector in the scalars of the chunk or -1 if the filter skipped it
+type plainRecord struct {
+	word string
+	line int
+	row  int
+}
+
+// plainChunk is a run of whole lines of a plaintext model starting at line,
+// and the records parsed from them. Chunks are reused once their records are
+// added.
+type plainChunk[T VectorScalar] struct {
+	seq  int
+	line int
+	data []byte
+	// eof is whether the chunk ends the stream, so its last line may be
+	// unterminated
+	eof bool
+
+	records []plainRecord
+	scalars []T
+	// err is the first error of the chunk, which follows its records
+	err error
+}
+
+// plainParser parses the values of a plaintext line into a vector of the
+// model's scalar type
+type plainParser[T VectorScalar] func(vector []T, values []byte) error
+
+// readPlainChunk reads the lines of the next chunk from r into c, starting
+// with the unterminated end of the previous chunk
+func readPlainChunk[T VectorScalar](r *plainReader, c *plainChunk[T]) {
+	buf := append(c.data[:0], r.long...)
+	if cap(buf)-len(buf) < plainChunkSize/2 {
+		buf = slices.Grow(buf, plainChunkSize)
+	}
+	var err error
+	for {
+		var n int
+		n, err = io.ReadFull(r.br, buf[len(buf):cap(buf)])
+		buf = buf[:len(buf)+n]
+		if err != nil || bytes.IndexByte(buf[len(buf)-n:], '\n') >= 0 {
+			break
+		}
+		// A line longer than the chunk
+		buf = slices.Grow(buf, len(buf))
+	}
+
+	c.line, c.data, c.eof, c.err = r.line+1, buf, false, nil
+	c.records, c.scalars = c.records[:0], c.scalars[:0]
+	r.long = r.long[:0]
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		c.eof = true
+		// Count an unterminated last line
+		if len(buf) > 0 && buf[len(buf)-1] != '\n' {
+			r.line++
+		}
+	} else if err != nil {
+		c.err = r.wrap(err)
+		return
+	} else {
+		// The rest is copied out as the chunk is passed on
+		i := bytes.LastIndexByte(buf, '\n')
+		c.data, r.long = buf[:i+1], append(r.long, buf[i+1:]...)
+	}
+	r.line += bytes.Count(c.data, []byte{'\n'})
+}
+
+// parse parses the lines of the chunk, stopping at the first error
+func (c *plainChunk[T]) parse(dim uint, filter *LoadFilter,
+	parseValues plainParser[T]) {
+
+	data, line := c.data, c.line-1
+	for len(data) > 0 && c.err == nil {
+		i := bytes.IndexByte(data, '\n')
+		l := data
+		if i >= 0 {
+			l, data = data[:i], data[i+1:]
+		} else {
+			data = nil
+		}
+		line++
+		l = trimLine(l)
+		if len(l) == 0 {
+			continue
+		}
+
+		word, values, err := splitLine(l, i >= 0 || !c.eof)
+		if err != nil {
+			c.err = &LoadError{Line: line, Err: err}
+			break
+		}
+		record := plainRecord{word: string(word), line: line, row: -1}
+		if filter.accepts(record.word) {
+			record.row = len(c.scalars) / int(dim)
+			c.scalars = slices.Grow(c.scalars, int(dim))
+			vector := c.scalars[len(c.scalars):][:dim]
+			if err := parseValues(vector, values); err != nil {
+				c.err = &LoadError{Line: line, Err: err}
+				break
+			}
+			c.scalars = c.scalars[:len(c.scalars)+int(dim)]
+		}
+		c.records = append(c.records, record)
+	}
+}
+
+// loadPlain loads the records of a plaintext model into a store, parsing
+// chunks of lines on o.Parallelism goroutines and adding them in file order.
+// newParser is called once for each of them.
+func loadPlain[T VectorScalar](pr *plainReader, store *vectorStore[T],
+	o *LoadOptions, newParser func() plainParser[T]) error {
+
+	filter, workers := &o.Filter, o.Parallelism
+	// The first line was read to find dim, it starts the first chunk
+	if pr.first != nil {
+		pr.long = append(append(pr.long[:0], pr.first...), '\n')
+		pr.first = nil
+		pr.line--
+	}
+
+	start := store.len()
+	// insert adds the records of a chunk, it returns io.EOF at the end of
+	// the model or if the filter is full
+	insert := func(c *plainChunk[T]) error {
+		dim := int(store.dim)
+		for _, record := range c.records {
+			if filter.full(store.len() - start) {
+				return io.EOF
+			}
+			if err := pr.count(); err != nil {
+				return &LoadError{Line: record.line, Err: err}
+			}
+			if record.row >= 0 {
+				store.set(record.word,
+					c.scalars[record.row*dim:(record.row+1)*dim])
+			}
+		}
+		o.loaded(store.len() - start)
+		if c.err != nil {
+			return c.err
+		} else if c.eof || filter.full(store.len()-start) {
+			return io.EOF
+		}
+		return nil
+	}
+	finish := func(err error) error {
+		if err == io.EOF && !filter.full(store.len()-start) {
+			err = pr.end()
+		}
+		if err == io.EOF {
+			return nil
+		}
+		return err
+	}
+
+	if workers <= 1 {
+		parse := newParser()
+		c := &plainChunk[T]{}
+		for {
+			readPlainChunk(pr, c)
+			c.parse(store.dim, filter, parse)
+			if err := insert(c); err != nil {
+				return finish(err)
+			}
+		}
+	}
+
+	var pool sync.Pool
+	pool.New = func() any { return &plainChunk[T]{} }
+	done := make(chan struct{})
+	chunks := make(chan *plainChunk[T], workers)
+	parsed := make(chan *plainChunk[T], workers)
+	// inflight bounds the chunks read but not yet added, as the chunks that
+	// are parsed out of order are held until the ones before them
+	inflight := make(chan struct{}, 2*workers)
+
+	// The reader goroutine owns pr.line and pr.long until it is finished
+	read := make(chan struct{})
+	go func() {
+		defer close(read)
+		defer close(chunks)
+		for seq := 0; ; seq++ {
+			select {
+			case inflight <- struct{}{}:
+			case <-done:
+				return
+			}
+			c := pool.Get().(*plainChunk[T])
+			readPlainChunk(pr, c)
+			c.seq = seq
+			last := c.eof || c.err != nil
+			select {
+			case chunks <- c:
+			case <-done:
+				return
+			}
+			if last {
+				return
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			parse := newParser()
+			for c := range chunks {
+				c.parse(store.dim, filter, parse)
+				select {
+				case parsed <- c:
+				case <-done:
+					return
+				}
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(parsed)
+	}()
+
+	// Chunks are added in file order
+	pending := make(map[int]*plainChunk[T])
+	next := 0
+	var err error
+	for c := range parsed {
+		pending[c.seq] = c
+		for err == nil && pending[next] != nil {
+			c := pending[next]
+			err = insert(c)
+			delete(pending, next)
+			pool.Put(c)
+			next++
+			<-inflight
+		}
+		if err != nil {
+			break
+		}
+	}
+	close(done)
+	for range parsed {
+	}
+	<-read
+	return finish(err)
+}
+
+/** Binary Records **/
+
+// binaryReader reads the words and vectors of a binary model, which always
+// starts with a description
+type binaryReader struct {
+	br        *bufio.Reader
+	order     binary.ByteOrder
+	size, dim uint
+	// record is the number of the word last read
+	record int
+}
+
+// newBinaryReader reads the description of a binary model
+func newBinaryReader(br *bufio.Reader,
+	order binary.ByteOrder) (*binaryReader, error) {
+
+	size, dim, err := readDescription(br)
+	if err != nil {
+		return nil, &LoadError{Line: 1, Err: err}
+	}
+	return &binaryReader{br: br, order: order, size: size, dim: dim}, nil
+}
+
+// wrap returns err as a LoadError at the current record, the end of the
+// stream is reported as ErrTruncated
+func (r *binaryReader) wrap(err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = fmt.Errorf("%w, description declares %d words but word %d "+
+			"is incomplete", ErrTruncated, r.size, r.record)
+	}
+	return &LoadError{Record: r.record, Err: err}
+}
+
+// readBinaryRecord reads the next word of r and its vector into buf, ok is
+// false if the filter skips the word in which case buf isn't filled. It
+// returns io.EOF once the words of the description have been read.
+func readBinaryRecord[B FloatScalar](r *binaryReader, buf []B,
+	filter *LoadFilter) (word string, ok bool, err error) {
+
+	if uint(r.record) >= r.size {
+		return "", false, io.EOF
+	}
+	r.record++
+	word, err = readBinaryWord(r.br)
+	if err != nil {
+		return "", false, r.wrap(err)
+	}
+	if !filter.accepts(word) {
+		if _, err := r.br.Discard(len(scalarBytes(buf))); err != nil {
+			return "", false, r.wrap(err)
+		}
+		return word, false, nil
+	}
+	if err := readScalars(r.br, buf, r.order); err != nil {
+		return "", false, r.wrap(err)
+	}
+	return word, true, nil
+}
@@ -0,0 +1,332 @@
+/*
+
+Copyright (C) 2024 Jackie Deng
+
+Permission to use, copy, modify, and/or distribute this software for any
+purpose with or without fee is hereby granted.
+
+THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES WITH
+REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF MERCHANTABILITY AND
+FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY SPECIAL, DIRECT,
+INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES WHATSOEVER RESULTING FROM
+LOSS OF USE, DATA OR PROFITS, WHETHER IN AN ACTION OF CONTRACT, NEGLIGENCE OR
+OTHER TORTIOUS ACTION, ARISING OUT OF OR IN CONNECTION WITH THE USE OR
+PERFORMANCE OF THIS SOFTWARE.
+
+*/
+
+package gowe
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestPlainLoadErrors(t *testing.T) {
+	cases := []struct {
+		plain  string
+		header bool
+		err    error
+		line   int
+	}{
+		{"2 3\ncat 1 2 3\n", true, ErrTruncated, 2},
+		{"1 3\ncat 1 2 3\ndog 1 2 3\n", true, ErrBadHeader, 3},
+		{"x 3\ncat 1 2 3\n", true, ErrBadHeader, 1},
+		{"1\ncat 1 2 3\n", true, ErrBadHeader, 1},
+		{"1 0\ncat\n", true, ErrBadHeader, 1},
+		{"cat 1 2 3\ndog 1 2\n", false, ErrDimMismatch, 2},
+		{"cat 1 2 3\n\ndog\nroad 1 2 3\n", false, ErrDimMismatch, 3},
+		{"cat 1 2 3\ndog", false, ErrTruncated, 2},
+		{"cat\n", false, ErrDimMismatch, 1},
+		{"", false, ErrTruncated, 1},
+	}
+	for _, c := range cases {
+		m := NewFloatModel[float32]()
+		err := m.LoadPlain(strings.NewReader(c.plain), WithHeader(c.header))
+		var loadErr *LoadError
+		if !errors.Is(err, c.err) || !errors.As(err, &loadErr) ||
+			loadErr.Line != c.line {
+			t.Errorf("Loading %q should fail with %v at line %d, got %v",
+				c.plain, c.err, c.line, err)
+		}
+	}
+
+	// Blank lines and trailing spaces are tolerated
+	m := NewIntModel[int8]()
+	err := m.LoadPlain(strings.NewReader("2 2\ncat 1 0 \r\n\n\ndog 0 1\n\n"),
+		WithHeader(true), WithMaxMagnitude(1))
+	if err != nil || m.VocabularySize() != 2 {
+		t.Errorf("Expected 2 words, got %d and %v", m.VocabularySize(), err)
+	}
+	err = NewFloatModel[float64]().LoadPlain(strings.NewReader("cat 1 x\n"))
+	var loadErr *LoadError
+	if !errors.As(err, &loadErr) || loadErr.Line != 1 {
+		t.Errorf("Invalid float should fail at line 1, got %v", err)
+	}
+}
+
+func TestBinaryLoadErrors(t *testing.T) {
+	data := testBinary()
+	for _, c := range []struct {
+		data   []byte
+		err    error
+		record int
+	}{
+		{data[:len(data)-1], ErrTruncated, 3},
+		{data[:len(data)-14], ErrTruncated, 3},
+		{bytes.Replace(data, []byte("3 3"), []byte("4 3"), 1), ErrTruncated,
+			4},
+		{bytes.Replace(data, []byte("3 3"), []byte("3 a"), 1), ErrBadHeader,
+			0},
+	} {
+		errs := []error{
+			NewFloatModel[float32]().LoadBinary(bytes.NewReader(c.data)),
+			NewIntModel[int8]().LoadBinary(bytes.NewReader(c.data),
+				WithMaxMagnitude(2)),
+		}
+		for _, err := range errs {
+			var loadErr *LoadError
+			if !errors.Is(err, c.err) || !errors.As(err, &loadErr) ||
+				loadErr.Record != c.record {
+				t.Errorf("Loading binary should fail with %v at record %d, "+
+					"got %v", c.err, c.record, err)
+			}
+		}
+	}
+
+	// Data after the declared words is ignored
+	m := NewFloatModel[float32]()
+	if err := m.LoadBinary(bytes.NewReader(append(data, "\nextra"...))); err !=
+		nil || m.VocabularySize() != 3 {
+		t.Errorf("Expected 3 words, got %d and %v", m.VocabularySize(), err)
+	}
+}
+
+// checkFuzzedModel checks a model that loaded without error is consistent
+func checkFuzzedModel[T VectorScalar](t *testing.T, m Embedding[T]) {
+	id := 0
+	for word := range m.Words() {
+		if got, ok := m.ID(word); !ok || got != id {
+			t.Fatalf("ID of %q should be %d, got %d", word, id, got)
+		}
+		if uint(len(m.VectorByID(id))) != m.Dimensions() {
+			t.Fatalf("Vector of %q should have %d dimensions, got %d", word,
+				m.Dimensions(), len(m.VectorByID(id)))
+		}
+		id++
+	}
+	if uint(id) != m.VocabularySize() {
+		t.Fatalf("Vocabulary should have %d words, got %d",
+			m.VocabularySize(), id)
+	}
+}
+
+func FuzzLoadPlain(f *testing.F) {
+	f.Add(testPlain(true), true)
+	f.Add(testPlain(false), false)
+	f.Add("2 2\ncat 1 0\n\ndog 0 1", true)
+	f.Add("cat 1e3 -0.5\ndog NaN Inf\n", false)
+	f.Fuzz(func(t *testing.T, plain string, header bool) {
+		m := NewFloatModel[float32]()
+		err := m.LoadPlain(strings.NewReader(plain), WithHeader(header))
+		if err == nil {
+			checkFuzzedModel[float32](t, m)
+		}
+		q := NewIntModel[int16]()
+		err = q.LoadPlain(strings.NewReader(plain), WithHeader(header),
+			WithMaxMagnitude(4))
+		if err == nil {
+			checkFuzzedModel[int16](t, q)
+		}
+	})
+}
+
+func FuzzLoadBinary(f *testing.F) {
+	f.Add(testBinary(), 32)
+	f.Add(testBinary64(), 64)
+	f.Add([]byte("1 2\ncat \x00\x00\x80\x3f\x00\x00\x00\x00"), 32)
+	f.Fuzz(func(t *testing.T, data []byte, bitSize int) {
+		m := NewFloatModel[float64]()
+		err := m.LoadBinary(bytes.NewReader(data), WithBitSize(bitSize))
+		if err == nil {
+			checkFuzzedModel[float64](t, m)
+		}
+		q := NewIntModel[int8]()
+		err = q.LoadBinary(bytes.NewReader(data), WithBitSize(bitSize),
+			WithMaxMagnitude(2))
+		if err == nil {
+			checkFuzzedModel[int8](t, q)
+		}
+	})
+}
+
+// benchPlain is the first 20000 words of the benchmark vocabulary as a
+// plaintext model, with 5 decimals like the GloVe releases
+func benchPlain() []byte {
+	data := benchData()
+	var plain []byte
+	plain = fmt.Appendf(plain, "%d %d\n", 20000, benchDim)
+	for i, word := range data.words[:20000] {
+		plain = append(plain, word...)
+		for _, f := range data.vectors[i] {
+			plain = append(plain, ' ')
+			plain = strconv.AppendFloat(plain, float64(f), 'f', 5, 32)
+		}
+		plain = append(plain, '\n')
+	}
+	return plain
+}
+
+func benchmarkLoadPlain[T VectorScalar](b *testing.B, newModel func() Model[T],
+	opts ...LoadOption) {
+
+	plain := benchPlain()
+	opts = append(opts, WithHeader(true), WithMaxMagnitude(1))
+	b.SetBytes(int64(len(plain)))
+	b.ResetTimer()
+	for range b.N {
+		if err := newModel().LoadPlain(bytes.NewReader(plain),
+			opts...); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func newBenchFloatModel() Model[float32] { return NewFloatModel[float32]() }
+func newBenchIntModel() Model[int16]     { return NewIntModel[int16]() }
+
+func BenchmarkLoadPlainSerial(b *testing.B) {
+	benchmarkLoadPlain(b, newBenchFloatModel, WithParallelism(1))
+}
+
+func BenchmarkLoadPlainParallel(b *testing.B) {
+	benchmarkLoadPlain(b, newBenchFloatModel)
+}
+
+func BenchmarkLoadPlainIntSerial(b *testing.B) {
+	benchmarkLoadPlain(b, newBenchIntModel, WithParallelism(1))
+}
+
+func BenchmarkLoadPlainIntParallel(b *testing.B) {
+	benchmarkLoadPlain(b, newBenchIntModel)
+}
+
+func TestParseFloat(t *testing.T) {
+	r := rand.New(rand.NewPCG(3, 4))
+	inputs := []string{"0", "-0", "+1", ".5", "5.", "1e3", "1E-3", "-2.5e+2",
+		"0.000001234", "123456789012345678901234", "1e400", "1e-400", "NaN",
+		"-Inf", "0x1p-2", "", "-", ".", "1e", "1.2.3", "1_000", "12a"}
+	for range 1000 {
+		f := r.NormFloat64() * math.Pow(10, float64(r.IntN(20)-10))
+		inputs = append(inputs,
+			strconv.FormatFloat(f, 'f', r.IntN(12), 64),
+			strconv.FormatFloat(f, 'g', -1, 32),
+			strconv.FormatFloat(f, 'e', -1, 64))
+	}
+	for _, s := range inputs {
+		want32, err32 := strconv.ParseFloat(s, 32)
+		got32, err := parseFloat[float32]([]byte(s))
+		if (err != nil) != (err32 != nil) || (err == nil &&
+			math.Float32bits(got32) != math.Float32bits(float32(want32))) {
+			t.Errorf("Parsing %q as float32 should give %v %v, got %v %v", s,
+				float32(want32), err32, got32, err)
+		}
+		want64, err64 := strconv.ParseFloat(s, 64)
+		got64, err := parseFloat[float64]([]byte(s))
+		if (err != nil) != (err64 != nil) || (err == nil &&
+			math.Float64bits(got64) != math.Float64bits(want64)) {
+			t.Errorf("Parsing %q as float64 should give %v %v, got %v %v", s,
+				want64, err64, got64, err)
+		}
+	}
+}
+
+// sameModel reports whether two models have the same words and vectors in
+// the same order
+func sameModel[T VectorScalar](m, n Embedding[T]) bool {
+	mwords, mvectors := collectAll(m)
+	nwords, nvectors := collectAll(n)
+	return slices.Equal(mwords, nwords) &&
+		slices.EqualFunc(mvectors, nvectors, slices.Equal)
+}
+
+func TestParallelLoadPlain(t *testing.T) {
+	// Chunks of a few lines so that every model is split across workers
+	defer func(size int) { plainChunkSize = size }(plainChunkSize)
+	plainChunkSize = 64
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "%d 3\n", 200)
+	for i := range 200 {
+		if i%7 == 0 {
+			sb.WriteString("\n")
+		}
+		fmt.Fprintf(&sb, "word%d %g %g %g\n", i, float32(i)/200, -0.5,
+			float32(i%3)/4)
+	}
+	plain := sb.String()
+	for _, opts := range [][]LoadOption{
+		nil,
+		{WithMaxWords(50)},
+		{WithKeep(func(word string) bool { return len(word) == 6 })},
+	} {
+		opts = append(opts, WithHeader(true), WithMaxMagnitude(1))
+		serial, parallel := NewFloatModel[float32](), NewFloatModel[float32]()
+		qserial, qparallel := NewIntModel[int16](), NewIntModel[int16]()
+		for _, m := range []struct {
+			m Model[float32]
+			n int
+		}{{serial, 1}, {parallel, 4}} {
+			err := m.m.LoadPlain(strings.NewReader(plain),
+				append(opts, WithParallelism(m.n))...)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		for _, m := range []struct {
+			m Model[int16]
+			n int
+		}{{qserial, 1}, {qparallel, 4}} {
+			err := m.m.LoadPlain(strings.NewReader(plain),
+				append(opts, WithParallelism(m.n))...)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		if !sameModel[float32](serial, parallel) ||
+			!sameModel[int16](qserial, qparallel) {
+			t.Error("Parallel load should match the serial load")
+		}
+		if serial.VocabularySize() == 0 {
+			t.Error("Parallel load should load words")
+		}
+	}
+
+	// Errors are reported at the same line as when loading serially
+	for _, plain := range []string{
+		plain[:len(plain)-40],
+		strings.Replace(plain, "word150 ", "word150 x ", 1),
+		strings.Replace(plain, "word99 0.495 ", "word99 ", 1),
+		strings.Replace(plain, "200 3", "100 3", 1),
+	} {
+		var errs [2]error
+		for i, n := range []int{1, 4} {
+			errs[i] = NewFloatModel[float32]().LoadPlain(
+				strings.NewReader(plain), WithHeader(true),
+				WithParallelism(n))
+		}
+		var serial, parallel *LoadError
+		if !errors.As(errs[0], &serial) || !errors.As(errs[1], &parallel) ||
+			serial.Line != parallel.Line || errs[0].Error() != errs[1].Error() {
+			t.Errorf("Parallel load should fail like the serial load with %v, "+
+				"got %v", errs[0], errs[1])
+		}
+	}
+}
@@ -0,0 +1,271 @@
+/*
+
+Copyright (C) 2024 Jackie Deng
+
+Permission to use, copy, modify, and/or distribute this software for any
+purpose with or without fee is hereby granted.
+
+THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES WITH
+REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF MERCHANTABILITY AND
+FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY SPECIAL, DIRECT,
+INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES WHATSOEVER RESULTING FROM
+LOSS OF USE, DATA OR PROFITS, WHETHER IN AN ACTION OF CONTRACT, NEGLIGENCE OR
+OTHER TORTIOUS ACTION, ARISING OUT OF OR IN CONNECTION WITH THE USE OR
+PERFORMANCE OF THIS SOFTWARE.
+
+*/
+
+package gowe
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"iter"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+	"unsafe"
+)
+
+/** MappedModel **/
+
+// MappedModel is a read-only model backed by a memory mapped native gowe
+// file. Vectors are read straight from the mapped file without being copied
+// or parsed, so opening a model only checks its word offsets and index, and
+// processes mapping the same file share a single copy in the page cache.
+//
+// Vectors and words returned by a MappedModel point into the mapped file and
+// must not be used after Close.
+type MappedModel[T VectorScalar] struct {
+	data        []byte
+	header      nativeHeader
+	metadata    map[string]string
+	scalars     []T
+	wordOffsets []uint64
+	wordBytes   []byte
+	index       []uint32
+}
+
+// OpenMappedModel memory maps the native gowe file at p, whose scalars must be
+// of type T
+func OpenMappedModel[T VectorScalar](p string) (*MappedModel[T], error) {
+	if !littleEndianHost {
+		return nil, errors.New("Memory mapped models require a little " +
+			"endian host")
+	}
+
+	file, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if info.Size() < nativeHeaderSize {
+		return nil, errors.New("Not a native gowe model")
+	}
+	data, err := mmapFile(file, int(info.Size()))
+	if err != nil {
+		return nil, err
+	}
+
+	m, err := newMappedModel[T](data)
+	if err != nil {
+		munmapFile(data)
+		return nil, err
+	}
+	return m, nil
+}
+
+func newMappedModel[T VectorScalar](data []byte) (*MappedModel[T], error) {
+	h, meta, err := readNativeHeader(bufio.NewReader(bytes.NewReader(data)))
+	if err != nil {
+		return nil, err
+	}
+	if h.scalar != scalarTypeOf[T]() {
+		return nil, fmt.Errorf("Native gowe model has %s scalars, not %s",
+			h.scalar, scalarTypeOf[T]())
+	}
+	// The header was validated so that its sections are in order, aligned
+	// and don't overflow, which leaves the file length, the word offsets and
+	// the index to check before anything is sliced from the mapping
+	if h.indexOff+h.size*4 > uint64(len(data)) {
+		return nil, fmt.Errorf("%w, native gowe model is %d bytes but its "+
+			"index ends at %d", ErrTruncated, len(data),
+			h.indexOff+h.size*4)
+	}
+
+	m := &MappedModel[T]{data: data, header: h, metadata: meta}
+	if h.size > 0 {
+		n := int(h.size)
+		var t T
+		if uintptr(unsafe.Pointer(&data[h.vectorsOff]))%
+			unsafe.Alignof(t) != 0 {
+			return nil, errors.New("Native gowe vectors are misaligned")
+		}
+		m.scalars = unsafe.Slice(
+			(*T)(unsafe.Pointer(&data[h.vectorsOff])), n*int(h.dim))
+		m.wordOffsets = unsafe.Slice(
+			(*uint64)(unsafe.Pointer(&data[h.wordsOff])), n+1)
+		m.wordBytes = data[h.wordBytesOff():h.indexOff]
+		if m.wordOffsets[0] != 0 || !slices.IsSorted(m.wordOffsets) ||
+			m.wordOffsets[n] > uint64(len(m.wordBytes)) {
+			return nil, fmt.Errorf("%w, invalid native gowe word offsets",
+				ErrBadHeader)
+		}
+		m.index = unsafe.Slice(
+			(*uint32)(unsafe.Pointer(&data[h.indexOff])), n)
+		for _, id := range m.index {
+			if uint64(id) >= h.size {
+				return nil, fmt.Errorf("%w, native gowe index has word id %d "+
+					"of %d words", ErrBadHeader, id, h.size)
+			}
+		}
+	}
+	return m, nil
+}
+
+// Close unmaps the model file
+func (m *MappedModel[T]) Close() error {
+	if m.data == nil {
+		return nil
+	}
+	err := munmapFile(m.data)
+	*m = MappedModel[T]{}
+	return err
+}
+
+// word returns the word with id i as a view of the mapped file
+func (m *MappedModel[T]) word(i int) string {
+	start, end := m.wordOffsets[i], m.wordOffsets[i+1]
+	if start >= end {
+		return ""
+	}
+	return unsafe.String(&m.wordBytes[start], int(end-start))
+}
+
+// row returns the vector of the word with id i
+func (m *MappedModel[T]) row(i int) []T {
+	dim := int(m.header.dim)
+	return m.scalars[i*dim : (i+1)*dim : (i+1)*dim]
+}
+
+// id looks up a word with a binary search of the sorted index
+func (m *MappedModel[T]) id(s string) (int, bool) {
+	i, ok := slices.BinarySearchFunc(m.index, s,
+		func(id uint32, s string) int {
+			return strings.Compare(m.word(int(id)), s)
+		})
+	if !ok {
+		return 0, false
+	}
+	return int(m.index[i]), true
+}
+
+func (m *MappedModel[T]) Vector(s string) []T {
+	i, ok := m.id(s)
+	if !ok {
+		return make([]T, m.header.dim)
+	}
+	return m.row(i)
+}
+
+// Lookup returns the vector of a word and whether the word is in the model,
+// the vector is in the read-only mapping and must not be modified
+func (m *MappedModel[T]) Lookup(s string) ([]T, bool) {
+	i, ok := m.id(s)
+	if !ok {
+		return nil, false
+	}
+	return m.row(i), true
+}
+
+func (m *MappedModel[T]) Dimensions() uint {
+	return uint(m.header.dim)
+}
+
+func (m *MappedModel[T]) VocabularySize() uint {
+	return uint(m.header.size)
+}
+
+// Words returns the vocabulary in the order it was written
+func (m *MappedModel[T]) Words() iter.Seq[string] {
+	return func(yield func(string) bool) {
+		for i := range int(m.header.size) {
+			if !yield(m.word(i)) {
+				return
+			}
+		}
+	}
+}
+
+// All returns the words and vectors of the model in the order they were
+// written, the vectors are in the read-only mapping and must not be modified
+func (m *MappedModel[T]) All() iter.Seq2[string, []T] {
+	return func(yield func(string, []T) bool) {
+		for i := range int(m.header.size) {
+			if !yield(m.word(i), m.row(i)) {
+				return
+			}
+		}
+	}
+}
+
+// ID returns the id of a word, ids number the vocabulary from 0 in the order
+// it was written
+func (m *MappedModel[T]) ID(s string) (int, bool) {
+	return m.id(s)
+}
+
+// Word returns the word with an id, or "" if there is no such id
+func (m *MappedModel[T]) Word(id int) string {
+	if id < 0 || id >= int(m.header.size) {
+		return ""
+	}
+	return m.word(id)
+}
+
+// VectorByID returns the vector of the word with an id, or nil if there is no
+// such id
+func (m *MappedModel[T]) VectorByID(id int) []T {
+	if id < 0 || id >= int(m.header.size) {
+		return nil
+	}
+	return m.row(id)
+}
+
+// Shift returns the QuantizationShift of the vectors if they are integers
+func (m *MappedModel[T]) Shift() uint8 {
+	return m.header.shift
+}
+
+// Metadata returns a copy of the metadata saved with the model
+func (m *MappedModel[T]) Metadata() map[string]string {
+	return maps.Clone(m.metadata)
+}
+
+// Similarity returns the cosine similarity between two words, or 0 if either
+// isn't in the model. Use SimilarityE to tell missing words apart.
+func (m *MappedModel[T]) Similarity(s, t string) float64 {
+	similarity, _ := m.SimilarityE(s, t)
+	return similarity
+}
+
+// SimilarityE returns the cosine similarity between two words, or an error
+// wrapping ErrWordNotFound if either isn't in the model
+func (m *MappedModel[T]) SimilarityE(s, t string) (float64, error) {
+	i, ok := m.id(s)
+	if !ok {
+		return 0, wordNotFound(s)
+	}
+	j, ok := m.id(t)
+	if !ok {
+		return 0, wordNotFound(t)
+	}
+	return cosineSimilarity(m.row(i), m.row(j)), nil
+}
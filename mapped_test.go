@@ -0,0 +1,139 @@
+/*
+
+Copyright (C) 2024 Jackie Deng
+
+Permission to use, copy, modify, and/or distribute this software for any
+purpose with or without fee is hereby granted.
+
+THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES WITH
+REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF MERCHANTABILITY AND
+FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY SPECIAL, DIRECT,
+INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES WHATSOEVER RESULTING FROM
+LOSS OF USE, DATA OR PROFITS, WHETHER IN AN ACTION OF CONTRACT, NEGLIGENCE OR
+OTHER TORTIOUS ACTION, ARISING OUT OF OR IN CONNECTION WITH THE USE OR
+PERFORMANCE OF THIS SOFTWARE.
+
+*/
+
+package gowe
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestMappedModel(t *testing.T) {
+	m := NewIntModel[int16]()
+	err := m.FromPlainReader(strings.NewReader(testPlain(false)), false, 2.0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.SetMetadata("source", "test")
+	p := t.TempDir() + "/model.gowe"
+	if err := m.WriteNativeFile(p); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := OpenMappedModel[int8](p); err == nil {
+		t.Error("Mapping an int16 model as int8 should fail")
+	}
+
+	mm, err := OpenMappedModel[int16](p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mm.Close()
+
+	if mm.Dimensions() != 3 || mm.VocabularySize() != 3 {
+		t.Fatalf("Mapped model should be 3 words of 3 dimensions, got %d "+
+			"of %d", mm.VocabularySize(), mm.Dimensions())
+	}
+	if mm.Shift() != m.Shift() || mm.Metadata()["source"] != "test" {
+		t.Error("Mapped model should keep the shift and metadata")
+	}
+	mm.Metadata()["source"] = "changed"
+	if mm.Metadata()["source"] != "test" {
+		t.Error("Metadata of a mapped model should be a copy")
+	}
+	for _, word := range testWords {
+		if !slices.Equal(m.Vector(word), mm.Vector(word)) {
+			t.Errorf("Mapped vector for %q should be %v, got %v", word,
+				m.Vector(word), mm.Vector(word))
+		}
+	}
+	if words := slices.Collect(mm.Words()); !slices.Equal(words, testWords) {
+		t.Errorf("Mapped words should be in file order, got %v", words)
+	}
+	if id, ok := mm.ID("road"); !ok || id != 2 || mm.Word(2) != "road" {
+		t.Errorf("Mapped ID of \"road\" should be 2, got %d", id)
+	}
+	if !slices.Equal(mm.VectorByID(1), m.Vector("dog")) {
+		t.Error("Mapped VectorByID(1) should be the vector for \"dog\"")
+	}
+	if !slices.Equal(mm.Vector("horse"), []int16{0, 0, 0}) {
+		t.Error("Mapped vector for a missing word should be zeros")
+	}
+	if mm.Similarity("cat", "dog") != m.Similarity("cat", "dog") {
+		t.Error("Mapped similarity should equal the loaded model's")
+	}
+
+	nearest, err := NNearestIn(mm, "cat", []string{"road", "dog"}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nearest[0] != "dog" {
+		t.Errorf("Nearest to \"cat\" should be \"dog\", got %v", nearest)
+	}
+}
+
+func TestMappedCorrupt(t *testing.T) {
+	data := testNative(t)
+	h, err := unmarshalNativeHeader(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		name string
+		data []byte
+		err  error
+	}{
+		{"truncated index", data[:len(data)-2], ErrTruncated},
+		{"truncated header", data[:h.vectorsOff-8], ErrTruncated},
+		{"huge dim", withHeaderField(data, 8, 1<<30), ErrBadHeader},
+		{"huge size", withHeaderField(data, 16, math.MaxUint32),
+			ErrBadHeader},
+		{"bad word offset", withHeaderField(data, int(h.wordsOff)+8, 1<<30),
+			ErrBadHeader},
+		{"decreasing word offsets", withHeaderField(data,
+			int(h.wordsOff)+16, 1), ErrBadHeader},
+		{"bad index entry", withUint32(data, int(h.indexOff)+4, 99),
+			ErrBadHeader},
+	} {
+		p := filepath.Join(t.TempDir(), "model.gowe")
+		if err := os.WriteFile(p, c.data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		m, err := OpenMappedModel[float32](p)
+		if !errors.Is(err, c.err) {
+			t.Errorf("Mapping native model with %s should fail with %v, "+
+				"got %v", c.name, c.err, err)
+		}
+		if err == nil {
+			m.Close()
+		}
+	}
+}
+
+// withUint32 returns a copy of data with the uint32 at offset set to v
+func withUint32(data []byte, offset int, v uint32) []byte {
+	data = bytes.Clone(data)
+	binary.LittleEndian.PutUint32(data[offset:], v)
+	return data
+}
@@ -0,0 +1,573 @@
+/*
+
+Copyright (C) 2024 Jackie Deng
+
+Permission to use, copy, modify, and/or distribute this software for any
+purpose with or without fee is hereby granted.
+
+THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES WITH
+REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF MERCHANTABILITY AND
+FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY SPECIAL, DIRECT,
+INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES WHATSOEVER RESULTING FROM
+LOSS OF USE, DATA OR PROFITS, WHETHER IN AN ACTION OF CONTRACT, NEGLIGENCE OR
+OTHER TORTIOUS ACTION, ARISING OUT OF OR IN CONNECTION WITH THE USE OR
+PERFORMANCE OF THIS SOFTWARE.
+
+*/
+
+package gowe
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"testing"
+)
+
+var testWords = []string{"cat", "dog", "road"}
+var testVectors = [][]float32{
+	{0.5, -1.25, 1},
+	{0.25, -1, 1.5},
+	{-1.75, 0.5, 0},
+}
+
+func testPlain(desc bool) string {
+	var sb strings.Builder
+	if desc {
+		fmt.Fprintf(&sb, "%d %d\n", len(testWords), len(testVectors[0]))
+	}
+	for i, word := range testWords {
+		sb.WriteString(word)
+		for _, f := range testVectors[i] {
+			fmt.Fprintf(&sb, " %g", f)
+		}
+		sb.WriteString("\n")
+	}
+	return sb.String()
+}
+
+func testBinary() []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%d %d\n", len(testWords), len(testVectors[0]))
+	for i, word := range testWords {
+		buf.WriteString(word + " ")
+		binary.Write(&buf, binary.LittleEndian, testVectors[i])
+	}
+	return buf.Bytes()
+}
+
+func checkTestFloatModel(t *testing.T, m *FloatModel[float32]) {
+	t.Helper()
+	if m.Dimensions() != 3 || m.VocabularySize() != 3 {
+		t.Fatalf("Model should be 3 words of 3 dimensions, got %d of %d",
+			m.VocabularySize(), m.Dimensions())
+	}
+	for i, word := range testWords {
+		v := m.Vector(word)
+		for j := range v {
+			if v[j] != testVectors[i][j] {
+				t.Errorf("Vector for %q should be %v, got %v", word,
+					testVectors[i], v)
+				break
+			}
+		}
+	}
+}
+
+func TestFloatModelFromPlainReader(t *testing.T) {
+	for _, desc := range []bool{true, false} {
+		m := NewFloatModel[float32]()
+		err := m.FromPlainReader(strings.NewReader(testPlain(desc)), desc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkTestFloatModel(t, m)
+	}
+}
+
+func TestFloatModelFromBinaryReader(t *testing.T) {
+	m := NewFloatModel[float32]()
+	err := m.FromBinaryReader(bytes.NewReader(testBinary()), 32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkTestFloatModel(t, m)
+}
+
+func TestIntModelFromReaders(t *testing.T) {
+	plain := NewIntModel[int16]()
+	err := plain.FromPlainReader(strings.NewReader(testPlain(false)), false,
+		2.0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bin := NewIntModel[int16]()
+	err = bin.FromBinaryReader(bytes.NewReader(testBinary()), 32, 2.0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, word := range testWords {
+		p, b := plain.Vector(word), bin.Vector(word)
+		if len(p) != 3 || len(b) != 3 {
+			t.Fatalf("Vector for %q should have 3 dimensions", word)
+		}
+		for i := range p {
+			if p[i] != b[i] {
+				t.Errorf("Plaintext and binary vectors for %q should be "+
+					"equal, got %v and %v", word, p, b)
+				break
+			}
+		}
+	}
+
+	err = NewIntModel[int8]().FromPlainReader(
+		strings.NewReader(testPlain(false)), false)
+	if err == nil {
+		t.Error("IntModel should require a maxMagnitude opt")
+	}
+}
+
+func TestFloatModelWriteRoundTrip(t *testing.T) {
+	m := NewFloatModel[float32]()
+	err := m.FromPlainReader(strings.NewReader(testPlain(false)), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := m.WritePlainTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(buf.String(), "3 3\ncat ") {
+		t.Errorf("Plaintext should start with a description and keep the "+
+			"word order, got %q", buf.String())
+	}
+	plain := NewFloatModel[float32]()
+	if err := plain.FromPlainReader(&buf, true); err != nil {
+		t.Fatal(err)
+	}
+	checkTestFloatModel(t, plain)
+
+	for _, bitSize := range []int{32, 64} {
+		buf.Reset()
+		if err := m.WriteBinaryTo(&buf, bitSize); err != nil {
+			t.Fatal(err)
+		}
+		bin := NewFloatModel[float32]()
+		if err := bin.FromBinaryReader(&buf, bitSize); err != nil {
+			t.Fatal(err)
+		}
+		checkTestFloatModel(t, bin)
+	}
+
+	// Words with separators couldn't be read back
+	for _, word := range []string{"ice cream", "tab\tbed", "new\nline"} {
+		if err := m.Set(word, []float32{1, 2, 3}); err != nil {
+			t.Fatal(err)
+		}
+		if err := m.WritePlainTo(io.Discard); err == nil {
+			t.Errorf("Writing %q to plaintext should fail", word)
+		}
+		if err := m.WriteBinaryTo(io.Discard, 32); err == nil {
+			t.Errorf("Writing %q to binary should fail", word)
+		}
+		m.Delete(word)
+	}
+}
+
+func TestIntModelWriteRoundTrip(t *testing.T) {
+	m := NewIntModel[int16]()
+	err := m.FromPlainReader(strings.NewReader(testPlain(false)), false, 2.0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The test vectors are exactly representable so they should dequantize
+	// back to the original floats
+	p := t.TempDir() + "/model.txt"
+	if err := m.WritePlainFile(p); err != nil {
+		t.Fatal(err)
+	}
+	f := NewFloatModel[float32]()
+	if err := f.FromPlainFile(p, true); err != nil {
+		t.Fatal(err)
+	}
+	checkTestFloatModel(t, f)
+
+	p = t.TempDir() + "/model.bin"
+	if err := m.WriteBinaryFile(p, 32); err != nil {
+		t.Fatal(err)
+	}
+	q := NewIntModel[int16]()
+	if err := q.FromBinaryFile(p, 32, 2.0); err != nil {
+		t.Fatal(err)
+	}
+	for _, word := range testWords {
+		if !slices.Equal(m.Vector(word), q.Vector(word)) {
+			t.Errorf("Vector for %q should round trip, got %v and %v", word,
+				m.Vector(word), q.Vector(word))
+		}
+	}
+}
+
+func TestWordIDs(t *testing.T) {
+	plain := "road 1 0\ncat 0 1\ndog 1 1\n"
+	m := NewFloatModel[float64]()
+	if err := m.FromPlainReader(strings.NewReader(plain), false); err != nil {
+		t.Fatal(err)
+	}
+
+	order := []string{"road", "cat", "dog"}
+	if words := slices.Collect(m.Words()); !slices.Equal(words, order) {
+		t.Errorf("Words should be in file order %v, got %v", order, words)
+	}
+	for i, word := range order {
+		if id, ok := m.ID(word); !ok || id != i {
+			t.Errorf("ID of %q should be %d, got %d", word, i, id)
+		}
+		if m.Word(i) != word {
+			t.Errorf("Word %d should be %q, got %q", i, word, m.Word(i))
+		}
+		if !slices.Equal(m.VectorByID(i), m.Vector(word)) {
+			t.Errorf("VectorByID(%d) should equal Vector(%q)", i, word)
+		}
+	}
+	if _, ok := m.ID("horse"); ok {
+		t.Error("ID of a missing word should not be found")
+	}
+	if m.Word(3) != "" || m.VectorByID(-1) != nil {
+		t.Error("Out of range ids should return \"\" and nil")
+	}
+
+	// Writing and loading keeps the order
+	var buf bytes.Buffer
+	if err := m.WriteBinaryTo(&buf, 64); err != nil {
+		t.Fatal(err)
+	}
+	q := NewIntModel[int8]()
+	if err := q.FromBinaryReader(&buf, 64, 1.0); err != nil {
+		t.Fatal(err)
+	}
+	if words := slices.Collect(q.Words()); !slices.Equal(words, order) {
+		t.Errorf("Written words should be in file order %v, got %v", order,
+			words)
+	}
+}
+
+func TestModelMutation(t *testing.T) {
+	m := NewFloatModel[float32]()
+	if err := m.LoadPlain(strings.NewReader(testPlain(false))); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Set("horse", []float32{1, 2}); err == nil {
+		t.Error("Expected error for a vector of the wrong dimensions")
+	}
+	if err := m.Set("horse", []float32{1, 2, 3}); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Set("cat", []float32{3, 2, 1}); err != nil {
+		t.Fatal(err)
+	}
+	if !m.Has("horse") || m.VocabularySize() != 4 {
+		t.Errorf("horse should be added, got %v", slices.Collect(m.Words()))
+	}
+	v := m.Vector("cat")
+	if !slices.Equal(v, []float32{3, 2, 1}) {
+		t.Errorf("cat should be replaced, got %v", v)
+	}
+	v[0] = 0
+	if m.Vector("cat")[0] != 3 {
+		t.Error("Vector should return a copy")
+	}
+
+	if !m.Delete("dog") || m.Delete("dog") || m.Has("dog") {
+		t.Error("dog should be deleted once")
+	}
+	order := []string{"cat", "road", "horse"}
+	if words := slices.Collect(m.Words()); !slices.Equal(words, order) {
+		t.Errorf("Words should be %v after delete, got %v", order, words)
+	}
+	// Ids don't change, the id of dog is left as a gap
+	for i, word := range map[int]string{0: "cat", 2: "road", 3: "horse"} {
+		if id, ok := m.ID(word); !ok || id != i ||
+			!slices.Equal(m.VectorByID(i), m.Vector(word)) {
+			t.Errorf("ID of %q should be %d after delete, got %d", word, i,
+				id)
+		}
+	}
+	if m.Word(1) != "" || m.VectorByID(1) != nil || m.VocabularySize() != 3 {
+		t.Error("Deleted id should return \"\" and nil")
+	}
+	neighbors, err := NNearest(m, "cat", 5)
+	if err != nil || len(neighbors) != 2 {
+		t.Errorf("NNearest should skip the deleted word, got %v %v",
+			neighbors, err)
+	}
+	// Words deleted before the iterator reaches them are skipped
+	words := m.Words()
+	m.Delete("road")
+	if got := slices.Collect(words); !slices.Equal(got,
+		[]string{"cat", "horse"}) {
+		t.Errorf("Words should skip road deleted after the call, got %v", got)
+	}
+	if err := m.Set("road", testVectors[2]); err != nil {
+		t.Fatal(err)
+	}
+	order = []string{"cat", "horse", "road"}
+	if err := m.Set("dog", []float32{1, 1, 1}); err != nil {
+		t.Fatal(err)
+	}
+	if id, _ := m.ID("dog"); id != 5 {
+		t.Errorf("Setting a deleted word should give it a new id, got %d", id)
+	}
+	var buf bytes.Buffer
+	if err := m.WritePlainTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	written := NewFloatModel[float32]()
+	if err := written.LoadPlain(&buf, WithHeader(true)); err != nil {
+		t.Fatal(err)
+	}
+	order = append(order, "dog")
+	if words := slices.Collect(written.Words()); !slices.Equal(words, order) {
+		t.Errorf("Written words should be %v, got %v", order, words)
+	}
+
+	// Compacting frees the rows of deleted words and renumbers the rest
+	m.Compact()
+	if m.idLimit() != 4 || len(m.store.scalars) != 4*3 {
+		t.Errorf("Compacted model should have 4 rows, got %d", m.idLimit())
+	}
+	for i, word := range order {
+		if id, ok := m.ID(word); !ok || id != i || m.Word(i) != word ||
+			!slices.Equal(m.VectorByID(i), m.Vector(word)) {
+			t.Errorf("ID of %q should be %d after Compact, got %d", word, i,
+				id)
+		}
+	}
+	if words := slices.Collect(m.Words()); !slices.Equal(words, order) {
+		t.Errorf("Words should be %v after Compact, got %v", order, words)
+	}
+	if !slices.Equal(m.Vector("dog"), []float32{1, 1, 1}) {
+		t.Errorf("Vector of dog should be kept by Compact, got %v",
+			m.Vector("dog"))
+	}
+
+	q := NewIntModel[int8]()
+	if err := q.SetFloat("cat", []float64{0.5}); err == nil {
+		t.Error("Expected error for SetFloat without a shift")
+	}
+	// A load that fails on its header doesn't set the shift
+	err = q.LoadPlain(strings.NewReader("not a header\n"), WithHeader(true),
+		WithMaxMagnitude(1))
+	if err == nil {
+		t.Fatal("Expected error for a plaintext model with a bad header")
+	}
+	if q.Shift() != 0 || q.SetFloat("cat", []float64{0.5}) == nil {
+		t.Errorf("Failed load should not set the shift, got %d", q.Shift())
+	}
+	err = q.LoadPlain(strings.NewReader(testPlain(false)),
+		WithMaxMagnitude(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := q.SetFloat("horse", []float64{0.5, -1.5, 1}); err != nil {
+		t.Fatal(err)
+	}
+	want := QuantizeFloatVector[int8](NewFloatVector([]float64{0.5, -1.5, 1}),
+		q.Shift())
+	if got := q.Vector("horse"); !slices.Equal(got, want.Scalars()) {
+		t.Errorf("SetFloat should quantize to %v, got %v", want.Scalars(),
+			got)
+	}
+	if err := q.SetFloat("horse", []float64{0.5, -100, 1}); err == nil {
+		t.Error("Expected error for a scalar out of the range of the shift")
+	}
+	// The shift outlives the words it was loaded with
+	for word := range q.Words() {
+		q.Delete(word)
+	}
+	q.Compact()
+	if err := q.SetFloat("horse", []float64{0.5, -1.5, 1}); err != nil {
+		t.Errorf("SetFloat should keep the shift after deleting every word, "+
+			"got %v", err)
+	}
+}
+
+func TestConcurrentMutation(t *testing.T) {
+	m := NewIntModel[int16]()
+	err := m.LoadPlain(strings.NewReader(testRandomPlain(2000, 8, 8)),
+		WithMaxMagnitude(4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := NewHNSW(m, HNSWConfig{Seed: 8})
+	ix, err := BuildIVFPQ(m, IVFPQConfig{NList: 8, M: 4, Rerank: 20,
+		Iterations: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := range 200 {
+			// Words of the index are overwritten in place while it searches
+			m.SetFloat("w5", []float64{0, 1, 0, 0, 0, 0, 0, float64(i%3) - 1})
+			word := fmt.Sprintf("new%d", i)
+			m.SetFloat(word, []float64{1, 0, 0, 0, 0, 0, 0, float64(i%3) - 1})
+			if i%2 == 0 {
+				m.Delete(word)
+			}
+		}
+	}()
+	for range 20 {
+		if _, err := h.SearchWord("w5", 5); err != nil {
+			t.Error(err)
+		}
+		if _, err := ix.SearchWord("w5", 5); err != nil {
+			t.Error(err)
+		}
+		if _, err := NNearest(m, "w1", 5); err != nil {
+			t.Error(err)
+		}
+		if _, err := BatchNNearest(m, []string{"w2", "w3"}, 5); err != nil {
+			t.Error(err)
+		}
+
+		m.Similarity("w1", "new1")
+		for word := range m.Words() {
+			m.Vector(word)
+		}
+	}
+	<-done
+	if m.VocabularySize() != 2100 {
+		t.Errorf("Model should have 2100 words, got %d", m.VocabularySize())
+	}
+}
+
+func TestMissingWords(t *testing.T) {
+	m := NewFloatModel[float32]()
+	if err := m.LoadPlain(strings.NewReader(testPlain(false))); err != nil {
+		t.Fatal(err)
+	}
+	if v, ok := m.Lookup("cat"); !ok || !slices.Equal(v, testVectors[0]) {
+		t.Errorf("Lookup of cat should be %v, got %v", testVectors[0], v)
+	}
+	if v, ok := m.Lookup("horse"); ok || v != nil {
+		t.Errorf("Lookup of a missing word should fail, got %v", v)
+	}
+	if _, err := m.SimilarityE("cat", "horse"); !errors.Is(err,
+		ErrWordNotFound) {
+		t.Errorf("Expected ErrWordNotFound, got %v", err)
+	}
+	if s, err := m.SimilarityE("cat", "dog"); err != nil ||
+		s != m.Similarity("cat", "dog") {
+		t.Errorf("SimilarityE should match Similarity, got %v %v", s, err)
+	}
+	if _, err := NNearest(m, "horse", 1); !errors.Is(err, ErrWordNotFound) {
+		t.Errorf("NNearest of a missing word should fail with "+
+			"ErrWordNotFound, got %v", err)
+	}
+
+	// road is dissimilar to cat, so horse outranks it with a score of 0
+	vocab := []string{"road", "horse", "dog"}
+	ctx := context.Background()
+	for policy, want := range map[MissingPolicy][]string{
+		MissingRank: {"dog", "horse"},
+		MissingSkip: {"dog", "road"},
+	} {
+		nearest, err := NNearestInContext(ctx, m, "cat", vocab, 2,
+			WithMissing(policy))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !slices.Equal(nearest, want) {
+			t.Errorf("Policy %d should find %v, got %v", policy, want,
+				nearest)
+		}
+	}
+	_, err := NNearestInContext(ctx, m, "cat", vocab, 2,
+		WithMissing(MissingError))
+	if !errors.Is(err, ErrWordNotFound) {
+		t.Errorf("MissingError should fail with ErrWordNotFound, got %v", err)
+	}
+	// The policy only applies to candidates
+	for _, policy := range []MissingPolicy{MissingRank, MissingSkip} {
+		_, err = NNearestInContext(ctx, m, "horse", vocab[:1], 1,
+			WithMissing(policy))
+		if !errors.Is(err, ErrWordNotFound) {
+			t.Errorf("Policy %d with a missing query should fail with "+
+				"ErrWordNotFound, got %v", policy, err)
+		}
+	}
+}
+
+// collectAll collects the words and copies of the vectors of a model
+func collectAll[T VectorScalar](m Embedding[T]) ([]string, [][]T) {
+	var words []string
+	var vectors [][]T
+	for word, vector := range m.All() {
+		words = append(words, word)
+		vectors = append(vectors, slices.Clone(vector))
+	}
+	return words, vectors
+}
+
+func TestAll(t *testing.T) {
+	m := NewFloatModel[float32]()
+	if err := m.LoadPlain(strings.NewReader(testPlain(false))); err != nil {
+		t.Fatal(err)
+	}
+	words, vectors := collectAll[float32](m)
+	if !slices.Equal(words, testWords) {
+		t.Errorf("All should yield %v, got %v", testWords, words)
+	}
+	for i := range vectors {
+		if !slices.Equal(vectors[i], testVectors[i]) {
+			t.Errorf("All should yield %v for %s, got %v", testVectors[i],
+				words[i], vectors[i])
+		}
+	}
+	for word := range m.All() {
+		if word != testWords[0] {
+			t.Errorf("All should stop after %s, got %s", testWords[0], word)
+		}
+		break
+	}
+
+	q := NewIntModel[int16]()
+	err := q.LoadPlain(strings.NewReader(testPlain(false)),
+		WithMaxMagnitude(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := t.TempDir() + "/model.gowe"
+	if err := q.WriteNativeFile(p); err != nil {
+		t.Fatal(err)
+	}
+	mm, err := OpenMappedModel[int16](p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mm.Close()
+	qWords, qVectors := collectAll[int16](q)
+	mWords, mVectors := collectAll[int16](mm)
+	if !slices.Equal(qWords, testWords) || !slices.Equal(mWords, testWords) {
+		t.Errorf("All should yield %v, got %v and %v", testWords, qWords,
+			mWords)
+	}
+	for i, word := range qWords {
+		if !slices.Equal(qVectors[i], q.Vector(word)) ||
+			!slices.Equal(mVectors[i], q.Vector(word)) {
+			t.Errorf("All should yield %v for %s, got %v and %v",
+				q.Vector(word), word, qVectors[i], mVectors[i])
+		}
+	}
+}
@@ -0,0 +1,614 @@
+/*
+
+Copyright (C) 2024 Jackie Deng
+
+Permission to use, copy, modify, and/or distribute this software for any
+purpose with or without fee is hereby granted.
+
+THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES WITH
+REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF MERCHANTABILITY AND
+FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY SPECIAL, DIRECT,
+INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES WHATSOEVER RESULTING FROM
+LOSS OF USE, DATA OR PROFITS, WHETHER IN AN ACTION OF CONTRACT, NEGLIGENCE OR
+OTHER TORTIOUS ACTION, ARISING OUT OF OR IN CONNECTION WITH THE USE OR
+PERFORMANCE OF THIS SOFTWARE.
+
+*/
+
+package gowe
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/bits"
+	"slices"
+	"strings"
+	"unsafe"
+)
+
+/** Native Format **/
+
+// The native gowe format stores a model exactly as it is held in memory so
+// that it can be loaded without parsing or quantizing any scalars. All
+// integers are little endian and the file is laid out as:
+//
+//	header[64]   magic "GOWE", version, scalar type, shift, dim, vocabulary
+//	             size, metadata length and the offsets of the sections below
+//	metadata     count, then a length prefixed key and value for each entry
+//	vectors      size*dim scalars, aligned to 64 bytes
+//	word offsets size+1 uint64 offsets into the word bytes, aligned to 8
+//	word bytes   every word concatenated
+//	index        size uint32 word ids sorted by word, aligned to 8
+//
+// The fixed layout allows the vectors and words to be used directly from a
+// memory mapped file.
+const (
+	nativeMagic      = "GOWE"
+	nativeVersion    = uint16(1)
+	nativeHeaderSize = 64
+	nativeAlignment  = 64
+)
+
+type scalarType uint8
+
+const (
+	scalarFloat32 scalarType = iota + 1
+	scalarFloat64
+	scalarInt8
+	scalarInt16
+	scalarInt32
+)
+
+func (s scalarType) String() string {
+	switch s {
+	case scalarFloat32:
+		return "float32"
+	case scalarFloat64:
+		return "float64"
+	case scalarInt8:
+		return "int8"
+	case scalarInt16:
+		return "int16"
+	case scalarInt32:
+		return "int32"
+	}
+	return fmt.Sprintf("scalarType(%d)", uint8(s))
+}
+
+// size returns the size of a scalar in bytes
+func (s scalarType) size() int {
+	switch s {
+	case scalarInt8:
+		return 1
+	case scalarInt16:
+		return 2
+	case scalarFloat32, scalarInt32:
+		return 4
+	}
+	return 8
+}
+
+func scalarTypeOf[T VectorScalar]() scalarType {
+	var t T
+	switch any(t).(type) {
+	case float32:
+		return scalarFloat32
+	case float64:
+		return scalarFloat64
+	case int8:
+		return scalarInt8
+	case int16:
+		return scalarInt16
+	default:
+		return scalarInt32
+	}
+}
+
+type nativeHeader struct {
+	version    uint16
+	scalar     scalarType
+	shift      uint8
+	dim        uint32
+	size       uint64
+	metaLen    uint64
+	vectorsOff uint64
+	wordsOff   uint64
+	indexOff   uint64
+}
+
+// wordBytesOff is the offset of the word bytes that follow the word offsets
+func (h *nativeHeader) wordBytesOff() uint64 {
+	return h.wordsOff + (h.size+1)*8
+}
+
+func (h *nativeHeader) marshal() []byte {
+	b := make([]byte, nativeHeaderSize)
+	copy(b, nativeMagic)
+	binary.LittleEndian.PutUint16(b[4:], h.version)
+	b[6] = byte(h.scalar)
+	b[7] = h.shift
+	binary.LittleEndian.PutUint32(b[8:], h.dim)
+	binary.LittleEndian.PutUint64(b[16:], h.size)
+	binary.LittleEndian.PutUint64(b[24:], h.metaLen)
+	binary.LittleEndian.PutUint64(b[32:], h.vectorsOff)
+	binary.LittleEndian.PutUint64(b[40:], h.wordsOff)
+	binary.LittleEndian.PutUint64(b[48:], h.indexOff)
+	return b
+}
+
+func unmarshalNativeHeader(b []byte) (nativeHeader, error) {
+	var h nativeHeader
+	if len(b) < nativeHeaderSize || string(b[:4]) != nativeMagic {
+		return h, errors.New("Not a native gowe model")
+	}
+	h.version = binary.LittleEndian.Uint16(b[4:])
+	if h.version != nativeVersion {
+		return h, fmt.Errorf("Unsupported native gowe model version %d",
+			h.version)
+	}
+	h.scalar = scalarType(b[6])
+	if h.scalar < scalarFloat32 || h.scalar > scalarInt32 {
+		return h, fmt.Errorf("Invalid scalar type %d in native gowe model",
+			b[6])
+	}
+	h.shift = b[7]
+	h.dim = binary.LittleEndian.Uint32(b[8:])
+	h.size = binary.LittleEndian.Uint64(b[16:])
+	h.metaLen = binary.LittleEndian.Uint64(b[24:])
+	h.vectorsOff = binary.LittleEndian.Uint64(b[32:])
+	h.wordsOff = binary.LittleEndian.Uint64(b[40:])
+	h.indexOff = binary.LittleEndian.Uint64(b[48:])
+	if err := h.validate(); err != nil {
+		return h, err
+	}
+	return h, nil
+}
+
+// validate checks that the size and dim of a header fit its sections, which
+// must follow each other in order, with overflow safe arithmetic so that a
+// corrupt header can't size an allocation or a slice of a mapped file
+func (h *nativeHeader) validate() error {
+	if h.dim > maxDimensions || (h.dim == 0 && h.size > 0) {
+		return fmt.Errorf("%w, native gowe model has %d dimensions",
+			ErrBadHeader, h.dim)
+	}
+	// Float scalars aren't quantized, and ints can't shift past their bits
+	isFloat := h.scalar == scalarFloat32 || h.scalar == scalarFloat64
+	if (isFloat && h.shift != 0) || int(h.shift) >= h.scalar.size()*8 {
+		return fmt.Errorf("%w, native gowe model of %s has a shift of %d",
+			ErrBadHeader, h.scalar, h.shift)
+	}
+	// Word ids are stored as uint32 in the index
+	if h.size > math.MaxUint32 {
+		return fmt.Errorf("%w, native gowe model has %d words", ErrBadHeader,
+			h.size)
+	}
+
+	// size and dim are bounded above so these products can't overflow
+	vectorsLen := h.size * uint64(h.dim) * uint64(h.scalar.size())
+	metaEnd, ok1 := addUint64(nativeHeaderSize, h.metaLen)
+	vectorsEnd, ok2 := addUint64(h.vectorsOff, vectorsLen)
+	offsetsEnd, ok3 := addUint64(h.wordsOff, (h.size+1)*8)
+	_, ok4 := addUint64(h.indexOff, h.size*4)
+	if !ok1 || !ok2 || !ok3 || !ok4 || h.vectorsOff < metaEnd ||
+		h.wordsOff < vectorsEnd || h.indexOff < offsetsEnd {
+		return fmt.Errorf("%w, invalid section offsets in native gowe model",
+			ErrBadHeader)
+	}
+	if h.vectorsOff%uint64(h.scalar.size()) != 0 || h.wordsOff%8 != 0 ||
+		h.indexOff%8 != 0 {
+		return fmt.Errorf("%w, misaligned sections in native gowe model",
+			ErrBadHeader)
+	}
+	return nil
+}
+
+// addUint64 returns a+b and whether it didn't overflow
+func addUint64(a, b uint64) (uint64, bool) {
+	sum, carry := bits.Add64(a, b, 0)
+	return sum, carry == 0
+}
+
+func alignUp(n, alignment uint64) uint64 {
+	return (n + alignment - 1) / alignment * alignment
+}
+
+// littleEndianHost is true if scalars can be copied to and from the native
+// format without swapping bytes
+var littleEndianHost = func() bool {
+	x := uint16(1)
+	return *(*byte)(unsafe.Pointer(&x)) == 1
+}()
+
+// scalarBytes views a slice of scalars as its underlying bytes
+func scalarBytes[T VectorScalar](s []T) []byte {
+	if len(s) == 0 {
+		return nil
+	}
+	return unsafe.Slice((*byte)(unsafe.Pointer(&s[0])),
+		len(s)*int(unsafe.Sizeof(s[0])))
+}
+
+// writeScalars writes s in little endian order
+func writeScalars[T VectorScalar](w io.Writer, s []T) error {
+	if littleEndianHost {
+		_, err := w.Write(scalarBytes(s))
+		return err
+	}
+	return binary.Write(w, binary.LittleEndian, s)
+}
+
+// readScalars fills s from scalars in r of the given byte order
+func readScalars[T VectorScalar](r io.Reader, s []T,
+	order binary.ByteOrder) error {
+
+	if littleEndianHost && order == binary.LittleEndian {
+		_, err := io.ReadFull(r, scalarBytes(s))
+		return err
+	}
+	// Decode in chunks so that a large model isn't buffered twice
+	const chunk = 1 << 14
+	for len(s) > 0 {
+		n := min(len(s), chunk)
+		if err := binary.Read(r, order, s[:n]); err != nil {
+			return err
+		}
+		s = s[n:]
+	}
+	return nil
+}
+
+// writeNative writes a model in the native format, vector must return a
+// vector of dim scalars for each of words.
+func writeNative[T VectorScalar](w io.Writer, dim uint, shift uint8,
+	words []string, vector func(word string) []T,
+	meta map[string]string) error {
+
+	keys := make([]string, 0, len(meta))
+	metaLen := uint64(4)
+	for key, value := range meta {
+		keys = append(keys, key)
+		metaLen += uint64(8 + len(key) + len(value))
+	}
+	slices.Sort(keys)
+
+	var t T
+	size := uint64(len(words))
+	wordBytesLen := uint64(0)
+	for _, word := range words {
+		wordBytesLen += uint64(len(word))
+	}
+	h := nativeHeader{
+		version: nativeVersion,
+		scalar:  scalarTypeOf[T](),
+		shift:   shift,
+		dim:     uint32(dim),
+		size:    size,
+		metaLen: metaLen,
+	}
+	h.vectorsOff = alignUp(nativeHeaderSize+metaLen, nativeAlignment)
+	h.wordsOff = alignUp(
+		h.vectorsOff+size*uint64(dim)*uint64(unsafe.Sizeof(t)), 8)
+	h.indexOff = alignUp(h.wordBytesOff()+wordBytesLen, 8)
+
+	bw := bufio.NewWriter(w)
+	offset := uint64(0)
+	write := func(b []byte) {
+		bw.Write(b)
+		offset += uint64(len(b))
+	}
+	pad := func(to uint64) {
+		write(make([]byte, to-offset))
+	}
+	u32 := func(n uint32) {
+		write(binary.LittleEndian.AppendUint32(nil, n))
+	}
+
+	write(h.marshal())
+	u32(uint32(len(keys)))
+	for _, key := range keys {
+		u32(uint32(len(key)))
+		write([]byte(key))
+		u32(uint32(len(meta[key])))
+		write([]byte(meta[key]))
+	}
+
+	pad(h.vectorsOff)
+	for _, word := range words {
+		v := vector(word)
+		if uint(len(v)) != dim {
+			return fmt.Errorf("Vector for %q has %d dimensions but model "+
+				"has %d", word, len(v), dim)
+		}
+		if err := writeScalars(bw, v); err != nil {
+			return err
+		}
+		offset += uint64(len(v)) * uint64(unsafe.Sizeof(t))
+	}
+
+	pad(h.wordsOff)
+	wordOffset := uint64(0)
+	write(binary.LittleEndian.AppendUint64(nil, 0))
+	for _, word := range words {
+		wordOffset += uint64(len(word))
+		write(binary.LittleEndian.AppendUint64(nil, wordOffset))
+	}
+	for _, word := range words {
+		write([]byte(word))
+	}
+
+	pad(h.indexOff)
+	index := make([]uint32, size)
+	for i := range index {
+		index[i] = uint32(i)
+	}
+	slices.SortFunc(index, func(a, b uint32) int {
+		return strings.Compare(words[a], words[b])
+	})
+	for _, id := range index {
+		u32(id)
+	}
+
+	return bw.Flush()
+}
+
+// readNativeHeader reads the header and metadata of a native model
+func readNativeHeader(br *bufio.Reader) (nativeHeader, map[string]string,
+	error) {
+
+	b := make([]byte, nativeHeaderSize)
+	if _, err := io.ReadFull(br, b); err != nil {
+		return nativeHeader{}, nil, errors.Join(
+			errors.New("Could not read native gowe header"), err)
+	}
+	h, err := unmarshalNativeHeader(b)
+	if err != nil {
+		return h, nil, err
+	}
+
+	// The metadata is read as it arrives rather than allocated from the
+	// header, which may be lying
+	metaBytes, err := io.ReadAll(io.LimitReader(br, int64(min(h.metaLen,
+		math.MaxInt64))))
+	if err == nil && uint64(len(metaBytes)) < h.metaLen {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return h, nil, nativeReadError("metadata", err)
+	}
+	next := func() (string, bool) {
+		if len(metaBytes) < 4 {
+			return "", false
+		}
+		n := binary.LittleEndian.Uint32(metaBytes)
+		if uint64(len(metaBytes)-4) < uint64(n) {
+			return "", false
+		}
+		s := string(metaBytes[4 : 4+n])
+		metaBytes = metaBytes[4+n:]
+		return s, true
+	}
+	if len(metaBytes) < 4 {
+		return h, nil, errors.New("Invalid native gowe metadata")
+	}
+	count := binary.LittleEndian.Uint32(metaBytes)
+	metaBytes = metaBytes[4:]
+	meta := make(map[string]string)
+	for range count {
+		key, ok := next()
+		value, ok2 := next()
+		if !ok || !ok2 {
+			return h, nil, errors.New("Invalid native gowe metadata")
+		}
+		meta[key] = value
+	}
+	return h, meta, nil
+}
+
+// nativeChunk is the number of scalars or offsets a native model is read in
+// at once, so that memory is only allocated for data that is actually there
+const nativeChunk = 1 << 16
+
+// nativeReadError reports an error reading a section of a native model, the
+// end of the stream means the model is truncated
+func nativeReadError(section string, err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = ErrTruncated
+	}
+	return fmt.Errorf("Could not read native gowe %s: %w", section, err)
+}
+
+// readNativeChunks reads n values with read in chunks of nativeChunk,
+// growing the slice as they arrive
+func readNativeChunks[T any](n uint64, read func(s []T) error) ([]T, error) {
+	s := make([]T, 0, min(n, nativeChunk))
+	for uint64(len(s)) < n {
+		k := int(min(n-uint64(len(s)), nativeChunk))
+		s = slices.Grow(s, k)
+		if err := read(s[len(s) : len(s)+k]); err != nil {
+			return nil, err
+		}
+		s = s[:len(s)+k]
+	}
+	return s, nil
+}
+
+// readNativeWords reads the word offsets and bytes of a native model from
+// br, which must be at the start of the words section
+func readNativeWords(br *bufio.Reader, h nativeHeader) ([]string, error) {
+	wordOffsets, err := readNativeChunks(h.size+1, func(s []uint64) error {
+		return binary.Read(br, binary.LittleEndian, s)
+	})
+	if err != nil {
+		return nil, nativeReadError("words", err)
+	}
+	// The word bytes end before the index
+	wordBytesLen := h.indexOff - h.wordBytesOff()
+	if wordOffsets[0] != 0 || !slices.IsSorted(wordOffsets) ||
+		wordOffsets[h.size] > wordBytesLen {
+		return nil, fmt.Errorf("%w, invalid native gowe word offsets",
+			ErrBadHeader)
+	}
+	wordBytes, err := readNativeChunks(wordOffsets[h.size],
+		func(s []byte) error {
+			_, err := io.ReadFull(br, s)
+			return err
+		})
+	if err != nil {
+		return nil, nativeReadError("words", err)
+	}
+	// One string is shared by every word to avoid an allocation per word
+	all := string(wordBytes)
+	words := make([]string, h.size)
+	for i := range words {
+		words[i] = all[wordOffsets[i]:wordOffsets[i+1]]
+	}
+	return words, nil
+}
+
+// readNativeWordsAt reads the words of a native model ahead of its vectors
+// if src can be read at offsets and isn't compressed, otherwise it returns
+// nil
+func readNativeWordsAt(src io.Reader, h nativeHeader) ([]string, error) {
+	ra, ok := src.(interface {
+		io.ReaderAt
+		io.Seeker
+	})
+	if !ok {
+		return nil, nil
+	}
+	base, err := ra.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, nil
+	}
+	magic := make([]byte, len(nativeMagic))
+	if _, err := ra.ReadAt(magic, base); err != nil ||
+		string(magic) != nativeMagic {
+		return nil, nil
+	}
+	section := io.NewSectionReader(ra, base+int64(h.wordsOff),
+		int64(h.indexOff-h.wordsOff))
+	return readNativeWords(bufio.NewReader(section), h)
+}
+
+// readNativeRows adds the rows of a native model that pass a filter to a
+// store, converting them from scalars of type T with convert. br must be
+// just past the metadata, and src is the stream it reads from.
+//
+// Skipped rows are never allocated. The words follow the vectors, so a
+// filter that checks words needs them to be read first from a src that can
+// be read at offsets, such as an uncompressed file. From other streams all
+// the rows are read before they are filtered. It returns the number of words
+// added.
+func readNativeRows[S, T VectorScalar](src io.Reader, br *bufio.Reader,
+	h nativeHeader, store *vectorStore[S], filter *LoadFilter,
+	convert func(dst []S, src []T)) (int, error) {
+
+	offset := uint64(nativeHeaderSize) + h.metaLen
+	skip := func(to uint64) error {
+		_, err := br.Discard(int(to - offset))
+		offset = to
+		return err
+	}
+	rowLen := uint64(h.dim) * uint64(unsafe.Sizeof(*new(T)))
+	start := store.len()
+
+	if err := skip(h.vectorsOff); err != nil {
+		return 0, nativeReadError("vectors", err)
+	}
+	var words []string
+	if filter.checksWords() {
+		var err error
+		if words, err = readNativeWordsAt(src, h); err != nil {
+			return 0, err
+		}
+	}
+	if words != nil {
+		// Each accepted row is read straight into the store, others are
+		// skipped over
+		scratch := make([]T, h.dim)
+		accepted := 0
+		for id, word := range words {
+			if filter.full(accepted) {
+				break
+			}
+			if !filter.accepts(word) {
+				continue
+			}
+			accepted++
+			if err := skip(h.vectorsOff + uint64(id)*rowLen); err != nil {
+				return 0, nativeReadError("vectors", err)
+			}
+			dst := store.addRow(word)
+			row, direct := any(dst).([]T)
+			if !direct {
+				row = scratch
+			}
+			if err := readScalars(br, row, binary.LittleEndian); err != nil {
+				return 0, nativeReadError("vectors", err)
+			}
+			offset += rowLen
+			if !direct {
+				convert(dst, row)
+			}
+		}
+		return store.len() - start, nil
+	}
+
+	// Without the words only the rows that a filter of MaxWords alone keeps
+	// are read, which are the first in file order
+	rows := h.size
+	if !filter.checksWords() {
+		rows = uint64(filter.capacity(uint(h.size)))
+	}
+	scalars, err := readNativeChunks(rows*uint64(h.dim), func(s []T) error {
+		return readScalars(br, s, binary.LittleEndian)
+	})
+	if err != nil {
+		return 0, nativeReadError("vectors", err)
+	}
+	offset += rows * rowLen
+	if err := skip(h.wordsOff); err != nil {
+		return 0, nativeReadError("words", err)
+	}
+	if words, err = readNativeWords(br, h); err != nil {
+		return 0, err
+	}
+	words = words[:rows]
+	if same, ok := any(scalars).([]S); ok && !filter.checksWords() {
+		store.addAll(words, same)
+		return store.len() - start, nil
+	}
+	if !filter.checksWords() {
+		store.reserve(uint(rows))
+	}
+	dim := int(h.dim)
+	for i, word := range words {
+		if filter.full(store.len() - start) {
+			break
+		}
+		if filter.accepts(word) {
+			convert(store.addRow(word), scalars[i*dim:(i+1)*dim])
+		}
+	}
+	return store.len() - start, nil
+}
+
+// readNativeFloats adds the rows of a native model whose scalars are of type
+// T to a store of floats, dequantizing integer scalars with the shift in the
+// header
+func readNativeFloats[F FloatScalar, T VectorScalar](src io.Reader,
+	br *bufio.Reader, h nativeHeader, store *vectorStore[F],
+	filter *LoadFilter) (int, error) {
+
+	scale := F(int64(1) << h.shift)
+	return readNativeRows(src, br, h, store, filter, func(dst []F, src []T) {
+		for i, s := range src {
+			dst[i] = F(s) / scale
+		}
+	})
+}
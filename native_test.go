@@ -0,0 +1,273 @@
+/*
+
+Copyright (C) 2024 Jackie Deng
+
+Permission to use, copy, modify, and/or distribute this software for any
+purpose with or without fee is hereby granted.
+
+THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES WITH
+REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF MERCHANTABILITY AND
+FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY SPECIAL, DIRECT,
+INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES WHATSOEVER RESULTING FROM
+LOSS OF USE, DATA OR PROFITS, WHETHER IN AN ACTION OF CONTRACT, NEGLIGENCE OR
+OTHER TORTIOUS ACTION, ARISING OUT OF OR IN CONNECTION WITH THE USE OR
+PERFORMANCE OF THIS SOFTWARE.
+
+*/
+
+package gowe
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestIntModelNativeRoundTrip(t *testing.T) {
+	m := NewIntModel[int8]()
+	err := m.FromPlainReader(strings.NewReader(testPlain(false)), false, 2.0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.SetMetadata("source", "test")
+
+	p := t.TempDir() + "/model.gowe"
+	if err := m.WriteNativeFile(p); err != nil {
+		t.Fatal(err)
+	}
+	q := NewIntModel[int8]()
+	if err := q.FromNativeFile(p); err != nil {
+		t.Fatal(err)
+	}
+	if q.Dimensions() != 3 || q.VocabularySize() != 3 {
+		t.Fatalf("Native model should be 3 words of 3 dimensions, got %d "+
+			"of %d", q.VocabularySize(), q.Dimensions())
+	}
+	if q.Shift() != m.Shift() {
+		t.Errorf("Native model should have shift %d, got %d", m.Shift(),
+			q.Shift())
+	}
+	if q.Metadata()["source"] != "test" {
+		t.Errorf("Native model should keep metadata, got %v", q.Metadata())
+	}
+	for _, word := range testWords {
+		if !slices.Equal(m.Vector(word), q.Vector(word)) {
+			t.Errorf("Vector for %q should round trip, got %v and %v", word,
+				m.Vector(word), q.Vector(word))
+		}
+	}
+
+	// The quantized scalars can be read back as floats
+	f := NewFloatModel[float32]()
+	if err := f.FromNativeFile(p); err != nil {
+		t.Fatal(err)
+	}
+	checkTestFloatModel(t, f)
+
+	// But not requantized to another int type
+	if err := NewIntModel[int16]().FromNativeFile(p); err == nil {
+		t.Error("Loading int8 native model into IntModel[int16] should fail")
+	}
+}
+
+func TestFloatModelNativeRoundTrip(t *testing.T) {
+	m := NewFloatModel[float64]()
+	err := m.FromPlainReader(strings.NewReader(testPlain(true)), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := m.WriteNativeTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(buf.Bytes(), []byte("GOWE")) {
+		t.Errorf("Native model should start with the magic bytes")
+	}
+	f := NewFloatModel[float32]()
+	if err := f.FromNativeReader(&buf); err != nil {
+		t.Fatal(err)
+	}
+	checkTestFloatModel(t, f)
+
+	err = NewFloatModel[float32]().FromNativeReader(
+		strings.NewReader(testPlain(true)))
+	if err == nil {
+		t.Error("Loading plaintext as a native model should fail")
+	}
+}
+
+// testNative returns the test model in the native format
+func testNative(t *testing.T) []byte {
+	m := NewFloatModel[float32]()
+	if err := m.LoadPlain(strings.NewReader(testPlain(false))); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := m.WriteNativeTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// withHeaderField returns a copy of a native model with the header field at
+// offset set to v, fields are uint32 at 8 and uint64 from 16
+func withHeaderField(data []byte, offset int, v uint64) []byte {
+	data = bytes.Clone(data)
+	if offset == 8 {
+		binary.LittleEndian.PutUint32(data[offset:], uint32(v))
+	} else {
+		binary.LittleEndian.PutUint64(data[offset:], v)
+	}
+	return data
+}
+
+func withByte(data []byte, offset int, v byte) []byte {
+	data = bytes.Clone(data)
+	data[offset] = v
+	return data
+}
+
+func TestNativeCorrupt(t *testing.T) {
+	data := testNative(t)
+	h, err := unmarshalNativeHeader(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A header declaring a billion words whose sections are consistent, but
+	// which has none of them
+	size := uint64(1 << 30)
+	wordsOff := alignUp(h.vectorsOff+size*uint64(h.dim)*4, 8)
+	huge := withHeaderField(data, 16, size)
+	huge = withHeaderField(huge, 40, wordsOff)
+	huge = withHeaderField(huge, 48, alignUp(wordsOff+(size+1)*8, 8))
+
+	for _, c := range []struct {
+		name string
+		data []byte
+		err  error
+	}{
+		{"huge dim", withHeaderField(data, 8, math.MaxUint32), ErrBadHeader},
+		{"float shift", withByte(data, 7, 3), ErrBadHeader},
+		{"zero dim", withHeaderField(data, 8, 0), ErrBadHeader},
+		{"huge size", withHeaderField(data, 16, 1<<40), ErrBadHeader},
+		{"max size", withHeaderField(data, 16, math.MaxUint64), ErrBadHeader},
+		{"size past offsets", withHeaderField(data, 16, 1000), ErrBadHeader},
+		{"huge metadata", withHeaderField(data, 24, math.MaxUint64),
+			ErrBadHeader},
+		{"misaligned vectors", withHeaderField(data, 32, h.vectorsOff+2),
+			ErrBadHeader},
+		{"overflowing index", withHeaderField(data, 48, math.MaxUint64-7),
+			ErrBadHeader},
+		{"bad word offset", withHeaderField(data, int(h.wordsOff)+8, 1<<40),
+			ErrBadHeader},
+		{"consistent but missing", huge, ErrTruncated},
+		{"truncated vectors", data[:h.vectorsOff+4], ErrTruncated},
+		{"truncated words", data[:h.wordsOff+4], ErrTruncated},
+		{"truncated word bytes", data[:h.wordBytesOff()+2], ErrTruncated},
+	} {
+		err := NewFloatModel[float32]().FromNativeReader(
+			bytes.NewReader(c.data))
+		if !errors.Is(err, c.err) {
+			t.Errorf("Loading native model with %s should fail with %v, "+
+				"got %v", c.name, c.err, err)
+		}
+	}
+
+	// Int scalars can't be shifted past their bits
+	q := NewIntModel[int8]()
+	err = q.LoadPlain(strings.NewReader(testPlain(false)),
+		WithMaxMagnitude(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := q.WriteNativeTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	for _, shift := range []byte{8, 200} {
+		corrupt := bytes.NewReader(withByte(buf.Bytes(), 7, shift))
+		err := NewFloatModel[float32]().LoadNative(corrupt)
+		if !errors.Is(err, ErrBadHeader) {
+			t.Errorf("Loading int8 native model with shift %d should fail "+
+				"with %v, got %v", shift, ErrBadHeader, err)
+		}
+	}
+}
+
+func TestNativeFilter(t *testing.T) {
+	data := testNative(t)
+	q := NewIntModel[int8]()
+	err := q.LoadPlain(strings.NewReader(testPlain(false)),
+		WithMaxMagnitude(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var quantized bytes.Buffer
+	if err := q.WriteNativeTo(&quantized); err != nil {
+		t.Fatal(err)
+	}
+	keep := WithKeep(func(word string) bool { return word != "cat" })
+
+	for _, c := range []struct {
+		name string
+		r    io.Reader
+		opts []LoadOption
+		want []string
+	}{
+		{"max words", bytes.NewReader(data), []LoadOption{WithMaxWords(2)},
+			[]string{"cat", "dog"}},
+		{"keep", bytes.NewReader(data), []LoadOption{keep, WithMaxWords(1)},
+			[]string{"dog"}},
+		{"keep from a stream", struct{ io.Reader }{bytes.NewReader(data)},
+			[]LoadOption{keep}, []string{"dog", "road"}},
+		{"quantized keep", bytes.NewReader(quantized.Bytes()),
+			[]LoadOption{keep}, []string{"dog", "road"}},
+	} {
+		m := NewFloatModel[float32]()
+		if err := m.LoadNative(c.r, c.opts...); err != nil {
+			t.Fatal(err)
+		}
+		if words := slices.Collect(m.Words()); !slices.Equal(words, c.want) {
+			t.Errorf("Native model with %s should load %v, got %v", c.name,
+				c.want, words)
+		}
+		for _, word := range c.want {
+			want := testVectors[slices.Index(testWords, word)]
+			if !slices.Equal(m.Vector(word), want) {
+				t.Errorf("Native model with %s should load %v for %q, got "+
+					"%v", c.name, want, word, m.Vector(word))
+			}
+		}
+	}
+
+	// Only the accepted rows are allocated when the words can be read ahead
+	// of the vectors
+	m := NewFloatModel[float32]()
+	err = m.LoadPlain(strings.NewReader(testRandomPlain(1000, 16, 1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var large bytes.Buffer
+	if err := m.WriteNativeTo(&large); err != nil {
+		t.Fatal(err)
+	}
+	for _, opt := range []LoadOption{WithMaxWords(10),
+		WithKeep(func(word string) bool { return len(word) == 2 })} {
+		f := NewFloatModel[float32]()
+		if err := f.LoadNative(bytes.NewReader(large.Bytes()),
+			opt); err != nil {
+			t.Fatal(err)
+		}
+		if f.VocabularySize() != 10 || cap(f.store.scalars) > 16*16 {
+			t.Errorf("Native model should load 10 words into at most %d "+
+				"scalars, got %d words in %d", 16*16, f.VocabularySize(),
+				cap(f.store.scalars))
+		}
+	}
+}
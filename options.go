@@ -0,0 +1,295 @@
+/*
+
+Copyright (C) 2024 Jackie Deng
+
+Permission to use, copy, modify, and/or distribute this software for any
+purpose with or without fee is hereby granted.
+
+THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES WITH
+REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF MERCHANTABILITY AND
+FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY SPECIAL, DIRECT,
+INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES WHATSOEVER RESULTING FROM
+LOSS OF USE, DATA OR PROFITS, WHETHER IN AN ACTION OF CONTRACT, NEGLIGENCE OR
+OTHER TORTIOUS ACTION, ARISING OUT OF OR IN CONNECTION WITH THE USE OR
+PERFORMANCE OF THIS SOFTWARE.
+
+*/
+
+package gowe
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"runtime"
+	"time"
+	"unicode"
+)
+
+/** Load Options **/
+
+// LoadFilter limits the words loaded from a model file, it is set with
+// WithFilter or the individual options such as WithMaxWords e.g.
+//
+//	model.LoadPlainFile("glove.840B.300d.txt",
+//		gowe.WithFilter(gowe.LoadFilter{MaxWords: 100000, LettersOnly: true}))
+//
+// The vectors of words that are filtered out are skipped without being parsed
+// or allocated.
+type LoadFilter struct {
+	// MaxWords stops loading after this many words have been loaded, so only
+	// the first words in file order are kept. Zero means no limit.
+	MaxWords int
+	// Allow only loads the words in the set if it isn't nil
+	Allow map[string]struct{}
+	// Keep only loads the words it returns true for if it isn't nil, it may
+	// be called concurrently when plaintext is parsed in parallel
+	Keep func(word string) bool
+	// LettersOnly skips words containing anything other than letters, such as
+	// digits or punctuation
+	LettersOnly bool
+}
+
+// accepts reports whether word passes the filter
+func (f *LoadFilter) accepts(word string) bool {
+	if f.Allow != nil {
+		if _, ok := f.Allow[word]; !ok {
+			return false
+		}
+	}
+	if f.LettersOnly {
+		for _, r := range word {
+			if !unicode.IsLetter(r) {
+				return false
+			}
+		}
+	}
+	if f.Keep != nil && !f.Keep(word) {
+		return false
+	}
+	return true
+}
+
+// empty reports whether the filter accepts every word
+func (f *LoadFilter) empty() bool {
+	return f.MaxWords <= 0 && !f.checksWords()
+}
+
+// checksWords reports whether the filter depends on the words themselves
+// rather than only on how many were loaded
+func (f *LoadFilter) checksWords() bool {
+	return f.Allow != nil || f.Keep != nil || f.LettersOnly
+}
+
+// full reports whether loaded words have reached the MaxWords limit
+func (f *LoadFilter) full(loaded int) bool {
+	return f.MaxWords > 0 && loaded >= f.MaxWords
+}
+
+// capacity bounds the number of words a model file of size words will add
+func (f *LoadFilter) capacity(size uint) uint {
+	if f.MaxWords > 0 {
+		return min(size, uint(f.MaxWords))
+	}
+	return size
+}
+
+// LoadOptions configures how model files are loaded, it is set with
+// LoadOption functions such as WithHeader and WithMaxMagnitude
+type LoadOptions struct {
+	// Header is whether a plaintext file starts with a "<size> <dim>"
+	// description, binary files always start with one
+	Header bool
+	// BitSize is the size of the floats in a binary file, 32 or 64
+	BitSize int
+	// ByteOrder is the byte order of the floats in a binary file
+	ByteOrder binary.ByteOrder
+	// MaxMagnitude is the maximum magnitude of any scalar, which is required
+	// to quantize into IntModels
+	MaxMagnitude float64
+	// Filter limits the words that are loaded
+	Filter LoadFilter
+	// Parallelism is the number of goroutines parsing plaintext, which
+	// defaults to GOMAXPROCS
+	Parallelism int
+	// Context stops loading with its error once it is done, the model keeps
+	// the words loaded until then
+	Context context.Context
+	// Progress is called with the number of words loaded, the bytes of the
+	// stream read and its size, or -1 if the size isn't known. It is called
+	// at most once every ProgressInterval, never concurrently, and once more
+	// when loading succeeds.
+	Progress         func(words, bytesRead, totalBytes int64)
+	ProgressInterval time.Duration
+
+	// ext is the file extension of the stream if it was opened from a file
+	ext     string
+	tracker *loadTracker
+}
+
+// LoadOption sets an option of LoadOptions
+type LoadOption func(o *LoadOptions)
+
+// newLoadOptions applies opts over the defaults, which are no plaintext
+// header, little endian float32 binaries and parsing plaintext on every
+// processor
+func newLoadOptions(opts []LoadOption) *LoadOptions {
+	o := &LoadOptions{
+		BitSize:     32,
+		ByteOrder:   binary.LittleEndian,
+		Parallelism: runtime.GOMAXPROCS(0),
+	}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
+// WithHeader sets whether a plaintext file starts with a "<size> <dim>"
+// description
+func WithHeader(header bool) LoadOption {
+	return func(o *LoadOptions) {
+		o.Header = header
+	}
+}
+
+// WithBitSize sets the size of the floats in a binary file, it defaults to 32
+// if it is not 64
+func WithBitSize(bitSize int) LoadOption {
+	return func(o *LoadOptions) {
+		o.BitSize = bitSize
+	}
+}
+
+// WithByteOrder sets the byte order of the floats in a binary file, which
+// defaults to binary.LittleEndian
+func WithByteOrder(order binary.ByteOrder) LoadOption {
+	return func(o *LoadOptions) {
+		o.ByteOrder = order
+	}
+}
+
+// WithMaxMagnitude sets the maximum magnitude of any scalar for quantizing
+// into IntModels, see QuantizationShift
+func WithMaxMagnitude(maxMagnitude float64) LoadOption {
+	return func(o *LoadOptions) {
+		o.MaxMagnitude = maxMagnitude
+	}
+}
+
+// WithParallelism sets the number of goroutines parsing plaintext, the
+// vectors are still added in file order. 1 parses on the calling goroutine.
+func WithParallelism(n int) LoadOption {
+	return func(o *LoadOptions) {
+		o.Parallelism = n
+	}
+}
+
+// WithContext stops loading plaintext and binary models with ctx.Err() once
+// ctx is done. It is checked between reads of the stream, which happen at
+// least every few megabytes.
+func WithContext(ctx context.Context) LoadOption {
+	return func(o *LoadOptions) {
+		o.Context = ctx
+	}
+}
+
+// WithProgress calls progress at most once every interval while loading
+// plaintext and binary models, and once more at the end e.g.
+//
+//	model.LoadPlainFile("glove.840B.300d.txt", gowe.WithProgress(
+//		func(words, bytesRead, totalBytes int64) {
+//			fmt.Printf("\r%d words, %d%%", words, 100*bytesRead/totalBytes)
+//		}, time.Second))
+//
+// bytesRead counts the bytes of the compressed stream for compressed models,
+// so that it can be compared to the size of the file.
+func WithProgress(progress func(words, bytesRead, totalBytes int64),
+	interval time.Duration) LoadOption {
+
+	return func(o *LoadOptions) {
+		o.Progress = progress
+		o.ProgressInterval = interval
+	}
+}
+
+// withExt sets the file extension of the stream, for detecting compression
+func withExt(ext string) LoadOption {
+	return func(o *LoadOptions) {
+		o.ext = ext
+	}
+}
+
+// WithFilter sets every field of the LoadFilter at once
+func WithFilter(filter LoadFilter) LoadOption {
+	return func(o *LoadOptions) {
+		o.Filter = filter
+	}
+}
+
+// WithMaxWords stops loading after n words, see LoadFilter.MaxWords
+func WithMaxWords(n int) LoadOption {
+	return func(o *LoadOptions) {
+		o.Filter.MaxWords = n
+	}
+}
+
+// WithAllowlist only loads the given words, see LoadFilter.Allow
+func WithAllowlist(words ...string) LoadOption {
+	return func(o *LoadOptions) {
+		o.Filter.Allow = make(map[string]struct{}, len(words))
+		for _, word := range words {
+			o.Filter.Allow[word] = struct{}{}
+		}
+	}
+}
+
+// WithKeep only loads the words keep returns true for, see LoadFilter.Keep
+func WithKeep(keep func(word string) bool) LoadOption {
+	return func(o *LoadOptions) {
+		o.Filter.Keep = keep
+	}
+}
+
+// WithLettersOnly skips words containing anything other than letters, see
+// LoadFilter.LettersOnly
+func WithLettersOnly() LoadOption {
+	return func(o *LoadOptions) {
+		o.Filter.LettersOnly = true
+	}
+}
+
+// legacyLoadOptions converts the untyped opts of the deprecated loaders, a
+// float64 is the maxMagnitude of IntModels and a LoadFilter filters the loaded
+// words
+func legacyLoadOptions(opts []interface{}) ([]LoadOption, error) {
+	var lopts []LoadOption
+	for _, opt := range opts {
+		switch opt := opt.(type) {
+		case float64:
+			lopts = append(lopts, WithMaxMagnitude(opt))
+		case LoadFilter:
+			lopts = append(lopts, WithFilter(opt))
+		case *LoadFilter:
+			if opt != nil {
+				lopts = append(lopts, WithFilter(*opt))
+			}
+		case LoadOption:
+			lopts = append(lopts, opt)
+		default:
+			return nil, fmt.Errorf("Invalid opt of type %T for loading model",
+				opt)
+		}
+	}
+	return lopts, nil
+}
+
+// checkMaxMagnitude checks that the options can quantize into IntModels
+func (o *LoadOptions) checkMaxMagnitude() error {
+	if o.MaxMagnitude <= 0 {
+		return errors.New("Missing maxMagnitude for parsing into IntModel, " +
+			"use WithMaxMagnitude")
+	}
+	return nil
+}
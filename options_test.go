@@ -0,0 +1,171 @@
+/*
+
+Copyright (C) 2024 Jackie Deng
+
+Permission to use, copy, modify, and/or distribute this software for any
+purpose with or without fee is hereby granted.
+
+THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES WITH
+REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF MERCHANTABILITY AND
+FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY SPECIAL, DIRECT,
+INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES WHATSOEVER RESULTING FROM
+LOSS OF USE, DATA OR PROFITS, WHETHER IN AN ACTION OF CONTRACT, NEGLIGENCE OR
+OTHER TORTIOUS ACTION, ARISING OUT OF OR IN CONNECTION WITH THE USE OR
+PERFORMANCE OF THIS SOFTWARE.
+
+*/
+
+package gowe
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestLoadFilter(t *testing.T) {
+	plain := "4 2\nthe 1 0\nr2d2 0 1\ncat 1 1\ndog 0.5 0.5\n"
+	filters := []struct {
+		filter LoadFilter
+		words  []string
+	}{
+		{LoadFilter{MaxWords: 2}, []string{"the", "r2d2"}},
+		{LoadFilter{LettersOnly: true}, []string{"the", "cat", "dog"}},
+		{LoadFilter{MaxWords: 2, LettersOnly: true}, []string{"the", "cat"}},
+		{LoadFilter{Allow: map[string]struct{}{"dog": {}, "cat": {}}},
+			[]string{"cat", "dog"}},
+		{LoadFilter{Keep: func(word string) bool {
+			return strings.HasPrefix(word, "d")
+		}}, []string{"dog"}},
+	}
+
+	for _, f := range filters {
+		m := NewFloatModel[float32]()
+		err := m.FromPlainReader(strings.NewReader(plain), true, f.filter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if words := slices.Collect(m.Words()); !slices.Equal(words, f.words) {
+			t.Errorf("Plaintext filtered by %+v should load %v, got %v",
+				f.filter, f.words, words)
+		}
+
+		var buf bytes.Buffer
+		all := NewFloatModel[float32]()
+		all.FromPlainReader(strings.NewReader(plain), true)
+		all.WriteBinaryTo(&buf, 32)
+		im := NewIntModel[int8]()
+		err = im.FromBinaryReader(&buf, 32, 1.0, &f.filter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if words := slices.Collect(im.Words()); !slices.Equal(words, f.words) {
+			t.Errorf("Binary filtered by %+v should load %v, got %v",
+				f.filter, f.words, words)
+		}
+		for _, word := range f.words {
+			if !slices.Equal(im.Vector(word), all.quantizedForTest(word)) {
+				t.Errorf("Filtered vector for %q should be unchanged", word)
+			}
+		}
+	}
+
+	// The first line is filtered too when there is no description
+	m := NewIntModel[int16]()
+	err := m.FromPlainReader(strings.NewReader(plain[4:]), false, 1.0,
+		LoadFilter{LettersOnly: true, MaxWords: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if words := slices.Collect(m.Words()); !slices.Equal(words,
+		[]string{"the"}) {
+		t.Errorf("Plaintext filtered without description should load "+
+			"[the], got %v", words)
+	}
+
+	err = NewFloatModel[float32]().FromPlainReader(strings.NewReader(plain),
+		true, "100000")
+	if err == nil {
+		t.Error("Loading with an opt of an unknown type should fail")
+	}
+}
+
+// quantizedForTest quantizes a vector the way IntModel[int8] does with a
+// maxMagnitude of 1.0
+func (m *FloatModel[F]) quantizedForTest(word string) []int8 {
+	return QuantizeFloatVector[int8](FloatVector[F]{scalars: m.Vector(word)},
+		QuantizationShift[int8](1.0)).scalars
+}
+
+func TestLoadOptions(t *testing.T) {
+	m := NewFloatModel[float32]()
+	err := m.LoadPlain(strings.NewReader(testPlain(true)), WithHeader(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkTestFloatModel(t, m)
+
+	// Big endian float64 binary
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%d %d\n", len(testWords), len(testVectors[0]))
+	for i, word := range testWords {
+		buf.WriteString(word + " ")
+		for _, f := range testVectors[i] {
+			binary.Write(&buf, binary.BigEndian, float64(f))
+		}
+	}
+	data := buf.Bytes()
+	m = NewFloatModel[float32]()
+	err = m.LoadBinary(bytes.NewReader(data), WithBitSize(64),
+		WithByteOrder(binary.BigEndian))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkTestFloatModel(t, m)
+
+	im := NewIntModel[int16]()
+	err = im.LoadBinary(bytes.NewReader(data), WithBitSize(64),
+		WithByteOrder(binary.BigEndian), WithMaxMagnitude(2.0),
+		WithAllowlist("dog", "road"), WithMaxWords(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if words := slices.Collect(im.Words()); !slices.Equal(words,
+		[]string{"dog"}) {
+		t.Errorf("Binary loaded with options should have [dog], got %v",
+			words)
+	}
+
+	im = NewIntModel[int16]()
+	err = im.LoadPlain(strings.NewReader(testPlain(false)),
+		WithMaxMagnitude(2.0), WithLettersOnly(),
+		WithKeep(func(word string) bool { return word != "cat" }))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if words := slices.Collect(im.Words()); !slices.Equal(words,
+		[]string{"dog", "road"}) {
+		t.Errorf("Plaintext loaded with options should have [dog road], "+
+			"got %v", words)
+	}
+
+	err = NewIntModel[int8]().LoadPlain(strings.NewReader(testPlain(false)))
+	if err == nil {
+		t.Error("IntModel should require WithMaxMagnitude")
+	}
+
+	// LoadOptions can also be passed through the deprecated loaders
+	im = NewIntModel[int16]()
+	err = im.FromPlainReader(strings.NewReader(testPlain(false)), false,
+		WithMaxMagnitude(2.0), WithMaxWords(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if im.VocabularySize() != 2 {
+		t.Errorf("Deprecated loader with options should load 2 words, got %d",
+			im.VocabularySize())
+	}
+}
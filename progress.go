@@ -0,0 +1,163 @@
+/*
+
+Copyright (C) 2024 Jackie Deng
+
+Permission to use, copy, modify, and/or distribute this software for any
+purpose with or without fee is hereby granted.
+
+THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES WITH
+REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF MERCHANTABILITY AND
+FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY SPECIAL, DIRECT,
+INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES WHATSOEVER RESULTING FROM
+LOSS OF USE, DATA OR PROFITS, WHETHER IN AN ACTION OF CONTRACT, NEGLIGENCE OR
+OTHER TORTIOUS ACTION, ARISING OUT OF OR IN CONNECTION WITH THE USE OR
+PERFORMANCE OF THIS SOFTWARE.
+
+*/
+
+package gowe
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+)
+
+/** Load Progress **/
+
+// loadTracker wraps the stream of a load to stop it once its context is done
+// and to report its progress
+type loadTracker struct {
+	r        io.Reader
+	ctx      context.Context
+	progress func(words, bytesRead, totalBytes int64)
+	interval time.Duration
+	// total is the size of the stream or -1 if it isn't known
+	total int64
+	read  int64
+	last  time.Time
+	// words is set by the goroutine adding words while Read may be called
+	// by another
+	words atomic.Int64
+	// finished is set once the final progress has been reported, as a load
+	// that passes its tracker on finishes along with the inner load
+	finished bool
+}
+
+// track wraps r for the context and progress of o, a load that is passed
+// the tracker of another with withTracker keeps using it
+func (o *LoadOptions) track(r io.Reader) (io.Reader, error) {
+	if o.tracker != nil || (o.Context == nil && o.Progress == nil) {
+		return r, nil
+	}
+	ctx := o.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	o.tracker = &loadTracker{r: r, ctx: ctx, progress: o.Progress,
+		interval: o.ProgressInterval, total: streamSize(r), last: time.Now()}
+	return o.tracker, nil
+}
+
+// open tracks and decompresses the stream of a load, finish must be called
+// with the result of the load
+func (o *LoadOptions) open(r io.Reader) (io.Reader, error) {
+	r, err := o.track(r)
+	if err != nil {
+		return nil, err
+	}
+	return decompress(r, o.ext)
+}
+
+// finish ends a load, reporting the final progress if it succeeded. If it
+// failed because the context is done, the error is that of the context.
+func (o *LoadOptions) finish(err error) error {
+	t := o.tracker
+	if t == nil {
+		return err
+	}
+	if err != nil {
+		if ctxErr := t.ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
+		return err
+	}
+	if !t.finished {
+		t.finished = true
+		t.report()
+	}
+	return nil
+}
+
+// loaded sets the number of words loaded so far
+func (o *LoadOptions) loaded(words int) {
+	if o.tracker != nil {
+		o.tracker.words.Store(int64(words))
+	}
+}
+
+func (t *loadTracker) Read(p []byte) (int, error) {
+	if err := t.ctx.Err(); err != nil {
+		return 0, err
+	}
+	n, err := t.r.Read(p)
+	t.read += int64(n)
+	if now := time.Now(); now.Sub(t.last) >= t.interval {
+		t.last = now
+		t.report()
+	}
+	return n, err
+}
+
+func (t *loadTracker) report() {
+	if t.progress != nil {
+		t.progress(t.words.Load(), t.read, t.total)
+	}
+}
+
+// streamSize returns the number of bytes left in r if it is a file or an
+// in-memory reader, otherwise -1
+func streamSize(r io.Reader) int64 {
+	switch r := r.(type) {
+	case interface{ Stat() (os.FileInfo, error) }:
+		if info, err := r.Stat(); err == nil && info.Mode().IsRegular() {
+			if s, ok := r.(io.Seeker); ok {
+				if offset, err := s.Seek(0, io.SeekCurrent); err == nil {
+					return info.Size() - offset
+				}
+			}
+			return info.Size()
+		}
+	case interface{ Len() int }:
+		return int64(r.Len())
+	}
+	return -1
+}
+
+// loadModelFile loads the model file at p with load, which decompresses it
+// according to its extension and knows its size for progress
+func loadModelFile(p string, opts []LoadOption,
+	load func(r io.Reader, opts ...LoadOption) error) error {
+
+	file, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	return load(file, append(opts, withExt(filepath.Ext(p)))...)
+}
+
+// withTracker continues tracking a load that started reading the stream
+// before passing it on, such as to detect its format
+func withTracker(t *loadTracker) LoadOption {
+	return func(o *LoadOptions) {
+		o.tracker = t
+	}
+}
@@ -0,0 +1,151 @@
+/*
+
+Copyright (C) 2024 Jackie Deng
+
+Permission to use, copy, modify, and/or distribute this software for any
+purpose with or without fee is hereby granted.
+
+THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES WITH
+REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF MERCHANTABILITY AND
+FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY SPECIAL, DIRECT,
+INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES WHATSOEVER RESULTING FROM
+LOSS OF USE, DATA OR PROFITS, WHETHER IN AN ACTION OF CONTRACT, NEGLIGENCE OR
+OTHER TORTIOUS ACTION, ARISING OUT OF OR IN CONNECTION WITH THE USE OR
+PERFORMANCE OF THIS SOFTWARE.
+
+*/
+
+package gowe
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// progressCalls records the calls of a progress callback
+type progressCalls [][3]int64
+
+func (c *progressCalls) record(words, bytesRead, totalBytes int64) {
+	*c = append(*c, [3]int64{words, bytesRead, totalBytes})
+}
+
+func TestLoadProgress(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string][]byte{
+		"model.txt":    []byte(testPlain(true)),
+		"model.bin":    testBinary(),
+		"model.bin.gz": gzipped(testBinary()),
+	}
+	for name, data := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), data,
+			0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	loads := map[string]func(opt LoadOption) error{
+		"model.txt": func(opt LoadOption) error {
+			return NewFloatModel[float32]().LoadPlainFile(
+				filepath.Join(dir, "model.txt"), WithHeader(true), opt)
+		},
+		"model.bin": func(opt LoadOption) error {
+			return NewIntModel[int8]().LoadBinaryFile(
+				filepath.Join(dir, "model.bin"), WithMaxMagnitude(2), opt)
+		},
+		"model.bin.gz": func(opt LoadOption) error {
+			_, _, err := Load[float64](filepath.Join(dir, "model.bin.gz"), opt)
+			return err
+		},
+	}
+	for name, load := range loads {
+		var calls progressCalls
+		if err := load(WithProgress(calls.record, 0)); err != nil {
+			t.Fatal(err)
+		}
+		size := int64(len(files[name]))
+		if len(calls) < 2 || calls[len(calls)-1] != [3]int64{3, size, size} {
+			t.Errorf("%s should report progress up to 3 words and %d bytes, "+
+				"got %v", name, size, calls)
+		}
+		for i := 1; i < len(calls); i++ {
+			if calls[i][0] < calls[i-1][0] || calls[i][1] < calls[i-1][1] {
+				t.Errorf("%s progress should not go back, got %v", name,
+					calls)
+				break
+			}
+		}
+	}
+
+	// Only the final progress is reported within the interval, and streams
+	// of unknown size report -1
+	var calls progressCalls
+	err := NewFloatModel[float32]().LoadPlain(
+		io.MultiReader(strings.NewReader(testPlain(false))),
+		WithProgress(calls.record, 1<<62))
+	if err != nil || len(calls) != 1 || calls[0][0] != 3 || calls[0][2] != -1 {
+		t.Errorf("Expected a single report of 3 words of unknown size, got "+
+			"%v and %v", calls, err)
+	}
+}
+
+// cancelingReader cancels a context once it has been read from
+type cancelingReader struct {
+	r      io.Reader
+	cancel context.CancelFunc
+}
+
+func (r *cancelingReader) Read(p []byte) (int, error) {
+	r.cancel()
+	return r.r.Read(p)
+}
+
+func TestLoadContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	m := NewFloatModel[float32]()
+	err := m.LoadPlain(strings.NewReader(testPlain(false)), WithContext(ctx))
+	if err != context.Canceled || m.VocabularySize() != 0 {
+		t.Errorf("Load with a canceled context should fail with %v, got %v "+
+			"and %d words", context.Canceled, err, m.VocabularySize())
+	}
+
+	// Loads stop between reads of the stream
+	defer func(size int) { plainChunkSize = size }(plainChunkSize)
+	plainChunkSize = 64
+	var sb strings.Builder
+	for i := range 500 {
+		fmt.Fprintf(&sb, "word%d 1 2 3\n", i)
+	}
+	for _, n := range []int{1, 4} {
+		ctx, cancel := context.WithCancel(context.Background())
+		m := NewFloatModel[float32]()
+		err := m.LoadPlain(&cancelingReader{strings.NewReader(sb.String()),
+			cancel}, WithContext(ctx), WithParallelism(n))
+		if err != context.Canceled || m.VocabularySize() >= 500 {
+			t.Errorf("Canceled load should stop early with %v, got %v and %d "+
+				"words", context.Canceled, err, m.VocabularySize())
+		}
+	}
+	plain := NewFloatModel[float32]()
+	if err := plain.LoadPlain(strings.NewReader(sb.String())); err != nil {
+		t.Fatal(err)
+	}
+	var binary bytes.Buffer
+	if err := plain.WriteBinaryTo(&binary, 32); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel = context.WithCancel(context.Background())
+	q := NewIntModel[int8]()
+	err = q.LoadBinary(&cancelingReader{&binary, cancel}, WithContext(ctx),
+		WithMaxMagnitude(4))
+	if err != context.Canceled || q.VocabularySize() >= 500 {
+		t.Errorf("Canceled binary load should stop early with %v, got %v "+
+			"and %d words", context.Canceled, err, q.VocabularySize())
+	}
+}
@@ -0,0 +1,208 @@
+/*
+
+Copyright (C) 2024 Jackie Deng
+
+Permission to use, copy, modify, and/or distribute this software for any
+purpose with or without fee is hereby granted.
+
+THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES WITH
+REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF MERCHANTABILITY AND
+FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY SPECIAL, DIRECT,
+INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES WHATSOEVER RESULTING FROM
+LOSS OF USE, DATA OR PROFITS, WHETHER IN AN ACTION OF CONTRACT, NEGLIGENCE OR
+OTHER TORTIOUS ACTION, ARISING OUT OF OR IN CONNECTION WITH THE USE OR
+PERFORMANCE OF THIS SOFTWARE.
+
+*/
+
+package gowe
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"iter"
+)
+
+/** Scanner **/
+
+// Scanner reads the words and vectors of a plaintext or binary model one at
+// a time, in file order and in constant memory as nothing is kept between
+// records. It is used like a bufio.Scanner:
+//
+//	for s.Scan() {
+//		fmt.Println(s.Word(), s.Vector())
+//	}
+//	if err := s.Err(); err != nil {
+//		...
+//	}
+type Scanner[F FloatScalar] struct {
+	dim, size uint
+	// read reads the next record into vector, ok is false if the filter
+	// skips it
+	read    func(vector []F) (word string, ok bool, err error)
+	filter  LoadFilter
+	scanned int
+
+	word   string
+	vector []F
+	// err is io.EOF once the model has been read
+	err error
+}
+
+// NewPlainScanner returns a Scanner of a plaintext stream, WithHeader must be
+// set if the stream starts with a "<size> <dim>" description and the
+// LoadFilter of opts skips words. The description or first line is read
+// before returning.
+func NewPlainScanner[F FloatScalar](r io.Reader,
+	opts ...LoadOption) (*Scanner[F], error) {
+
+	o := newLoadOptions(opts)
+	r, err := decompress(r, "")
+	if err != nil {
+		return nil, err
+	}
+	pr, err := newPlainReader(bufio.NewReader(r), o.Header)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Scanner[F]{dim: pr.dim, size: pr.size, filter: o.Filter}
+	s.vector = make([]F, pr.dim)
+	s.read = func(vector []F) (string, bool, error) {
+		word, values, err := pr.next(&s.filter)
+		if err != nil || values == nil {
+			return word, false, err
+		}
+		if err := parsePlainValues(vector, values); err != nil {
+			return "", false, pr.wrap(err)
+		}
+		return word, true, nil
+	}
+	return s, nil
+}
+
+// NewBinaryScanner returns a Scanner of a binary stream, WithBitSize and
+// WithByteOrder describe its floats which are cast to F, and the LoadFilter
+// of opts skips words. The description is read before returning.
+func NewBinaryScanner[F FloatScalar](r io.Reader,
+	opts ...LoadOption) (*Scanner[F], error) {
+
+	o := newLoadOptions(opts)
+	r, err := decompress(r, "")
+	if err != nil {
+		return nil, err
+	}
+	br, err := newBinaryReader(bufio.NewReader(r), o.ByteOrder)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Scanner[F]{dim: br.dim, size: br.size, filter: o.Filter}
+	s.vector = make([]F, br.dim)
+	if o.BitSize == 64 {
+		s.read = binaryRecords[F, float64](br, &s.filter)
+	} else {
+		s.read = binaryRecords[F, float32](br, &s.filter)
+	}
+	return s, nil
+}
+
+// NewScanner detects whether a stream is a plaintext or binary model with
+// DetectFormat and returns a Scanner of it, opts are applied after the
+// detected options
+func NewScanner[F FloatScalar](r io.Reader,
+	opts ...LoadOption) (*Scanner[F], error) {
+
+	info, r, err := DetectFormat(r)
+	if err != nil {
+		return nil, err
+	}
+	opts = append(info.Options(), opts...)
+	switch info.Format {
+	case FormatPlain:
+		return NewPlainScanner[F](r, opts...)
+	case FormatBinary:
+		return NewBinaryScanner[F](r, opts...)
+	}
+	return nil, fmt.Errorf("Can't scan a model in the %s format",
+		info.Format)
+}
+
+// binaryRecords returns the read function of a Scanner of binary scalars B
+func binaryRecords[F FloatScalar, B FloatScalar](r *binaryReader,
+	filter *LoadFilter) func([]F) (string, bool, error) {
+
+	buf := make([]B, r.dim)
+	return func(vector []F) (string, bool, error) {
+		word, ok, err := readBinaryRecord(r, buf, filter)
+		if ok {
+			castScalars(vector, buf)
+		}
+		return word, ok, err
+	}
+}
+
+// Scan advances to the next word the filter accepts, it returns false at the
+// end of the model or on an error, which Err returns
+func (s *Scanner[F]) Scan() bool {
+	if s.err != nil || s.filter.full(s.scanned) {
+		return false
+	}
+	for {
+		word, ok, err := s.read(s.vector)
+		if err != nil {
+			s.word, s.err = "", err
+			return false
+		}
+		if ok {
+			s.word = word
+			s.scanned++
+			return true
+		}
+	}
+}
+
+// Word returns the word of the last record scanned
+func (s *Scanner[F]) Word() string {
+	return s.word
+}
+
+// Vector returns the vector of the last record scanned, it is overwritten by
+// the next call to Scan so it must be copied to be kept
+func (s *Scanner[F]) Vector() []F {
+	return s.vector
+}
+
+// Err returns the first error of Scan, or nil if the model was read to its
+// end
+func (s *Scanner[F]) Err() error {
+	if s.err == io.EOF {
+		return nil
+	}
+	return s.err
+}
+
+// Dimensions returns the dimensions of the vectors
+func (s *Scanner[F]) Dimensions() uint {
+	return s.dim
+}
+
+// Size returns the number of words declared by the description of the
+// model, or 0 if it has none
+func (s *Scanner[F]) Size() uint {
+	return s.size
+}
+
+// All returns an iterator over the remaining words and vectors, which are
+// only valid during an iteration as with Vector. Err must be checked after
+// the iteration to tell the end of the model from an error.
+func (s *Scanner[F]) All() iter.Seq2[string, []F] {
+	return func(yield func(string, []F) bool) {
+		for s.Scan() {
+			if !yield(s.word, s.vector) {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,138 @@
+/*
+
+Copyright (C) 2024 Jackie Deng
+
+Permission to use, copy, modify, and/or distribute this software for any
+purpose with or without fee is hereby granted.
+
+THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES WITH
+REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF MERCHANTABILITY AND
+FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY SPECIAL, DIRECT,
+INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES WHATSOEVER RESULTING FROM
+LOSS OF USE, DATA OR PROFITS, WHETHER IN AN ACTION OF CONTRACT, NEGLIGENCE OR
+OTHER TORTIOUS ACTION, ARISING OUT OF OR IN CONNECTION WITH THE USE OR
+PERFORMANCE OF THIS SOFTWARE.
+
+*/
+
+package gowe
+
+import (
+	"bytes"
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestScanner(t *testing.T) {
+	scanners := map[string]func() (*Scanner[float32], error){
+		"plain": func() (*Scanner[float32], error) {
+			return NewPlainScanner[float32](strings.NewReader(testPlain(false)))
+		},
+		"plain with header": func() (*Scanner[float32], error) {
+			return NewPlainScanner[float32](strings.NewReader(testPlain(true)),
+				WithHeader(true))
+		},
+		"binary": func() (*Scanner[float32], error) {
+			return NewBinaryScanner[float32](bytes.NewReader(testBinary()))
+		},
+		"binary64": func() (*Scanner[float32], error) {
+			return NewBinaryScanner[float32](bytes.NewReader(testBinary64()),
+				WithBitSize(64))
+		},
+		"detected": func() (*Scanner[float32], error) {
+			return NewScanner[float32](bytes.NewReader(testBinary64()))
+		},
+	}
+	for name, newScanner := range scanners {
+		s, err := newScanner()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s.Dimensions() != 3 {
+			t.Errorf("%s should have 3 dimensions, got %d", name,
+				s.Dimensions())
+		}
+		i := 0
+		for word, vector := range s.All() {
+			if word != testWords[i] || !slices.Equal(vector, testVectors[i]) {
+				t.Errorf("%s record %d should be %s %v, got %s %v", name, i,
+					testWords[i], testVectors[i], word, vector)
+			}
+			i++
+		}
+		if s.Err() != nil || i != len(testWords) {
+			t.Errorf("%s should scan %d words, got %d and %v", name,
+				len(testWords), i, s.Err())
+		}
+		if s.Scan() {
+			t.Errorf("%s should not scan past the end", name)
+		}
+	}
+
+	// The vector buffer is reused and filters apply
+	s, err := NewPlainScanner[float64](strings.NewReader(testPlain(false)),
+		WithKeep(func(word string) bool { return word != "cat" }),
+		WithMaxWords(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := s.Vector()
+	var words []string
+	for s.Scan() {
+		words = append(words, s.Word())
+		if &s.Vector()[0] != &buf[0] {
+			t.Error("Scanner should reuse its vector")
+		}
+	}
+	if !slices.Equal(words, []string{"dog"}) {
+		t.Errorf("Filtered scan should find [dog], got %v", words)
+	}
+
+	// Errors stop the scan
+	data := testBinary()
+	truncated, err := NewBinaryScanner[float32](
+		bytes.NewReader(data[:len(data)-1]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for truncated.Scan() {
+	}
+	if !errors.Is(truncated.Err(), ErrTruncated) {
+		t.Errorf("Truncated scan should fail with ErrTruncated, got %v",
+			truncated.Err())
+	}
+	_, err = NewPlainScanner[float32](strings.NewReader("x y\n"),
+		WithHeader(true))
+	if !errors.Is(err, ErrBadHeader) {
+		t.Errorf("Expected ErrBadHeader, got %v", err)
+	}
+}
+
+func BenchmarkScanPlain(b *testing.B) {
+	m := NewFloatModel[float32]()
+	data := benchData()
+	m.store.setDim(benchDim)
+	for i, word := range data.words[:10000] {
+		m.store.set(word, data.vectors[i])
+	}
+	var buf bytes.Buffer
+	if err := m.WritePlainTo(&buf); err != nil {
+		b.Fatal(err)
+	}
+	b.SetBytes(int64(buf.Len()))
+	b.ResetTimer()
+	for range b.N {
+		s, err := NewPlainScanner[float32](bytes.NewReader(buf.Bytes()),
+			WithHeader(true))
+		if err != nil {
+			b.Fatal(err)
+		}
+		for s.Scan() {
+		}
+		if err := s.Err(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,668 @@
+/*
+
+Copyright (C) 2024 Jackie Deng
+
+Permission to use, copy, modify, and/or distribute this software for any
+purpose with or without fee is hereby granted.
+
+THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES WITH
+REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF MERCHANTABILITY AND
+FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY SPECIAL, DIRECT,
+INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES WHATSOEVER RESULTING FROM
+LOSS OF USE, DATA OR PROFITS, WHETHER IN AN ACTION OF CONTRACT, NEGLIGENCE OR
+OTHER TORTIOUS ACTION, ARISING OUT OF OR IN CONNECTION WITH THE USE OR
+PERFORMANCE OF THIS SOFTWARE.
+
+*/
+
+package gowe
+
+import (
+	"cmp"
+	"container/heap"
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"runtime"
+	"slices"
+	"sync"
+)
+
+/** Search **/
+
+// Neighbor is a word found by a search and its score, which is the cosine
+// similarity for most searches
+type Neighbor struct {
+	Word       string
+	Similarity float64
+}
+
+// compareNeighbors orders neighbors from the most to the least similar, ties
+// are ordered by word so that results are deterministic
+func compareNeighbors(a, b Neighbor) int {
+	if c := cmp.Compare(b.Similarity, a.Similarity); c != 0 {
+		return c
+	}
+	return cmp.Compare(a.Word, b.Word)
+}
+
+// neighborHeap is a min-heap with the least similar neighbor on top
+type neighborHeap []Neighbor
+
+func (h neighborHeap) Len() int      { return len(h) }
+func (h neighborHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+func (h *neighborHeap) Push(x any)   { *h = append(*h, x.(Neighbor)) }
+
+func (h neighborHeap) Less(i, j int) bool {
+	return compareNeighbors(h[i], h[j]) > 0
+}
+
+func (h *neighborHeap) Pop() any {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
+// topNeighbors keeps the n most similar neighbors it is offered in a bounded
+// heap, so a search over the whole vocabulary never sorts more than n words
+type topNeighbors struct {
+	n int
+	h neighborHeap
+}
+
+func newTopNeighbors(n uint) *topNeighbors {
+	return &topNeighbors{
+		n: int(n),
+		h: make(neighborHeap, 0, min(n, maxReserve)),
+	}
+}
+
+// accepts reports whether a neighbor with a similarity could be kept, which
+// allows skipping the lookup of its word
+func (t *topNeighbors) accepts(similarity float64) bool {
+	return len(t.h) < t.n || similarity >= t.h[0].Similarity
+}
+
+func (t *topNeighbors) offer(nb Neighbor) {
+	if len(t.h) < t.n {
+		heap.Push(&t.h, nb)
+	} else if compareNeighbors(nb, t.h[0]) < 0 {
+		t.h[0] = nb
+		heap.Fix(&t.h, 0)
+	}
+}
+
+// sorted returns the kept neighbors from the most to the least similar
+func (t *topNeighbors) sorted() []Neighbor {
+	s := slices.Clone(t.h)
+	slices.SortFunc(s, compareNeighbors)
+	return s
+}
+
+// unitVector returns a vector as float64s scaled to a magnitude of 1, or nil
+// if it has no magnitude
+func unitVector[T VectorScalar](v []T) []float64 {
+	u := make([]float64, len(v))
+	m := float64(0)
+	for i := range v {
+		u[i] = float64(v[i])
+		m += u[i] * u[i]
+	}
+	if m == 0 {
+		return nil
+	}
+	m = math.Sqrt(m)
+	for i := range u {
+		u[i] /= m
+	}
+	return u
+}
+
+// dotMagnitude returns the dot product of u and v and the magnitude of v
+func dotMagnitude[T VectorScalar](u []float64, v []T) (float64, float64) {
+	d, m := float64(0), float64(0)
+	for i := range v {
+		f := float64(v[i])
+		d += u[i] * f
+		m += f * f
+	}
+	return d, math.Sqrt(m)
+}
+
+// queryVectors returns the unit vectors of words and adds their ids to
+// exclude so that they are left out of the results
+func queryVectors[T VectorScalar, M Embedding[T]](m M, words []string,
+	exclude map[int]struct{}) ([][]float64, error) {
+
+	vectors := make([][]float64, 0, len(words))
+	for _, word := range words {
+		v, ok := m.Lookup(word)
+		if !ok {
+			return nil, wordNotFound(word)
+		}
+		// Models with subwords can have query words out of the vocabulary
+		if id, ok := m.ID(word); ok {
+			exclude[id] = struct{}{}
+		}
+		if u := unitVector(v); u != nil {
+			vectors = append(vectors, u)
+		}
+	}
+	return vectors, nil
+}
+
+/** Concurrent Search **/
+
+// SearchOptions configure the exhaustive searches of the vocabulary
+type SearchOptions struct {
+	// Workers is the number of goroutines the vocabulary is split across,
+	// defaults to GOMAXPROCS
+	Workers int
+	// Missing is how NNearestIn treats candidates that aren't in the model
+	Missing MissingPolicy
+}
+
+type SearchOption func(*SearchOptions)
+
+// MissingPolicy is how NNearestIn treats candidates that aren't in the model
+type MissingPolicy int
+
+const (
+	// MissingRank ranks missing candidates with a similarity of 0, which is
+	// the default for compatibility
+	MissingRank MissingPolicy = iota
+	// MissingSkip leaves missing candidates out of the results, so fewer
+	// than n words may be returned
+	MissingSkip
+	// MissingError fails with ErrWordNotFound if any candidate is missing
+	MissingError
+)
+
+func newSearchOptions(opts []SearchOption) *SearchOptions {
+	o := &SearchOptions{Workers: runtime.GOMAXPROCS(0)}
+	for _, opt := range opts {
+		opt(o)
+	}
+	o.Workers = max(o.Workers, 1)
+	return o
+}
+
+// WithWorkers sets the number of goroutines a search runs on, 1 searches on
+// the calling goroutine
+func WithWorkers(n int) SearchOption {
+	return func(o *SearchOptions) {
+		o.Workers = n
+	}
+}
+
+// WithMissing sets how NNearestIn treats candidates that aren't in the
+// model, a query word that isn't in the model is always an error
+func WithMissing(p MissingPolicy) SearchOption {
+	return func(o *SearchOptions) {
+		o.Missing = p
+	}
+}
+
+const (
+	// minWorkerWords is the least number of words worth a worker goroutine
+	minWorkerWords = 4096
+	// cancelCheckWords is how many words are scored between checks of the
+	// context
+	cancelCheckWords = 1024
+)
+
+// scanVocabulary splits the ids of a vocabulary of size words into ranges
+// that are scanned on o.Workers goroutines, each offering ids to its own
+// topNeighbors with scan. The n best of each worker are merged, which gives
+// the same result for any number of workers as neighbors are totally
+// ordered.
+func scanVocabulary(ctx context.Context, size int, n uint, o *SearchOptions,
+	scan func(top *topNeighbors, id int)) ([]Neighbor, error) {
+
+	workers := min(o.Workers, max(size/minWorkerWords, 1))
+	chunk := (size + workers - 1) / workers
+	tops := make([]*topNeighbors, workers)
+	errs := make([]error, workers)
+	scanRange := func(w int) {
+		top := newTopNeighbors(n)
+		tops[w] = top
+		end := min((w+1)*chunk, size)
+		for id := w * chunk; id < end; id++ {
+			if id%cancelCheckWords == 0 {
+				if err := ctx.Err(); err != nil {
+					errs[w] = err
+					return
+				}
+			}
+			scan(top, id)
+		}
+	}
+
+	if workers == 1 {
+		scanRange(0)
+	} else {
+		var wg sync.WaitGroup
+		for w := range workers {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				scanRange(w)
+			}()
+		}
+		wg.Wait()
+	}
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if workers == 1 {
+		return tops[0].sorted(), nil
+	}
+	merged := newTopNeighbors(n)
+	for _, top := range tops {
+		for _, nb := range top.h {
+			merged.offer(nb)
+		}
+	}
+	return merged.sorted(), nil
+}
+
+// nearestTo scans the vocabulary for the n words most similar to a unit
+// vector, skipping the ids in exclude
+func nearestTo[T VectorScalar, M Embedding[T]](ctx context.Context, m M,
+	target []float64, n uint, exclude map[int]struct{},
+	o *SearchOptions) ([]Neighbor, error) {
+
+	return scanVocabulary(ctx, idLimit[T](m), n, o,
+		func(top *topNeighbors, id int) {
+			if _, ok := exclude[id]; ok {
+				return
+			}
+			d, mag := dotMagnitude(target, m.VectorByID(id))
+			if mag == 0 || !top.accepts(d/mag) {
+				return
+			}
+			top.offer(Neighbor{Word: m.Word(id), Similarity: d / mag})
+		})
+}
+
+// nearestToVector scans the vocabulary for the n words most similar to a
+// vector of the model's scalar type, which is compared with the vector
+// kernels, skipping the id exclude
+func nearestToVector[T VectorScalar, M Embedding[T]](ctx context.Context,
+	m M, v []T, n uint, exclude int, o *SearchOptions) ([]Neighbor, error) {
+
+	return scanVocabulary(ctx, idLimit[T](m), n, o,
+		func(top *topNeighbors, id int) {
+			if id == exclude {
+				return
+			}
+			u := m.VectorByID(id)
+			if u == nil {
+				return
+			}
+			similarity := cosineSimilarity(v, u)
+			// Vectors without magnitude have no similarity
+			if math.IsNaN(similarity) || !top.accepts(similarity) {
+				return
+			}
+			top.offer(Neighbor{Word: m.Word(id), Similarity: similarity})
+		})
+}
+
+/** Nearest Neighbors **/
+
+// NNearest returns the n words of the vocabulary most similar to a word and
+// their cosine similarities, the word itself is excluded. Fewer than n words
+// are returned if the vocabulary is smaller.
+func NNearest[T VectorScalar, M Embedding[T]](m M, s string,
+	n uint) ([]Neighbor, error) {
+
+	return NNearestContext[T](context.Background(), m, s, n)
+}
+
+// NNearestContext is NNearest split across workers, it stops early with the
+// error of ctx if ctx is done
+func NNearestContext[T VectorScalar, M Embedding[T]](ctx context.Context,
+	m M, s string, n uint, opts ...SearchOption) ([]Neighbor, error) {
+
+	if n == 0 {
+		return nil, errors.New("n = 0 for NNearest() is invalid")
+	}
+
+	view, release := readLocked[T](m)
+	defer release()
+	v, ok := view.Lookup(s)
+	if !ok {
+		return nil, wordNotFound(s)
+	}
+	// Models with subwords can have query words out of the vocabulary,
+	// which have no id to exclude
+	id, ok := view.ID(s)
+	if !ok {
+		id = -1
+	}
+	if magnitudeScalars(v) == 0 {
+		return nil, fmt.Errorf("Vector for %q has no magnitude", s)
+	}
+	return nearestToVector[T](ctx, view, v, n, id, newSearchOptions(opts))
+}
+
+// NNearestToVector returns the n words of the vocabulary most similar to a
+// vector of the model's scalar type, such as the result of vector arithmetic
+func NNearestToVector[T VectorScalar, M Embedding[T]](m M, v []T,
+	n uint) ([]Neighbor, error) {
+
+	return NNearestToVectorContext[T](context.Background(), m, v, n)
+}
+
+// NNearestToVectorContext is NNearestToVector split across workers, it stops
+// early with the error of ctx if ctx is done
+func NNearestToVectorContext[T VectorScalar, M Embedding[T]](
+	ctx context.Context, m M, v []T, n uint,
+	opts ...SearchOption) ([]Neighbor, error) {
+
+	if n == 0 {
+		return nil, errors.New("n = 0 for NNearestToVector() is invalid")
+	}
+
+	view, release := readLocked[T](m)
+	defer release()
+	if uint(len(v)) != view.Dimensions() {
+		return nil, fmt.Errorf("Vector has %d dimensions, model has %d",
+			len(v), view.Dimensions())
+	}
+	if magnitudeScalars(v) == 0 {
+		return nil, errors.New("Vector has no magnitude")
+	}
+	return nearestToVector[T](ctx, view, v, n, -1, newSearchOptions(opts))
+}
+
+/** Analogies **/
+
+// Analogy solves "a is to b as c is to ?" e.g. "man is to king as woman is
+// to ?" by returning the n words most similar to b - a + c with the 3CosAdd
+// method. The words of the query are excluded from the results.
+func Analogy[T VectorScalar, M Embedding[T]](m M, a, b, c string,
+	n uint) ([]Neighbor, error) {
+
+	return MostSimilar[T](m, []string{b, c}, []string{a}, n)
+}
+
+// AnalogyCosMul solves an analogy like Analogy with the 3CosMul method of
+// Levy and Goldberg, which balances the similarities to b and c so that one
+// of them can't dominate the result
+func AnalogyCosMul[T VectorScalar, M Embedding[T]](m M, a, b, c string,
+	n uint) ([]Neighbor, error) {
+
+	return MostSimilarCosMul[T](m, []string{b, c}, []string{a}, n)
+}
+
+// MostSimilar returns the n words most similar to the sum of the unit vectors
+// of the positive words minus those of the negative words, like gensim's
+// most_similar. The query words are excluded from the results.
+func MostSimilar[T VectorScalar, M Embedding[T]](m M, positive,
+	negative []string, n uint) ([]Neighbor, error) {
+
+	return MostSimilarContext[T](context.Background(), m, positive, negative,
+		n)
+}
+
+// MostSimilarContext is MostSimilar split across workers, it stops early
+// with the error of ctx if ctx is done
+func MostSimilarContext[T VectorScalar, M Embedding[T]](ctx context.Context,
+	m M, positive, negative []string, n uint,
+	opts ...SearchOption) ([]Neighbor, error) {
+
+	if n == 0 {
+		return nil, errors.New("n = 0 for MostSimilar() is invalid")
+	}
+	if len(positive)+len(negative) == 0 {
+		return nil, errors.New("MostSimilar() needs at least one word")
+	}
+
+	view, release := readLocked[T](m)
+	defer release()
+	exclude := make(map[int]struct{})
+	pos, err := queryVectors[T](view, positive, exclude)
+	if err != nil {
+		return nil, err
+	}
+	neg, err := queryVectors[T](view, negative, exclude)
+	if err != nil {
+		return nil, err
+	}
+
+	target := make([]float64, view.Dimensions())
+	for _, u := range pos {
+		for i := range u {
+			target[i] += u[i]
+		}
+	}
+	for _, u := range neg {
+		for i := range u {
+			target[i] -= u[i]
+		}
+	}
+	target = unitVector(target)
+	if target == nil {
+		return nil, errors.New("MostSimilar() query has no magnitude")
+	}
+
+	return nearestTo[T](ctx, view, target, n, exclude, newSearchOptions(opts))
+}
+
+// MostSimilarCosMul is MostSimilar with the 3CosMul method, words are scored
+// by the product of their similarities to the positive words divided by the
+// product of their similarities to the negative words, with similarities
+// shifted to [0, 1] to keep them positive
+func MostSimilarCosMul[T VectorScalar, M Embedding[T]](m M, positive,
+	negative []string, n uint) ([]Neighbor, error) {
+
+	return MostSimilarCosMulContext[T](context.Background(), m, positive,
+		negative, n)
+}
+
+// MostSimilarCosMulContext is MostSimilarCosMul split across workers, it
+// stops early with the error of ctx if ctx is done
+func MostSimilarCosMulContext[T VectorScalar, M Embedding[T]](
+	ctx context.Context, m M, positive, negative []string, n uint,
+	opts ...SearchOption) ([]Neighbor, error) {
+
+	if n == 0 {
+		return nil, errors.New("n = 0 for MostSimilarCosMul() is invalid")
+	}
+	if len(positive) == 0 {
+		return nil, errors.New("MostSimilarCosMul() needs a positive word")
+	}
+
+	view, release := readLocked[T](m)
+	defer release()
+	exclude := make(map[int]struct{})
+	pos, err := queryVectors[T](view, positive, exclude)
+	if err != nil {
+		return nil, err
+	}
+	neg, err := queryVectors[T](view, negative, exclude)
+	if err != nil {
+		return nil, err
+	}
+	// Query words without magnitude have no similarity to anything so they
+	// are left out, but the product needs a positive word
+	if len(pos) == 0 {
+		return nil, errors.New("MostSimilarCosMul() needs a positive word " +
+			"with magnitude")
+	}
+
+	// epsilon avoids division by zero as in Levy and Goldberg
+	const epsilon = 1e-6
+	return scanVocabulary(ctx, idLimit(view), n,
+		newSearchOptions(opts), func(top *topNeighbors, id int) {
+			if _, ok := exclude[id]; ok {
+				return
+			}
+			v := view.VectorByID(id)
+			score := float64(1)
+			for _, u := range pos {
+				d, mag := dotMagnitude(u, v)
+				if mag == 0 {
+					return
+				}
+				score *= (1 + d/mag) / 2
+			}
+			div := float64(1)
+			for _, u := range neg {
+				d, mag := dotMagnitude(u, v)
+				if mag == 0 {
+					return
+				}
+				div *= (1 + d/mag) / 2
+			}
+			score /= div + epsilon
+			if !top.accepts(score) {
+				return
+			}
+			top.offer(Neighbor{Word: view.Word(id), Similarity: score})
+		})
+}
+
+/** Batch Search **/
+
+// BatchResult is the result of one query of a batch search, Err is set if
+// the query isn't in the model
+type BatchResult struct {
+	Query     string
+	Neighbors []Neighbor
+	Err       error
+}
+
+const (
+	// batchQueries is how many queries are compared to each vector while it
+	// is in cache
+	batchQueries = 32
+	// batchRows is how many vectors are scanned between checks of the
+	// context
+	batchRows = 1024
+)
+
+// BatchNNearest is NNearest for many words at once, it returns a result for
+// each query in order. Magnitudes are computed once for the batch and
+// queries are compared in blocks to each vector of the vocabulary, so that a
+// vector is read once per block rather than once per query.
+func BatchNNearest[T VectorScalar, M Embedding[T]](m M, queries []string,
+	n uint) ([]BatchResult, error) {
+
+	return BatchNNearestContext[T](context.Background(), m, queries, n)
+}
+
+// BatchNNearestContext is BatchNNearest with blocks of queries split across
+// workers, it stops early with the error of ctx if ctx is done
+func BatchNNearestContext[T VectorScalar, M Embedding[T]](ctx context.Context,
+	m M, queries []string, n uint,
+	opts ...SearchOption) ([]BatchResult, error) {
+
+	if n == 0 {
+		return nil, errors.New("n = 0 for BatchNNearest() is invalid")
+	}
+	o := newSearchOptions(opts)
+
+	view, release := readLocked[T](m)
+	defer release()
+	size := idLimit(view)
+
+	inverse := make([]float64, size)
+	for id := range size {
+		if mag := magnitudeScalars(view.VectorByID(id)); mag != 0 {
+			inverse[id] = 1 / mag
+		}
+	}
+
+	// Only the queries found in the model are searched, those out of the
+	// vocabulary of models with subwords have an id of -1
+	results := make([]BatchResult, len(queries))
+	var found []int
+	ids := make([]int, len(queries))
+	vectors := make([][]T, len(queries))
+	inverseQuery := make([]float64, len(queries))
+	for i, query := range queries {
+		results[i].Query = query
+		v, ok := view.Lookup(query)
+		if !ok {
+			results[i].Err = wordNotFound(query)
+			continue
+		}
+		mag := magnitudeScalars(v)
+		if mag == 0 {
+			results[i].Err = fmt.Errorf("Vector for %q has no magnitude",
+				query)
+			continue
+		}
+		if ids[i], ok = view.ID(query); !ok {
+			ids[i] = -1
+		}
+		vectors[i], inverseQuery[i] = v, 1/mag
+		found = append(found, i)
+	}
+
+	searchBlock := func(block []int) error {
+		tops := make([]*topNeighbors, len(block))
+		for j := range block {
+			tops[j] = newTopNeighbors(n)
+		}
+		for id := range size {
+			if id%batchRows == 0 {
+				if err := ctx.Err(); err != nil {
+					return err
+				}
+			}
+			if inverse[id] == 0 {
+				continue
+			}
+			v := view.VectorByID(id)
+			for j, i := range block {
+				if id == ids[i] {
+					continue
+				}
+				similarity := dotScalars(vectors[i], v) * inverseQuery[i] *
+					inverse[id]
+				if tops[j].accepts(similarity) {
+					tops[j].offer(Neighbor{
+						Word:       view.Word(id),
+						Similarity: similarity,
+					})
+				}
+			}
+		}
+		for j, i := range block {
+			results[i].Neighbors = tops[j].sorted()
+		}
+		return nil
+	}
+
+	blocks := slices.Collect(slices.Chunk(found, batchQueries))
+	workers := min(o.Workers, len(blocks))
+	errs := make([]error, workers)
+	var wg sync.WaitGroup
+	for w := range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for b := w; b < len(blocks); b += workers {
+				if errs[w] = searchBlock(blocks[b]); errs[w] != nil {
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return results, nil
+}
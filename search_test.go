@@ -0,0 +1,400 @@
+/*
+
+Copyright (C) 2024 Jackie Deng
+
+Permission to use, copy, modify, and/or distribute this software for any
+purpose with or without fee is hereby granted.
+
+THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES WITH
+REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF MERCHANTABILITY AND
+FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY SPECIAL, DIRECT,
+INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES WHATSOEVER RESULTING FROM
+LOSS OF USE, DATA OR PROFITS, WHETHER IN AN ACTION OF CONTRACT, NEGLIGENCE OR
+OTHER TORTIOUS ACTION, ARISING OUT OF OR IN CONNECTION WITH THE USE OR
+PERFORMANCE OF THIS SOFTWARE.
+
+*/
+
+package gowe
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"strings"
+	"testing"
+)
+
+const testAnalogyPlain = `man 1 0 0
+woman 0 1 0
+king 1 0 1
+queen 0 1 1
+prince 0.9 0.1 0.8
+apple 0.2 0.2 -1
+`
+
+func testAnalogyModels(t *testing.T) (*FloatModel[float32],
+	*IntModel[int16]) {
+
+	t.Helper()
+	fm := NewFloatModel[float32]()
+	if err := fm.LoadPlain(strings.NewReader(testAnalogyPlain)); err != nil {
+		t.Fatal(err)
+	}
+	im := NewIntModel[int16]()
+	err := im.LoadPlain(strings.NewReader(testAnalogyPlain),
+		WithMaxMagnitude(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fm, im
+}
+
+func neighborWords(neighbors []Neighbor) []string {
+	words := make([]string, len(neighbors))
+	for i, nb := range neighbors {
+		words[i] = nb.Word
+	}
+	return words
+}
+
+func TestAnalogy(t *testing.T) {
+	fm, im := testAnalogyModels(t)
+	type analogy func(a, b, c string, n uint) ([]Neighbor, error)
+	for name, f := range map[string]analogy{
+		"Float 3CosAdd": func(a, b, c string, n uint) ([]Neighbor, error) {
+			return Analogy[float32](fm, a, b, c, n)
+		},
+		"Int 3CosAdd": func(a, b, c string, n uint) ([]Neighbor, error) {
+			return Analogy[int16](im, a, b, c, n)
+		},
+		"Float 3CosMul": func(a, b, c string, n uint) ([]Neighbor, error) {
+			return AnalogyCosMul[float32](fm, a, b, c, n)
+		},
+		"Int 3CosMul": func(a, b, c string, n uint) ([]Neighbor, error) {
+			return AnalogyCosMul[int16](im, a, b, c, n)
+		},
+	} {
+		nearest, err := f("man", "king", "woman", 10)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		words := neighborWords(nearest)
+		if len(words) != 3 || words[0] != "queen" {
+			t.Errorf("%s: man is to king as woman is to queen, got %v",
+				name, words)
+		}
+		for _, word := range []string{"man", "king", "woman"} {
+			if slices.Contains(words, word) {
+				t.Errorf("%s: query word %q should be excluded", name, word)
+			}
+		}
+		if !slices.IsSortedFunc(nearest, compareNeighbors) {
+			t.Errorf("%s: results should be sorted, got %v", name, nearest)
+		}
+
+		if _, err := f("man", "king", "duchess", 1); err == nil {
+			t.Errorf("%s: words not in the model should fail", name)
+		}
+		if _, err := f("man", "king", "woman", 0); err == nil {
+			t.Errorf("%s: n = 0 should fail", name)
+		}
+	}
+}
+
+func TestMostSimilar(t *testing.T) {
+	fm, _ := testAnalogyModels(t)
+	nearest, err := MostSimilar[float32](fm, []string{"king"}, nil, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if words := neighborWords(nearest); !slices.Equal(words,
+		[]string{"prince", "man"}) {
+		t.Errorf("Most similar to king should be [prince man], got %v",
+			words)
+	}
+	if nearest[0].Similarity <= nearest[1].Similarity {
+		t.Errorf("Similarities should be descending, got %v", nearest)
+	}
+
+	nearest, err = MostSimilar[float32](fm, []string{"queen", "prince"},
+		[]string{"woman", "man"}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nearest) != 1 || nearest[0].Word != "king" {
+		t.Errorf("Most similar to queen + prince - woman - man should be "+
+			"king, got %v", nearest)
+	}
+}
+
+func TestMostSimilarZeroWord(t *testing.T) {
+	fm, _ := testAnalogyModels(t)
+	if err := fm.Set("zero", make([]float32, fm.Dimensions())); err != nil {
+		t.Fatal(err)
+	}
+	for name, search := range map[string]func(pos, neg []string) (
+		[]Neighbor, error){
+		"3CosAdd": func(pos, neg []string) ([]Neighbor, error) {
+			return MostSimilar[float32](fm, pos, neg, 3)
+		},
+		"3CosMul": func(pos, neg []string) ([]Neighbor, error) {
+			return MostSimilarCosMul[float32](fm, pos, neg, 3)
+		},
+	} {
+		// A zero word as a candidate or a negative is skipped
+		nearest, err := search([]string{"king"}, []string{"zero"})
+		if err != nil || len(nearest) != 3 {
+			t.Fatalf("%s with a zero negative should find 3 words, got %v "+
+				"and %v", name, nearest, err)
+		}
+		for _, nb := range nearest {
+			if math.IsNaN(nb.Similarity) || nb.Word == "zero" {
+				t.Errorf("%s should skip the zero word, got %v", name,
+					nearest)
+			}
+		}
+		if !slices.Equal(neighborWords(nearest)[:2],
+			[]string{"prince", "man"}) {
+			t.Errorf("%s should ignore a zero negative, got %v", name,
+				nearest)
+		}
+	}
+	if _, err := MostSimilarCosMul[float32](fm, []string{"zero"},
+		[]string{"king"}, 3); err == nil {
+		t.Error("3CosMul with only a zero positive should fail")
+	}
+}
+
+func TestNNearest(t *testing.T) {
+	fm, im := testAnalogyModels(t)
+	floatNearest, err := NNearest(fm, "king", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	intNearest, err := NNearest(im, "king", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, nearest := range [][]Neighbor{floatNearest, intNearest} {
+		if words := neighborWords(nearest); !slices.Equal(words,
+			[]string{"prince", "man"}) {
+			t.Errorf("Nearest to king should be [prince man], got %v",
+				words)
+		}
+	}
+	if s := floatNearest[1].Similarity; s < 0.707 || s > 0.708 {
+		t.Errorf("Similarity of king and man should be 0.707, got %f", s)
+	}
+
+	all, err := NNearest(fm, "king", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 5 || slices.Contains(neighborWords(all), "king") {
+		t.Errorf("Nearest should be the 5 other words, got %v", all)
+	}
+	if _, err := NNearest(fm, "duchess", 1); err == nil {
+		t.Error("Words not in the model should fail")
+	}
+
+	nearest, err := NNearestToVector(im, im.Vector("queen"), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nearest) != 1 || nearest[0].Word != "queen" ||
+		nearest[0].Similarity < 0.999 {
+		t.Errorf("Nearest to the vector of queen should be queen, got %v",
+			nearest)
+	}
+	if _, err := NNearestToVector(fm, []float32{1, 0}, 1); err == nil {
+		t.Error("Vectors of the wrong dimensions should fail")
+	}
+}
+
+func TestConcurrentSearch(t *testing.T) {
+	// Every word is duplicated so that ties have to be broken by word
+	plain := testRandomPlain(6000, 8, 6)
+	plain += strings.ReplaceAll(plain, "w", "x")
+	m := NewIntModel[int16]()
+	err := m.LoadPlain(strings.NewReader(plain), WithMaxMagnitude(4))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	want, err := NNearestContext(ctx, m, "w1", 25, WithWorkers(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want[0].Word != "x1" || want[1].Similarity != want[2].Similarity ||
+		want[1].Word > want[2].Word {
+		t.Errorf("Ties should be ordered by word, got %v", want[:3])
+	}
+	for _, workers := range []int{2, 3, 8, 64} {
+		got, err := NNearestContext(ctx, m, "w1", 25, WithWorkers(workers))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !slices.Equal(got, want) {
+			t.Errorf("%d workers should find %v, got %v", workers, want, got)
+		}
+
+		got, err = MostSimilarCosMulContext(ctx, m, []string{"w1", "w2"},
+			[]string{"w3"}, 10, WithWorkers(workers))
+		if err != nil {
+			t.Fatal(err)
+		}
+		single, _ := MostSimilarCosMulContext(ctx, m, []string{"w1", "w2"},
+			[]string{"w3"}, 10, WithWorkers(1))
+		if !slices.Equal(got, single) {
+			t.Errorf("%d workers should find %v, got %v", workers, single,
+				got)
+		}
+
+		words := slices.Collect(m.Words())
+		nearestIn, err := NNearestInContext(ctx, m, "w1", words, 10,
+			WithWorkers(workers))
+		if err != nil {
+			t.Fatal(err)
+		}
+		// NNearestIn doesn't exclude the word itself
+		if !slices.Equal(nearestIn[1:], neighborWords(want[:9])) {
+			t.Errorf("%d workers NNearestIn should find %v, got %v",
+				workers, neighborWords(want[:9]), nearestIn[1:])
+		}
+	}
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	_, err = NNearestToVectorContext(cancelled, m, m.Vector("w1"), 10,
+		WithWorkers(4))
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("Cancelled search should fail with context.Canceled, got %v",
+			err)
+	}
+}
+
+func TestTopNeighbors(t *testing.T) {
+	top := newTopNeighbors(3)
+	for i, word := range []string{"a", "b", "c", "d", "e", "f"} {
+		top.offer(Neighbor{Word: word, Similarity: float64(i % 3)})
+	}
+	got := neighborWords(top.sorted())
+	if !slices.Equal(got, []string{"c", "f", "b"}) {
+		t.Errorf("Top 3 should be [c f b], got %v", got)
+	}
+}
+
+func benchNNearest[T VectorScalar](b *testing.B, m Embedding[T]) {
+	kernelImplementations(b, func(name string) {
+		b.Run(name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				NNearest(m, "word0", 10)
+			}
+		})
+	})
+}
+
+func BenchmarkNNearest10InFloat32(b *testing.B) {
+	data := benchData()
+	m := NewFloatModel[float32]()
+	m.store.setDim(benchDim)
+	for i, word := range data.words {
+		m.store.set(word, data.vectors[i])
+	}
+	b.ResetTimer()
+	benchNNearest(b, m)
+}
+
+func BenchmarkNNearest10InInt8(b *testing.B) {
+	data := benchData()
+	m := NewIntModel[int8]()
+	m.store.setDim(benchDim)
+	m.setShift(QuantizationShift[int8](1))
+	for i, word := range data.words {
+		quantizeScalars(m.store.addRow(word), data.vectors[i], m.shift)
+	}
+	b.ResetTimer()
+	benchNNearest(b, m)
+}
+
+func TestBatchNNearest(t *testing.T) {
+	m := NewFloatModel[float32]()
+	err := m.LoadPlain(strings.NewReader(testRandomPlain(3000, 16, 7)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	queries := []string{"missing"}
+	for i := range 70 {
+		queries = append(queries, fmt.Sprintf("w%d", i*13))
+	}
+
+	for _, workers := range []int{1, 3} {
+		results, err := BatchNNearestContext(context.Background(), m,
+			queries, 5, WithWorkers(workers))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(results) != len(queries) {
+			t.Fatalf("Expected %d results, got %d", len(queries),
+				len(results))
+		}
+		if results[0].Err == nil || results[0].Neighbors != nil {
+			t.Errorf("Missing query should fail, got %v", results[0])
+		}
+		for i, result := range results[1:] {
+			if result.Query != queries[i+1] || result.Err != nil {
+				t.Fatalf("Expected result for %s, got %v", queries[i+1],
+					result)
+			}
+			want, _ := NNearest(m, result.Query, 5)
+			if !slices.Equal(neighborWords(result.Neighbors),
+				neighborWords(want)) {
+				t.Errorf("Batch nearest to %s should be %v, got %v",
+					result.Query, want, result.Neighbors)
+			}
+			for j := range want {
+				diff := want[j].Similarity - result.Neighbors[j].Similarity
+				if math.Abs(diff) > 1e-9 {
+					t.Errorf("Batch similarity to %s should be %v, got %v",
+						result.Query, want[j], result.Neighbors[j])
+				}
+			}
+		}
+	}
+
+	if _, err := BatchNNearest(m, queries, 0); err == nil {
+		t.Error("Expected error for n = 0")
+	}
+}
+
+func benchBatchModel() (*FloatModel[float32], []string) {
+	data := benchData()
+	m := NewFloatModel[float32]()
+	m.store.setDim(benchDim)
+	for i, word := range data.words {
+		m.store.set(word, data.vectors[i])
+	}
+	return m, data.words[:64]
+}
+
+func BenchmarkNNearest64Queries(b *testing.B) {
+	m, queries := benchBatchModel()
+	b.ResetTimer()
+	for range b.N {
+		for _, query := range queries {
+			NNearest(m, query, 10)
+		}
+	}
+}
+
+func BenchmarkBatchNNearest64Queries(b *testing.B) {
+	m, queries := benchBatchModel()
+	b.ResetTimer()
+	for range b.N {
+		BatchNNearest(m, queries, 10)
+	}
+}
@@ -0,0 +1,376 @@
+/*
+
+Copyright (C) 2024 Jackie Deng
+
+Permission to use, copy, modify, and/or distribute this software for any
+purpose with or without fee is hereby granted.
+
+THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES WITH
+REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF MERCHANTABILITY AND
+FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY SPECIAL, DIRECT,
+INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES WHATSOEVER RESULTING FROM
+LOSS OF USE, DATA OR PROFITS, WHETHER IN AN ACTION OF CONTRACT, NEGLIGENCE OR
+OTHER TORTIOUS ACTION, ARISING OUT OF OR IN CONNECTION WITH THE USE OR
+PERFORMANCE OF THIS SOFTWARE.
+
+*/
+
+package gowe
+
+import (
+	"fmt"
+	"iter"
+	"slices"
+	"sync"
+)
+
+/** Vector Storage **/
+
+// vectorStore holds the vectors of a model in one contiguous matrix of
+// len(words) rows by dim columns, where row i is the vector for words[i].
+// Compared to a map of individually allocated vectors, this keeps full
+// vocabulary scans cache friendly and gives the garbage collector a handful of
+// pointers to trace instead of millions.
+//
+// The id of a word is its row, which only changes when the store is
+// compacted. Deleting a word leaves a tombstone in deleted rather than moving
+// the rows after it, and its id isn't reused, so ids held by indexes and
+// callers stay valid.
+type vectorStore[T VectorScalar] struct {
+	dim     uint
+	scalars []T
+	words   []string
+	index   map[string]int32
+	// deleted is a bitmap of the rows of deleted words
+	deleted []uint64
+	removed int
+	// reserved is the number of rows expected from a description
+	reserved int
+}
+
+func newVectorStore[T VectorScalar]() vectorStore[T] {
+	return vectorStore[T]{index: make(map[string]int32)}
+}
+
+// setDim sets the dimensions of the rows, which can't change once the store
+// has any rows
+func (s *vectorStore[T]) setDim(dim uint) error {
+	if len(s.words) > 0 && dim != s.dim {
+		return fmt.Errorf("%w, model has %d dimensions but %d dimensions "+
+			"were loaded", ErrDimMismatch, s.dim, dim)
+	}
+	s.dim = dim
+	return nil
+}
+
+// maxReserve bounds the rows reserved from a description, and
+// reserveScalars is the most scalars reserved before any rows are added. A
+// corrupt description can't allocate an absurd amount of memory, while the
+// rows of a valid description are allocated once without doubling.
+const (
+	maxReserve     = 1 << 24
+	reserveScalars = 1 << 20
+)
+
+// reserve grows the capacity of the store for n more rows, up to
+// reserveScalars now and the rest as rows are added
+func (s *vectorStore[T]) reserve(n uint) {
+	s.reserved = s.rows() + int(min(n, maxReserve))
+	s.grow(max(reserveScalars/int(max(s.dim, 1)), 1))
+}
+
+// grow grows the capacity of the store for up to rows more rows, but not
+// past the rows reserved
+func (s *vectorStore[T]) grow(rows int) {
+	rows = min(rows, s.reserved-s.rows())
+	if rows <= 0 {
+		return
+	}
+	s.scalars = slices.Grow(s.scalars, rows*int(s.dim))
+	s.words = slices.Grow(s.words, rows)
+}
+
+// len returns the number of words in the store
+func (s *vectorStore[T]) len() int {
+	return len(s.words) - s.removed
+}
+
+// rows returns the number of rows including those of deleted words, which
+// is one past the greatest id
+func (s *vectorStore[T]) rows() int {
+	return len(s.words)
+}
+
+// isDeleted returns whether row i of a deleted bitmap is a tombstone
+func isDeleted(deleted []uint64, i int) bool {
+	return i>>6 < len(deleted) && deleted[i>>6]&(1<<(i&63)) != 0
+}
+
+// row returns the vector with id i, capped so appending to it can't overwrite
+// the next row
+func (s *vectorStore[T]) row(i int) []T {
+	start, end := i*int(s.dim), (i+1)*int(s.dim)
+	return s.scalars[start:end:end]
+}
+
+// id returns the id of word, which is its position in the order of loading
+// counting deleted words
+func (s *vectorStore[T]) id(word string) (int, bool) {
+	i, ok := s.index[word]
+	return int(i), ok
+}
+
+// word returns the word with id i or "" if there is no such id
+func (s *vectorStore[T]) word(i int) string {
+	if i < 0 || i >= len(s.words) || isDeleted(s.deleted, i) {
+		return ""
+	}
+	return s.words[i]
+}
+
+// vectorByID returns the vector with id i or nil if there is no such id
+func (s *vectorStore[T]) vectorByID(i int) []T {
+	if i < 0 || i >= len(s.words) || isDeleted(s.deleted, i) {
+		return nil
+	}
+	return s.row(i)
+}
+
+// all yields every word in id order, the store must stay locked while the
+// iterator is used
+func (s *vectorStore[T]) all() iter.Seq[string] {
+	if s.removed == 0 {
+		return slices.Values(s.words)
+	}
+	return func(yield func(string) bool) {
+		for i, word := range s.words {
+			if !isDeleted(s.deleted, i) && !yield(word) {
+				return
+			}
+		}
+	}
+}
+
+// allLocked yields every word with an id below the rows of the store as of
+// the call, taking l for each word so that the store can change in between.
+// Words deleted before they are reached are skipped.
+func (s *vectorStore[T]) allLocked(l sync.Locker) iter.Seq[string] {
+	rows := s.rows()
+	return func(yield func(string) bool) {
+		for i := range rows {
+			l.Lock()
+			ok := i < len(s.words) && !isDeleted(s.deleted, i)
+			var word string
+			if ok {
+				word = s.words[i]
+			}
+			l.Unlock()
+			if ok && !yield(word) {
+				return
+			}
+		}
+	}
+}
+
+// vocabulary returns the words of the store in id order without those that
+// were deleted
+func (s *vectorStore[T]) vocabulary() []string {
+	if s.removed == 0 {
+		return s.words
+	}
+	return slices.Collect(s.all())
+}
+
+// lookup returns the vector for word if it is in the store
+func (s *vectorStore[T]) lookup(word string) ([]T, bool) {
+	i, ok := s.index[word]
+	if !ok {
+		return nil, false
+	}
+	return s.row(int(i)), true
+}
+
+// addRow returns the row for word to be filled in, appending a new row if the
+// word isn't already in the store
+func (s *vectorStore[T]) addRow(word string) []T {
+	if i, ok := s.index[word]; ok {
+		return s.row(int(i))
+	}
+	if len(s.words) == cap(s.words) {
+		// Doubling towards the reserved rows
+		s.grow(max(s.len(), 1))
+	}
+	s.index[word] = int32(len(s.words))
+	s.words = append(s.words, word)
+	s.scalars = append(s.scalars, make([]T, s.dim)...)
+	return s.row(len(s.words) - 1)
+}
+
+// set copies vector into the row for word
+func (s *vectorStore[T]) set(word string, vector []T) {
+	copy(s.addRow(word), vector)
+}
+
+// put sets the vector for word after checking its dimensions, an empty store
+// takes the dimensions of the vector
+func (s *vectorStore[T]) put(word string, vector []T) error {
+	if len(s.words) == 0 && s.dim == 0 {
+		s.dim = uint(len(vector))
+	}
+	if uint(len(vector)) != s.dim || s.dim == 0 {
+		return fmt.Errorf("%w, vector for %q has %d dimensions but the model "+
+			"has %d", ErrDimMismatch, word, len(vector), s.dim)
+	}
+	s.set(word, vector)
+	return nil
+}
+
+// delete marks the row for word as deleted, the ids of other words don't
+// change and setting the word again adds a new row. It returns false if the
+// word isn't in the store.
+func (s *vectorStore[T]) delete(word string) bool {
+	i, ok := s.index[word]
+	if !ok {
+		return false
+	}
+	delete(s.index, word)
+	if n := int(i>>6) + 1; len(s.deleted) < n {
+		s.deleted = append(s.deleted, make([]uint64, n-len(s.deleted))...)
+	}
+	s.deleted[i>>6] |= 1 << (i & 63)
+	s.removed++
+	return true
+}
+
+// compact frees the rows of deleted words by moving the rows after them up,
+// which changes their ids. The rows are copied into a new matrix so that
+// vectors returned before compacting don't change.
+func (s *vectorStore[T]) compact() {
+	if s.removed == 0 {
+		return
+	}
+	dim := int(s.dim)
+	scalars := make([]T, 0, s.len()*dim)
+	words := make([]string, 0, s.len())
+	for i, word := range s.words {
+		if isDeleted(s.deleted, i) {
+			continue
+		}
+		s.index[word] = int32(len(words))
+		words = append(words, word)
+		scalars = append(scalars, s.row(i)...)
+	}
+	s.scalars, s.words = scalars, words
+	s.deleted, s.removed, s.reserved = nil, 0, 0
+}
+
+// addAll adds a matrix of rows for words, an empty store takes ownership of
+// scalars rather than copying it
+func (s *vectorStore[T]) addAll(words []string, scalars []T) {
+	if len(s.words) == 0 {
+		index := make(map[string]int32, len(words))
+		for i, word := range words {
+			index[word] = int32(i)
+		}
+		// Duplicate words need the overwriting behaviour of set
+		if len(index) == len(words) {
+			s.scalars, s.words, s.index = scalars, words, index
+			return
+		}
+	}
+	dim := int(s.dim)
+	for i, word := range words {
+		s.set(word, scalars[i*dim:(i+1)*dim])
+	}
+}
+
+/** Concurrent Access **/
+
+// storeView is an Embedding of a store which its model has read locked, so
+// that searches reading the model many times don't lock it for every read
+type storeView[T VectorScalar] struct {
+	store *vectorStore[T]
+}
+
+func (v storeView[T]) Vector(s string) []T {
+	if row, ok := v.store.lookup(s); ok {
+		return row
+	}
+	return make([]T, v.store.dim)
+}
+
+func (v storeView[T]) Dimensions() uint        { return v.store.dim }
+func (v storeView[T]) VocabularySize() uint    { return uint(v.store.len()) }
+func (v storeView[T]) Words() iter.Seq[string] { return v.store.all() }
+func (v storeView[T]) All() iter.Seq2[string, []T] {
+	return func(yield func(string, []T) bool) {
+		for i, word := range v.store.words {
+			if isDeleted(v.store.deleted, i) {
+				continue
+			}
+			if !yield(word, v.store.row(i)) {
+				return
+			}
+		}
+	}
+}
+
+func (v storeView[T]) idLimit() int { return v.store.rows() }
+
+func (v storeView[T]) ID(s string) (int, bool) { return v.store.id(s) }
+func (v storeView[T]) Word(id int) string      { return v.store.word(id) }
+func (v storeView[T]) VectorByID(id int) []T   { return v.store.vectorByID(id) }
+
+func (v storeView[T]) Lookup(s string) ([]T, bool) {
+	return v.store.lookup(s)
+}
+
+func (v storeView[T]) Similarity(s, t string) float64 {
+	similarity, _ := v.SimilarityE(s, t)
+	return similarity
+}
+
+func (v storeView[T]) SimilarityE(s, t string) (float64, error) {
+	a, ok := v.store.lookup(s)
+	if !ok {
+		return 0, wordNotFound(s)
+	}
+	b, ok := v.store.lookup(t)
+	if !ok {
+		return 0, wordNotFound(t)
+	}
+	return cosineSimilarity(a, b), nil
+}
+
+// idLimiter is implemented by models whose ids can have gaps left by deleted
+// words, idLimit is one past the greatest id
+type idLimiter interface {
+	idLimit() int
+}
+
+// idLimit returns one past the greatest id of m, which is its vocabulary
+// size unless words were deleted. Ids below it without a word have a nil
+// VectorByID.
+func idLimit[T VectorScalar](m Embedding[T]) int {
+	if l, ok := m.(idLimiter); ok {
+		return l.idLimit()
+	}
+	return int(m.VocabularySize())
+}
+
+// readLocker is implemented by models that can change while they are read,
+// readLock read locks the model until release is called and returns an
+// Embedding of it that doesn't lock again
+type readLocker[T VectorScalar] interface {
+	readLock() (view Embedding[T], release func())
+}
+
+// readLocked returns an Embedding of m that can be read many times without
+// m changing in between, until release is called. Models that can't change
+// are returned as they are.
+func readLocked[T VectorScalar, M Embedding[T]](m M) (Embedding[T], func()) {
+	if l, ok := any(m).(readLocker[T]); ok {
+		return l.readLock()
+	}
+	return m, func() {}
+}
@@ -0,0 +1,139 @@
+/*
+
+Copyright (C) 2024 Jackie Deng
+
+Permission to use, copy, modify, and/or distribute this software for any
+purpose with or without fee is hereby granted.
+
+THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES WITH
+REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF MERCHANTABILITY AND
+FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY SPECIAL, DIRECT,
+INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES WHATSOEVER RESULTING FROM
+LOSS OF USE, DATA OR PROFITS, WHETHER IN AN ACTION OF CONTRACT, NEGLIGENCE OR
+OTHER TORTIOUS ACTION, ARISING OUT OF OR IN CONNECTION WITH THE USE OR
+PERFORMANCE OF THIS SOFTWARE.
+
+*/
+
+package gowe
+
+import (
+	"math/rand/v2"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+// The benchmarks below compare the contiguous vectorStore with the map of
+// individually allocated vectors that models used previously, for a synthetic
+// vocabulary of benchWords words of benchDim dimensions.
+const (
+	benchWords = 50000
+	benchDim   = 300
+)
+
+type benchVocabulary struct {
+	words   []string
+	vectors [][]float32
+}
+
+// benchData is generated lazily so that it isn't built for plain test runs
+var benchData = sync.OnceValue(func() benchVocabulary {
+	r := rand.New(rand.NewPCG(1, 2))
+	words := make([]string, benchWords)
+	vectors := make([][]float32, benchWords)
+	for i := range words {
+		words[i] = "word" + strconv.Itoa(i)
+		vectors[i] = make([]float32, benchDim)
+		for j := range vectors[i] {
+			vectors[i][j] = r.Float32()*2 - 1
+		}
+	}
+	return benchVocabulary{words, vectors}
+})
+
+func loadMapLayout() map[string]*FloatVector[float32] {
+	data := benchData()
+	vectors := make(map[string]*FloatVector[float32])
+	for i, word := range data.words {
+		v := make([]float32, benchDim)
+		copy(v, data.vectors[i])
+		vectors[word] = &FloatVector[float32]{scalars: v}
+	}
+	return vectors
+}
+
+func loadStoreLayout() vectorStore[float32] {
+	s := newVectorStore[float32]()
+	s.setDim(benchDim)
+	s.reserve(benchWords)
+	data := benchData()
+	for i, word := range data.words {
+		s.set(word, data.vectors[i])
+	}
+	return s
+}
+
+func TestVectorStore(t *testing.T) {
+	s := newVectorStore[int8]()
+	s.setDim(2)
+	s.set("a", []int8{1, 2})
+	s.set("b", []int8{3, 4})
+	s.set("a", []int8{5, 6})
+	if s.len() != 2 {
+		t.Fatalf("Store should have 2 rows, got %d", s.len())
+	}
+	if v, ok := s.lookup("a"); !ok || v[0] != 5 || v[1] != 6 || cap(v) != 2 {
+		t.Errorf("Row for \"a\" should be overwritten to [5 6], got %v", v)
+	}
+	if err := s.setDim(3); err == nil {
+		t.Error("Changing dimensions of a non-empty store should fail")
+	}
+
+	u := newVectorStore[int8]()
+	u.setDim(2)
+	u.addAll([]string{"x", "y", "x"}, []int8{1, 1, 2, 2, 3, 3})
+	if v, _ := u.lookup("x"); u.len() != 2 || v[0] != 3 {
+		t.Errorf("Duplicate words should overwrite, got %d rows and %v",
+			u.len(), v)
+	}
+}
+
+func BenchmarkLoadMapLayout(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		loadMapLayout()
+	}
+}
+
+func BenchmarkLoadStoreLayout(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		loadStoreLayout()
+	}
+}
+
+func BenchmarkScanMapLayout(b *testing.B) {
+	vectors := loadMapLayout()
+	q := FloatVector[float32]{scalars: benchData().vectors[0]}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		best := -2.0
+		for _, v := range vectors {
+			best = max(best, q.CosineSimilarity(*v))
+		}
+	}
+}
+
+func BenchmarkScanStoreLayout(b *testing.B) {
+	s := loadStoreLayout()
+	q := FloatVector[float32]{scalars: benchData().vectors[0]}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		best := -2.0
+		for j := range s.len() {
+			best = max(best,
+				q.CosineSimilarity(FloatVector[float32]{scalars: s.row(j)}))
+		}
+	}
+}
@@ -38,6 +38,16 @@ type FloatVector[F FloatScalar] struct {
 	scalars []F
 }
 
+// NewFloatVector wraps scalars, such as a vector returned by a FloatModel, in
+// a FloatVector without copying them
+func NewFloatVector[F FloatScalar](scalars []F) FloatVector[F] {
+	return FloatVector[F]{scalars: scalars}
+}
+
+func (v FloatVector[F]) Scalars() []F {
+	return v.scalars
+}
+
 func (v FloatVector[F]) Add(u FloatVector[F]) FloatVector[F] {
 	w := make([]F, len(v.scalars))
 	for i, _ := range v.scalars {
@@ -59,6 +69,9 @@ func (v FloatVector[F]) Subtract(u FloatVector[F]) FloatVector[F] {
 }
 
 func (v FloatVector[F]) Dot(u FloatVector[F]) float64 {
+	if a, ok := any(v.scalars).([]float32); ok {
+		return dotFloat32(a, any(u.scalars).([]float32))
+	}
 	d := float64(0)
 	for i, _ := range v.scalars {
 		d += float64(v.scalars[i]) * float64(u.scalars[i])
@@ -87,6 +100,10 @@ func (v FloatVector[F]) Normalize() FloatVector[F] {
 
 // Fused-loop implementation of CosineSimilarity
 func (v FloatVector[F]) CosineSimilarity(u FloatVector[F]) float64 {
+	if a, ok := any(v.scalars).([]float32); ok {
+		d, mV, mU := cosineFloat32(a, any(u.scalars).([]float32))
+		return d / math.Sqrt(mV*mU)
+	}
 	d, mV, mU := float64(0), float64(0), float64(0)
 	for i, _ := range v.scalars {
 		d += float64(v.scalars[i]) * float64(u.scalars[i])
@@ -105,6 +122,20 @@ type IntVector[I int8 | int16 | int32] struct {
 	shift   uint8
 }
 
+// NewIntVector wraps quantized scalars and their shift, such as a vector and
+// the Shift of an IntModel, in an IntVector without copying them
+func NewIntVector[I IntScalar](scalars []I, shift uint8) IntVector[I] {
+	return IntVector[I]{scalars: scalars, shift: shift}
+}
+
+func (v IntVector[I]) Scalars() []I {
+	return v.scalars
+}
+
+func (v IntVector[I]) Shift() uint8 {
+	return v.shift
+}
+
 // Never operate on IntVectors of different shifts, this operation is designed
 // to be fast so it doesn't check it.
 func (v IntVector[I]) Add(u IntVector[I]) IntVector[I] {
@@ -130,10 +161,7 @@ func (v IntVector[I]) Subtract(u IntVector[I]) IntVector[I] {
 }
 
 func (v IntVector[I]) Dot(u IntVector[I]) float64 {
-	w := int64(0)
-	for i, _ := range v.scalars {
-		w += int64(v.scalars[i]) * int64(u.scalars[i])
-	}
+	w := dotInts(v.scalars, u.scalars)
 	scale := float64(int64(1) << (v.shift + u.shift))
 	return float64(w) / scale
 }
@@ -157,6 +185,12 @@ func (v IntVector[I]) Normalize() IntVector[I] {
 
 // Fused-loop implementation of CosineSimilarity
 func (v IntVector[int32]) CosineSimilarity(u IntVector[int32]) float64 {
+	if isKernelInt(v.scalars) {
+		d := dotInts(v.scalars, u.scalars)
+		mV := dotInts(v.scalars, v.scalars)
+		mU := dotInts(u.scalars, u.scalars)
+		return float64(d) / math.Sqrt(float64(mV)*float64(mU))
+	}
 	d, mV, mU := int64(0), int64(0), int64(0)
 	for i, _ := range v.scalars {
 		d += int64(v.scalars[i]) * int64(u.scalars[i])
@@ -201,25 +235,116 @@ func QuantizationShift[I IntScalar](maxMagnitude float64) uint8 {
 func QuantizeFloatVector[I IntScalar, F FloatScalar](
 	v FloatVector[F], shift uint8) IntVector[I] {
 
-	scale := F(int64(1) << shift)
 	qScalars := make([]I, len(v.scalars))
-	for i, _ := range v.scalars {
-		qScalars[i] = I(v.scalars[i] * scale)
-	}
+	quantizeScalars(qScalars, v.scalars, shift)
 	return IntVector[I]{
 		scalars: qScalars,
 		shift:   shift,
 	}
 }
 
+// quantizeScalars quantizes src into dst, it is the allocation free core of
+// QuantizeFloatVector
+func quantizeScalars[I IntScalar, F FloatScalar](dst []I, src []F,
+	shift uint8) {
+
+	scale := F(int64(1) << shift)
+	for i := range src {
+		dst[i] = I(src[i] * scale)
+	}
+}
+
 func DequantizeIntVector[F FloatScalar, I IntScalar](
 	v IntVector[I]) FloatVector[F] {
 
+	// Divide rather than shift so the fractional bits aren't lost
+	scale := F(int64(1) << v.shift)
 	dScalars := make([]F, len(v.scalars))
 	for i, _ := range v.scalars {
-		dScalars[i] = F(v.scalars[i] >> v.shift)
+		dScalars[i] = F(v.scalars[i]) / scale
 	}
 	return FloatVector[F]{
 		scalars: dScalars,
 	}
 }
+
+// cosineSimilarity computes the cosine similarity of two vectors of any
+// scalar type with the fused loops of FloatVector and IntVector
+func cosineSimilarity[T VectorScalar](v, u []T) float64 {
+	switch v := any(v).(type) {
+	case []float32:
+		return FloatVector[float32]{scalars: v}.CosineSimilarity(
+			FloatVector[float32]{scalars: any(u).([]float32)})
+	case []float64:
+		return FloatVector[float64]{scalars: v}.CosineSimilarity(
+			FloatVector[float64]{scalars: any(u).([]float64)})
+	case []int8:
+		return IntVector[int8]{scalars: v}.CosineSimilarity(
+			IntVector[int8]{scalars: any(u).([]int8)})
+	case []int16:
+		return IntVector[int16]{scalars: v}.CosineSimilarity(
+			IntVector[int16]{scalars: any(u).([]int16)})
+	case []int32:
+		return IntVector[int32]{scalars: v}.CosineSimilarity(
+			IntVector[int32]{scalars: any(u).([]int32)})
+	}
+	return 0
+}
+
+// castScalars copies src into dst, converting each scalar to the type of dst
+func castScalars[D VectorScalar, S VectorScalar](dst []D, src []S) {
+	if same, ok := any(src).([]D); ok {
+		copy(dst, same)
+		return
+	}
+	for i := range src {
+		dst[i] = D(src[i])
+	}
+}
+
+// dotScalars computes the dot product of two vectors of any scalar type
+// without rescaling quantized scalars, which is enough for cosine
+// similarities as the shifts cancel out
+func dotScalars[T VectorScalar](v, u []T) float64 {
+	switch v := any(v).(type) {
+	case []float32:
+		return dotFloat32(v, any(u).([]float32))
+	case []int8:
+		return float64(dotInt8(v, any(u).([]int8)))
+	case []int16:
+		return float64(dotInt16(v, any(u).([]int16)))
+	}
+	d := float64(0)
+	for i := range v {
+		d += float64(v[i]) * float64(u[i])
+	}
+	return d
+}
+
+// dotInts computes the dot product of two int vectors with the int8 and int16
+// kernels
+func dotInts[I IntScalar](v, u []I) int64 {
+	switch v := any(v).(type) {
+	case []int8:
+		return dotInt8(v, any(u).([]int8))
+	case []int16:
+		return dotInt16(v, any(u).([]int16))
+	}
+	return dotIntGo(v, u)
+}
+
+// isKernelInt reports whether int vectors have kernels, for which a fused
+// loop isn't faster than three dot products
+func isKernelInt[I IntScalar](v []I) bool {
+	switch any(v).(type) {
+	case []int8, []int16:
+		return true
+	}
+	return false
+}
+
+// magnitudeScalars is the magnitude of a vector of any scalar type without
+// rescaling quantized scalars
+func magnitudeScalars[T VectorScalar](v []T) float64 {
+	return math.Sqrt(dotScalars(v, v))
+}
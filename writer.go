@@ -0,0 +1,133 @@
+/*
+
+Copyright (C) 2024 Jackie Deng
+
+Permission to use, copy, modify, and/or distribute this software for any
+purpose with or without fee is hereby granted.
+
+THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES WITH
+REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF MERCHANTABILITY AND
+FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY SPECIAL, DIRECT,
+INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES WHATSOEVER RESULTING FROM
+LOSS OF USE, DATA OR PROFITS, WHETHER IN AN ACTION OF CONTRACT, NEGLIGENCE OR
+OTHER TORTIOUS ACTION, ARISING OUT OF OR IN CONNECTION WITH THE USE OR
+PERFORMANCE OF THIS SOFTWARE.
+
+*/
+
+package gowe
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"unsafe"
+)
+
+/** Writers **/
+
+// createModelFile creates the file at p and writes to it with write, the
+// file is only reported as written successfully if it is also flushed and
+// closed successfully.
+func createModelFile(p string, write func(w io.Writer) error) error {
+	file, err := os.Create(p)
+	if err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(file)
+	if err := write(bw); err != nil {
+		file.Close()
+		return err
+	}
+	if err := bw.Flush(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// checkWords checks that words can be read back from the plaintext and
+// binary formats, where a word ends at the first space
+func checkWords(words []string) error {
+	for _, word := range words {
+		if word == "" || strings.ContainsAny(word, " \t\r\n") {
+			return fmt.Errorf("Word %q can't be written, words must not be "+
+				"empty or contain spaces, tabs or newlines", word)
+		}
+	}
+	return nil
+}
+
+// writePlainVectors writes the "<size> <dim>" description followed by a
+// plaintext line for each word
+func writePlainVectors[F FloatScalar](w io.Writer, dim uint, words []string,
+	vector func(word string) []F) error {
+
+	if err := checkWords(words); err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(w, "%d %d\n", len(words), dim); err != nil {
+		return err
+	}
+
+	var f F
+	bitSize := int(unsafe.Sizeof(f) * 8)
+	line := make([]byte, 0, 64)
+	for _, word := range words {
+		line = append(line[:0], word...)
+		for _, val := range vector(word) {
+			line = append(line, ' ')
+			line = strconv.AppendFloat(line, float64(val), 'g', -1, bitSize)
+		}
+		line = append(line, '\n')
+		if _, err := w.Write(line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeBinaryVectors writes the "<size> <dim>" description followed by each
+// word and its little endian vector of bitSize floats. Like the original
+// word2vec tool, each vector is followed by a newline.
+func writeBinaryVectors[F FloatScalar](w io.Writer, dim uint, words []string,
+	vector func(word string) []F, bitSize int) error {
+
+	if err := checkWords(words); err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(w, "%d %d\n", len(words), dim); err != nil {
+		return err
+	}
+
+	f32 := make([]float32, dim)
+	f64 := make([]float64, dim)
+	for _, word := range words {
+		if _, err := io.WriteString(w, word+" "); err != nil {
+			return err
+		}
+		var err error
+		if bitSize == 64 {
+			for i, val := range vector(word) {
+				f64[i] = float64(val)
+			}
+			err = binary.Write(w, binary.LittleEndian, f64)
+		} else {
+			for i, val := range vector(word) {
+				f32[i] = float32(val)
+			}
+			err = binary.Write(w, binary.LittleEndian, f32)
+		}
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write([]byte{'\n'}); err != nil {
+			return err
+		}
+	}
+	return nil
+}